@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/common"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel"
+	"github.com/spf13/cobra"
+	flowcontrol "k8s.io/api/flowcontrol/v1beta3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var (
+	matchUser           string
+	matchGroups         []string
+	matchServiceAccount string
+	matchVerb           string
+	matchResource       string
+	matchSubresource    string
+	matchNamespace      string
+	matchPath           string
+)
+
+// flowSchemaCmd 打印FlowSchema的匹配顺序，以及指定用户或ServiceAccount的请求会匹配的FlowSchema
+func flowSchemaCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "flowSchema",
+		Short: "show the effective flow schema order and which one a user or service account matches",
+		Long:  "",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			request, err := flowRequest()
+			if err != nil {
+				return err
+			}
+			k8sCfg := &common.K8sConfig{
+				Kubeconfig: kubeconfig,
+				Context:    kubeContext,
+				QPS:        kubeAPIQPS,
+				Burst:      kubeAPIBurst,
+				UserAgent:  userAgent,
+			}
+			client, err := k8sCfg.InitClientSet()
+			if err != nil {
+				return fmt.Errorf("init k8s client: %w", err)
+			}
+			list, err := client.FlowcontrolV1beta3().FlowSchemas().List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				return fmt.Errorf("list flow schemas: %w", err)
+			}
+			schemas := make([]*flowcontrol.FlowSchema, 0, len(list.Items))
+			for i := range list.Items {
+				schemas = append(schemas, &list.Items[i])
+			}
+
+			matched, ok := k8s_resource_otel.MatchFlowSchema(schemas, request)
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "MATCHED\tPRECEDENCE\tNAME\tPRIORITY LEVEL")
+			for _, fs := range k8s_resource_otel.OrderFlowSchemas(schemas) {
+				mark := ""
+				if ok && fs.Name == matched.Name {
+					mark = "*"
+				}
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", mark, fs.Spec.MatchingPrecedence, fs.Name, fs.Spec.PriorityLevelConfiguration.Name)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			if !ok {
+				fmt.Printf("\n%s matches no flow schema\n", request.User)
+				return nil
+			}
+			fmt.Printf("\n%s matches flow schema %q, priority level %q\n", request.User, matched.Name, matched.Spec.PriorityLevelConfiguration.Name)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&matchUser, "user", "", "user name sending the request")
+	cmd.Flags().StringSliceVar(&matchGroups, "groups", nil, "groups of the user")
+	cmd.Flags().StringVar(&matchServiceAccount, "service-account", "", "service account sending the request, namespace/name, overrides --user and --groups")
+	cmd.Flags().StringVar(&matchVerb, "verb", "list", "verb of the request")
+	cmd.Flags().StringVar(&matchResource, "resource", "pods", "resource of the request, resource.group for non-core groups, ex: deployments.apps")
+	cmd.Flags().StringVar(&matchSubresource, "subresource", "", "subresource of the request, ex: status")
+	cmd.Flags().StringVar(&matchNamespace, "namespace", "default", "namespace of the request, empty for cluster scoped requests")
+	cmd.Flags().StringVar(&matchPath, "non-resource-url", "", "path of a non-resource request, ex: /healthz, overrides --resource")
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "path to kubeconfig, defaults to in-cluster config, then $KUBECONFIG or ~/.kube/config")
+	cmd.Flags().StringVar(&kubeContext, "context", "", "kubeconfig context to use")
+	cmd.Flags().StringVar(&userAgent, "user-agent", common.DefaultUserAgent, "user agent to use while talking with kube-apiserver")
+	return cmd
+}
+
+// flowRequest 根据参数构造需要匹配的请求
+func flowRequest() (*k8s_resource_otel.FlowRequest, error) {
+	var request *k8s_resource_otel.FlowRequest
+	switch {
+	case matchServiceAccount != "":
+		namespace, name, ok := strings.Cut(matchServiceAccount, "/")
+		if !ok || namespace == "" || name == "" {
+			return nil, fmt.Errorf("invalid service account %q, must be namespace/name", matchServiceAccount)
+		}
+		request = k8s_resource_otel.NewServiceAccountRequest(namespace, name)
+	case matchUser != "":
+		request = k8s_resource_otel.NewUserRequest(matchUser, matchGroups)
+	default:
+		return nil, fmt.Errorf("one of --user or --service-account is required")
+	}
+	request.Verb = matchVerb
+	if matchPath != "" {
+		request.Path = matchPath
+		return request, nil
+	}
+	request.Resource, request.APIGroup, _ = strings.Cut(matchResource, ".")
+	request.Subresource = matchSubresource
+	request.Namespace = matchNamespace
+	return request, nil
+}
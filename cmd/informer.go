@@ -4,6 +4,42 @@ import (
 	"github.com/practice/opentelemetry-practice/pkg/common"
 	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel"
 	"github.com/spf13/cobra"
+	"time"
+)
+
+var (
+	namespaces        []string
+	allNamespaces     bool
+	excludeNamespaces []string
+	labelSelector     string
+	fieldSelector     string
+	spanStore         string
+	spanStoreFile     string
+	reconcileInterval time.Duration
+	terminalReasons   []string
+	eventMode         string
+	eventsAPI         string
+	workers           int
+	dynamicResources  string
+	traceNodes        bool
+	traceVolumes      bool
+	traceRBAC         bool
+	traceFlowControl  bool
+	traceEndpoints    bool
+
+	kubeconfig   string
+	kubeContext  string
+	kubeAPIQPS   float32
+	kubeAPIBurst int
+	userAgent    string
+
+	leaderElect              bool
+	leaderElectNamespace     string
+	leaderElectName          string
+	leaderElectIdentity      string
+	leaderElectLeaseDuration time.Duration
+	leaderElectRenewDeadline time.Duration
+	leaderElectRetryPeriod   time.Duration
 )
 
 func informerCmd() *cobra.Command {
@@ -11,14 +47,83 @@ func informerCmd() *cobra.Command {
 		Use:   "k8sInformer",
 		Short: "run k8s resource informer server",
 		Long:  "",
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
+			informerCfg := &common.InformerConfig{
+				Namespaces:           namespaces,
+				ExcludeNamespaces:    excludeNamespaces,
+				LabelSelector:        labelSelector,
+				FieldSelector:        fieldSelector,
+				SpanStore:            spanStore,
+				SpanStoreFile:        spanStoreFile,
+				ReconcileInterval:    reconcileInterval,
+				TerminalReasons:      terminalReasons,
+				EventMode:            eventMode,
+				EventsAPI:            eventsAPI,
+				Workers:              workers,
+				DynamicResourcesFile: dynamicResources,
+				TraceNodes:           traceNodes,
+				TraceVolumes:         traceVolumes,
+				TraceRBAC:            traceRBAC,
+				TraceFlowControl:     traceFlowControl,
+				TraceEndpoints:       traceEndpoints,
+			}
+			if allNamespaces {
+				informerCfg.Namespaces = nil
+			}
 			cfg := &common.ServerConfig{
 				Debug:          debug,
 				Port:           serverPort,
 				JaegerEndpoint: jaegerEndpoint,
+				Informer:       informerCfg,
+				K8s: &common.K8sConfig{
+					Kubeconfig: kubeconfig,
+					Context:    kubeContext,
+					QPS:        kubeAPIQPS,
+					Burst:      kubeAPIBurst,
+					UserAgent:  userAgent,
+				},
+				LeaderElection: &common.LeaderElectionConfig{
+					Enabled:       leaderElect,
+					Namespace:     leaderElectNamespace,
+					Name:          leaderElectName,
+					Identity:      leaderElectIdentity,
+					LeaseDuration: leaderElectLeaseDuration,
+					RenewDeadline: leaderElectRenewDeadline,
+					RetryPeriod:   leaderElectRetryPeriod,
+				},
 			}
-			k8s_resource_otel.K8sResourceInformer(cfg)
+			return k8s_resource_otel.K8sResourceInformer(cfg)
 		},
 	}
+	cmd.Flags().StringSliceVarP(&namespaces, "namespaces", "n", []string{"default"}, "namespaces to watch")
+	cmd.Flags().BoolVarP(&allNamespaces, "all-namespaces", "A", false, "watch all namespaces, overrides --namespaces")
+	cmd.Flags().StringSliceVar(&excludeNamespaces, "exclude-namespaces", nil, "namespaces to ignore, ex: kube-system")
+	cmd.Flags().StringVarP(&labelSelector, "label-selector", "l", "", "label selector for pods and workloads")
+	cmd.Flags().StringVar(&fieldSelector, "field-selector", "", "field selector for pods, ex: spec.nodeName=node1")
+	cmd.Flags().StringVar(&spanStore, "span-store", "", "where to persist pod trace context across restarts: memory, file or annotation, defaults to annotation with --leader-elect, otherwise memory")
+	cmd.Flags().StringVar(&spanStoreFile, "span-store-file", "./data/span-store.json", "file used when --span-store=file")
+	cmd.Flags().DurationVar(&reconcileInterval, "reconcile-interval", k8s_resource_otel.DefaultReconcileInterval, "interval to close spans of pods whose delete event was missed")
+	cmd.Flags().StringVar(&eventMode, "event-mode", k8s_resource_otel.EventModeSpan, "how pod events are recorded: span-event (events on the pod lifecycle span) or span (short child spans)")
+	cmd.Flags().StringVar(&eventsAPI, "events-api", k8s_resource_otel.EventsAPICoreV1, "events API to watch: core/v1 or events.k8s.io/v1")
+	cmd.Flags().BoolVar(&traceNodes, "trace-nodes", true, "trace node join, conditions, cordon and taints, and link pod spans to node problems")
+	cmd.Flags().BoolVar(&traceVolumes, "trace-volumes", true, "trace PVC provisioning and binding, and link pods waiting on volume mounts to the PVC trace")
+	cmd.Flags().BoolVar(&traceRBAC, "trace-rbac", false, "record changes of roles, cluster roles and their bindings as traces with rule and subject diffs")
+	cmd.Flags().BoolVar(&traceFlowControl, "trace-flowcontrol", false, "record changes of flow schemas and priority levels as traces with the effective flow schema order")
+	cmd.Flags().BoolVar(&traceEndpoints, "trace-endpoints", true, "record when pod addresses are added to, become ready in and are removed from service endpoint slices")
+	cmd.Flags().StringVar(&dynamicResources, "dynamic-resources-file", "", "rules file of additional resources (including CRDs) to trace with a dynamic informer")
+	cmd.Flags().IntVar(&workers, "workers", k8s_resource_otel.DefaultWorkers, "number of workers processing pod and event notifications, 0 processes them synchronously in informer callbacks")
+	cmd.Flags().StringSliceVar(&terminalReasons, "terminal-reasons", k8s_resource_otel.DefaultTerminalReasons, "pod reasons that end the pod lifecycle span, a trailing * matches failure reasons by prefix, ex: Init:CrashLoopBackOff or Init:Err*")
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "path to kubeconfig, defaults to in-cluster config, then $KUBECONFIG or ~/.kube/config")
+	cmd.Flags().StringVar(&kubeContext, "context", "", "kubeconfig context to use")
+	cmd.Flags().Float32Var(&kubeAPIQPS, "kube-api-qps", 0, "QPS to use while talking with kube-apiserver, 0 for client-go default")
+	cmd.Flags().IntVar(&kubeAPIBurst, "kube-api-burst", 0, "burst to use while talking with kube-apiserver, 0 for client-go default")
+	cmd.Flags().StringVar(&userAgent, "user-agent", common.DefaultUserAgent, "user agent to use while talking with kube-apiserver")
+	cmd.Flags().BoolVar(&leaderElect, "leader-elect", false, "enable leader election so only one replica emits spans")
+	cmd.Flags().StringVar(&leaderElectNamespace, "leader-elect-namespace", "default", "namespace of the leader election lease")
+	cmd.Flags().StringVar(&leaderElectName, "leader-elect-name", "k8s-informer-opentelemetry", "name of the leader election lease")
+	cmd.Flags().StringVar(&leaderElectIdentity, "leader-elect-identity", "", "identity of this replica, defaults to hostname")
+	cmd.Flags().DurationVar(&leaderElectLeaseDuration, "leader-elect-lease-duration", 15*time.Second, "duration that standby replicas wait before taking over")
+	cmd.Flags().DurationVar(&leaderElectRenewDeadline, "leader-elect-renew-deadline", 10*time.Second, "duration that the leader retries refreshing leadership before giving up")
+	cmd.Flags().DurationVar(&leaderElectRetryPeriod, "leader-elect-retry-period", 2*time.Second, "duration between leader election attempts")
 	return cmd
 }
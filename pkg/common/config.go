@@ -1,7 +1,68 @@
 package common
 
+import "time"
+
 type ServerConfig struct {
 	Debug          bool
 	Port           string
 	JaegerEndpoint string
+	// Informer k8sInformer使用的配置
+	Informer *InformerConfig
+	// K8s 连接集群使用的配置
+	K8s *K8sConfig
+	// LeaderElection 选主配置
+	LeaderElection *LeaderElectionConfig
+}
+
+// InformerConfig informer监听范围配置
+type InformerConfig struct {
+	// Namespaces 需要监听的namespace列表，为空时监听所有namespace
+	Namespaces []string
+	// ExcludeNamespaces 需要忽略的namespace列表，ex: kube-system
+	ExcludeNamespaces []string
+	// LabelSelector 过滤pod与工作负载的label selector
+	LabelSelector string
+	// FieldSelector 过滤pod的field selector，ex: spec.nodeName=node1
+	FieldSelector string
+	// SpanStore pod trace的持久化方式：memory file annotation
+	SpanStore string
+	// SpanStoreFile SpanStore为file时使用的文件路径
+	SpanStoreFile string
+	// ReconcileInterval 对比缓存与informer，结束错过删除事件的pod的周期
+	ReconcileInterval time.Duration
+	// TerminalReasons 结束pod生命周期span的reason，以*结尾时按前缀匹配失败的reason，为空时使用默认值
+	TerminalReasons []string
+	// EventMode pod event的记录方式：span-event(生命周期span上的event) span(短span)
+	EventMode string
+	// EventsAPI 监听的event API：core/v1 events.k8s.io/v1
+	EventsAPI string
+	// Workers 每个处理队列(pod event)的worker数量，为0时在informer回调中同步处理
+	Workers int
+	// TraceNodes 是否追踪node，需要集群级别的list/watch权限
+	TraceNodes bool
+	// TraceVolumes 是否追踪PVC与PV，需要集群级别的PV与StorageClass list/watch权限
+	TraceVolumes bool
+	// TraceRBAC 是否把Role ClusterRole及其binding的变更记录为trace
+	TraceRBAC bool
+	// TraceFlowControl 是否把FlowSchema与PriorityLevelConfiguration的变更记录为trace
+	TraceFlowControl bool
+	// TraceEndpoints 是否在pod的trace中记录其地址在EndpointSlice中的变化
+	TraceEndpoints bool
+	// DynamicResourcesFile dynamic informer的规则文件，为空时不监听其他资源
+	DynamicResourcesFile string
+}
+
+// LeaderElectionConfig 多副本运行时的选主配置，只有leader会记录trace
+type LeaderElectionConfig struct {
+	// Enabled 是否开启选主
+	Enabled bool
+	// Namespace Name Lease对象的namespace与名称
+	Namespace string
+	Name      string
+	// Identity 当前副本的身份，默认使用hostname
+	Identity string
+	// LeaseDuration RenewDeadline RetryPeriod 选主时间配置
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
 }
@@ -1,39 +1,87 @@
 package common
 
 import (
+	"errors"
+	"fmt"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/util/homedir"
-	"log"
-	"strings"
+	"k8s.io/klog/v2"
 )
 
+// DefaultUserAgent 访问apiserver时默认使用的user-agent
+const DefaultUserAgent = "k8s-informer-opentelemetry"
+
 type K8sConfig struct {
+	// Kubeconfig kubeconfig文件路径，为空时使用$KUBECONFIG(可以是多个文件合并)或~/.kube/config
+	Kubeconfig string
+	// Context 使用kubeconfig中的某个context，为空时使用current-context
+	Context string
+	// QPS Burst client限流配置，为0时使用client-go默认值
+	QPS   float32
+	Burst int
+	// UserAgent 访问apiserver时使用的user-agent
+	UserAgent string
 }
 
 func NewK8sConfig() *K8sConfig {
-	return &K8sConfig{}
+	return &K8sConfig{
+		UserAgent: DefaultUserAgent,
+	}
 }
 
-// 初始化 系统 配置
-// 取默认配置文件，大家可以自己修改路径和获取方式
-func (*K8sConfig) K8sRestConfig() *rest.Config {
-	homeDir := strings.Replace(homedir.HomeDir(), "\\", "/", -1)
-	config, err := clientcmd.BuildConfigFromFlags("", homeDir+"/.kube/config")
-	if err != nil {
-		log.Fatal(err)
+// K8sRestConfig 初始化 系统 配置
+// 1. 没有指定kubeconfig与context时，优先使用in-cluster配置，方便以pod方式运行在集群中，加载失败时使用kubeconfig
+// 2. 否则依次使用 --kubeconfig、$KUBECONFIG、~/.kube/config，并使用 --context 指定的context
+func (k *K8sConfig) K8sRestConfig() (*rest.Config, error) {
+	var config *rest.Config
+	if k.Kubeconfig == "" && k.Context == "" {
+		c, err := rest.InClusterConfig()
+		// 有in-cluster环境变量但读取不到service account token时，回退到kubeconfig
+		if err != nil && !errors.Is(err, rest.ErrNotInCluster) {
+			klog.Warningf("load in-cluster config: %v, fall back to kubeconfig", err)
+		}
+		config = c
 	}
-	return config
-}
 
-// 初始化client-go客户端
-func (this *K8sConfig) InitClientSet() *kubernetes.Clientset {
+	if config == nil {
+		rules := clientcmd.NewDefaultClientConfigLoadingRules()
+		rules.ExplicitPath = k.Kubeconfig
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: k.Context}
+		c, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("load kubeconfig: %w", err)
+		}
+		config = c
+	}
 
-	c, err := kubernetes.NewForConfig(this.K8sRestConfig())
+	if k.QPS > 0 {
+		config.QPS = k.QPS
+	}
+	if k.Burst > 0 {
+		config.Burst = k.Burst
+	}
+	if k.UserAgent != "" {
+		config.UserAgent = k.UserAgent
+	}
+	return config, nil
+}
+
+// InitClientSet 初始化client-go客户端
+func (k *K8sConfig) InitClientSet() (*kubernetes.Clientset, error) {
+	config, err := k.K8sRestConfig()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	return kubernetes.NewForConfig(config)
+}
 
-	return c
+// InitDynamicClient 初始化dynamic客户端，用于监听任意资源(包括CRD)
+func (k *K8sConfig) InitDynamicClient() (dynamic.Interface, error) {
+	config, err := k.K8sRestConfig()
+	if err != nil {
+		return nil, err
+	}
+	return dynamic.NewForConfig(config)
 }
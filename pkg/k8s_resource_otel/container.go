@@ -0,0 +1,269 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sync"
+	"time"
+)
+
+// GlobalContainerTracker 全局容器追踪器，由pod handler驱动
+var GlobalContainerTracker *ContainerTracker
+
+// containerSpan 一个容器(或init容器)的span
+type containerSpan struct {
+	ctx  context.Context
+	span oteltrace.Span
+	// containerID 当前容器实例的ID，重启后会变化
+	containerID string
+	// waitingReason 最近一次记录的等待原因，相同原因不重复记录
+	waitingReason string
+}
+
+// ContainerTracker 为pod的每个容器与init容器在生命周期span下创建子span，
+// 等待原因(ImagePullBackOff CrashLoopBackOff等)记录为event，每次重启记录为一个子span，
+// 包含退出码、信号、原因(ex: OOMKilled)与结束时间
+type ContainerTracker struct {
+	provider *trace.TracerProvider
+	lock     sync.Mutex
+	// containers 进行中的容器span，key为pod UID，内层key为容器名(init容器带init:前缀)
+	containers map[types.UID]map[string]*containerSpan
+	// now 获取当前时间，方便替换
+	now func() time.Time
+}
+
+func NewContainerTracker(provider *trace.TracerProvider) *ContainerTracker {
+	return &ContainerTracker{
+		provider:   provider,
+		containers: map[types.UID]map[string]*containerSpan{},
+		now:        time.Now,
+	}
+}
+
+// OnPodUpdate 对比新旧pod的容器状态，oldPod为nil时(新增或重放的pod)只根据当前状态记录
+func (c *ContainerTracker) OnPodUpdate(podCtx context.Context, oldPod, pod *v1.Pod) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	spans, ok := c.containers[pod.UID]
+	if !ok {
+		spans = map[string]*containerSpan{}
+		c.containers[pod.UID] = spans
+	}
+	var oldInit, oldContainers []v1.ContainerStatus
+	if oldPod != nil {
+		oldInit, oldContainers = oldPod.Status.InitContainerStatuses, oldPod.Status.ContainerStatuses
+	}
+	// pod已经结束，容器不会再重启
+	podFinished := pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed
+	for _, status := range pod.Status.InitContainerStatuses {
+		c.update(podCtx, spans, "init:"+status.Name, true, findContainerStatus(oldInit, status.Name), status, podFinished)
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		c.update(podCtx, spans, status.Name, false, findContainerStatus(oldContainers, status.Name), status, podFinished)
+	}
+}
+
+// OnPodDelete 结束pod所有还未结束的容器span
+func (c *ContainerTracker) OnPodDelete(uid types.UID) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, cs := range c.containers[uid] {
+		if cs.span.IsRecording() {
+			cs.span.End()
+		}
+	}
+	delete(c.containers, uid)
+}
+
+func (c *ContainerTracker) update(podCtx context.Context, spans map[string]*containerSpan, key string, init bool, old *v1.ContainerStatus, status v1.ContainerStatus, podFinished bool) {
+	cs, ok := spans[key]
+	if !ok {
+		cs = c.start(podCtx, status, init)
+		spans[key] = cs
+		if old == nil && status.RestartCount > 0 {
+			// 第一次看到容器时已经重启过，只能拿到最后一次的终止状态
+			c.recordRestart(cs, status, status.RestartCount)
+		}
+	}
+	if !cs.span.IsRecording() {
+		return
+	}
+
+	if status.ContainerID != cs.containerID {
+		cs.containerID = status.ContainerID
+		cs.span.SetAttributes(attribute.KeyValue{
+			Key:   "containerID",
+			Value: attribute.StringValue(status.ContainerID),
+		})
+	}
+
+	waitingReason := ""
+	if status.State.Waiting != nil {
+		waitingReason = status.State.Waiting.Reason
+	}
+	if waitingReason != cs.waitingReason {
+		cs.waitingReason = waitingReason
+		if waitingReason != "" {
+			cs.span.AddEvent("waiting", oteltrace.WithAttributes(
+				attribute.KeyValue{
+					Key:   "reason",
+					Value: attribute.StringValue(waitingReason),
+				},
+				attribute.KeyValue{
+					Key:   "message",
+					Value: attribute.StringValue(status.State.Waiting.Message),
+				},
+				attribute.KeyValue{
+					Key:   "restartCount",
+					Value: attribute.IntValue(int(status.RestartCount)),
+				},
+			))
+		}
+	}
+
+	if old != nil && status.RestartCount > old.RestartCount {
+		c.recordRestart(cs, status, status.RestartCount-old.RestartCount)
+	}
+
+	// init容器成功退出，或pod已经结束时，容器不会再运行
+	if terminated := status.State.Terminated; terminated != nil && ((init && terminated.ExitCode == 0) || podFinished) {
+		cs.span.SetAttributes(terminatedAttributes(terminated)...)
+		if terminated.ExitCode != 0 {
+			cs.span.SetStatus(codes.Error, terminatedReason(terminated))
+		}
+		end := terminated.FinishedAt.Time
+		if end.IsZero() {
+			end = c.now()
+		}
+		cs.span.End(oteltrace.WithTimestamp(end))
+	}
+}
+
+// start 开启容器span，从容器(最近一次)开始运行的时间开始，还没运行时从当前时间开始
+func (c *ContainerTracker) start(podCtx context.Context, status v1.ContainerStatus, init bool) *containerSpan {
+	name := "container-" + status.Name
+	if init {
+		name = "init-container-" + status.Name
+	}
+	startTime := c.now()
+	switch {
+	case status.State.Running != nil && !status.State.Running.StartedAt.IsZero():
+		startTime = status.State.Running.StartedAt.Time
+	case status.State.Terminated != nil && !status.State.Terminated.StartedAt.IsZero():
+		startTime = status.State.Terminated.StartedAt.Time
+	}
+	ctx, span := c.provider.Tracer("containers").Start(podCtx, name, oteltrace.WithTimestamp(startTime))
+	span.SetAttributes(
+		attribute.KeyValue{
+			Key:   "container",
+			Value: attribute.StringValue(status.Name),
+		},
+		attribute.KeyValue{
+			Key:   "init",
+			Value: attribute.BoolValue(init),
+		},
+		attribute.KeyValue{
+			Key:   "image",
+			Value: attribute.StringValue(status.Image),
+		},
+		attribute.KeyValue{
+			Key:   "imageID",
+			Value: attribute.StringValue(status.ImageID),
+		},
+	)
+	return &containerSpan{ctx: ctx, span: span}
+}
+
+// recordRestart 以上一次的终止状态记录重启span，时间为上一个容器实例的运行时间，
+// restarts为两次更新之间的重启次数，CrashLoop时kubelet可能在一次更新中累计多次重启，
+// 只有最后一次的终止状态，其余的重启记录在restarts属性中
+func (c *ContainerTracker) recordRestart(cs *containerSpan, status v1.ContainerStatus, restarts int32) {
+	restartAttrs := []attribute.KeyValue{
+		{
+			Key:   "restartCount",
+			Value: attribute.IntValue(int(status.RestartCount)),
+		},
+		{
+			Key:   "restarts",
+			Value: attribute.IntValue(int(restarts)),
+		},
+	}
+	terminated := status.LastTerminationState.Terminated
+	if terminated == nil {
+		cs.span.AddEvent("restart", oteltrace.WithAttributes(restartAttrs...))
+		return
+	}
+	var startOpts []oteltrace.SpanStartOption
+	if !terminated.StartedAt.IsZero() {
+		startOpts = append(startOpts, oteltrace.WithTimestamp(terminated.StartedAt.Time))
+	}
+	name := fmt.Sprintf("%s(restart %d) - %s", status.Name, status.RestartCount, terminatedReason(terminated))
+	if restarts > 1 {
+		name = fmt.Sprintf("%s(restart %d-%d) - %s", status.Name, status.RestartCount-restarts+1, status.RestartCount, terminatedReason(terminated))
+	}
+	_, span := c.provider.Tracer("containers").Start(cs.ctx, name, startOpts...)
+	span.SetAttributes(terminatedAttributes(terminated)...)
+	span.SetAttributes(restartAttrs...)
+	if terminated.ExitCode != 0 {
+		span.SetStatus(codes.Error, terminatedReason(terminated))
+	}
+	var endOpts []oteltrace.SpanEndOption
+	if !terminated.FinishedAt.IsZero() {
+		endOpts = append(endOpts, oteltrace.WithTimestamp(terminated.FinishedAt.Time))
+	}
+	span.End(endOpts...)
+}
+
+// terminatedAttributes 容器终止状态的属性
+func terminatedAttributes(terminated *v1.ContainerStateTerminated) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		{
+			Key:   "exitCode",
+			Value: attribute.IntValue(int(terminated.ExitCode)),
+		},
+		{
+			Key:   "signal",
+			Value: attribute.IntValue(int(terminated.Signal)),
+		},
+		{
+			Key:   "reason",
+			Value: attribute.StringValue(terminated.Reason),
+		},
+		{
+			Key:   "message",
+			Value: attribute.StringValue(terminated.Message),
+		},
+		{
+			Key:   "finishedAt",
+			Value: attribute.StringValue(terminated.FinishedAt.String()),
+		},
+	}
+}
+
+// terminatedReason 与kubectl一致：优先使用reason，没有时使用信号或退出码
+func terminatedReason(terminated *v1.ContainerStateTerminated) string {
+	switch {
+	case terminated.Reason != "":
+		return terminated.Reason
+	case terminated.Signal != 0:
+		return fmt.Sprintf("Signal:%d", terminated.Signal)
+	}
+	return fmt.Sprintf("ExitCode:%d", terminated.ExitCode)
+}
+
+func findContainerStatus(statuses []v1.ContainerStatus, name string) *v1.ContainerStatus {
+	for i := range statuses {
+		if statuses[i].Name == name {
+			return &statuses[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+	"log"
+	"strings"
+	"sync"
+)
+
+var _ cache.ResourceEventHandler = &DynamicHandler{}
+
+// DynamicHandler 根据规则处理任意资源(包括CRD)，与工作负载一样每个对象拥有自己的生命周期trace，
+// SpanInfo保存在WorkloadCtxSet中，由CRD创建的子资源与pod可以通过OwnerReferences加入其trace
+type DynamicHandler struct {
+	provider *trace.TracerProvider
+	rule     *compiledRule
+	// lock JSONPath不能并发执行，多个namespace的informer共用同一规则
+	lock sync.Mutex
+}
+
+func NewDynamicHandler(rule *compiledRule) *DynamicHandler {
+	return &DynamicHandler{
+		provider: GlobalJaegerProvider,
+		rule:     rule,
+	}
+}
+
+func (d *DynamicHandler) tracer() oteltrace.Tracer {
+	return d.provider.Tracer(d.rule.gvr.Resource)
+}
+
+func (d *DynamicHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// 有owner时加入owner的trace，否则新建trace
+	parentCtx := context.Background()
+	if owner, ok := ownerSpanInfo(u.GetOwnerReferences()); ok {
+		parentCtx = owner.Ctx
+	}
+	// 接管leader时重放的对象已经在追踪
+	if _, ok := WorkloadCtxSet.Peek(u.GetUID()); ok {
+		return
+	}
+	spanInfo := startLifecycle(d.tracer(), parentCtx, u, evalJSONPath(d.rule.spanName, u),
+		fmt.Sprintf("%s-lifecycle", strings.ToLower(d.rule.kind)), isInInitialList, d.attributes(u)...)
+	WorkloadCtxSet.Add(u.GetUID(), spanInfo)
+
+	// 初始列表中已经结束的对象
+	d.finish(oteltrace.SpanFromContext(spanInfo.Ctx), u)
+}
+
+func (d *DynamicHandler) OnUpdate(oldObj, newObj interface{}) {
+	old, ok := oldObj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	u, ok := newObj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	// resync时对象未变化，不需要记录
+	if old.GetResourceVersion() == u.GetResourceVersion() {
+		return
+	}
+
+	spanInfo, ok := WorkloadCtxSet.Get(u.GetUID())
+	if !ok {
+		log.Println("not found carrier:", u.GetKind(), u.GetName())
+		return
+	}
+	newCtx := otel.GetTextMapPropagator().Extract(context.Background(), spanInfo.Carrier)
+	tracer := d.tracer()
+
+	// 1. spec变更
+	if old.GetGeneration() != u.GetGeneration() {
+		_, span := tracer.Start(newCtx, fmt.Sprintf("spec-change(generation %d)", u.GetGeneration()))
+		span.SetAttributes(d.attributes(u)...)
+		span.End()
+	}
+
+	// 2. 进度字段变化
+	for _, p := range d.rule.progress {
+		oldValue, value := evalJSONPath(p, old), evalJSONPath(p, u)
+		if oldValue == value {
+			continue
+		}
+		_, span := tracer.Start(newCtx, fmt.Sprintf("progress %s -> %s", oldValue, value))
+		span.SetAttributes(d.attributes(u)...)
+		span.End()
+		break
+	}
+
+	// 3. 满足成功或失败条件时结束生命周期span
+	d.finish(oteltrace.SpanFromContext(spanInfo.Ctx), u)
+}
+
+func (d *DynamicHandler) OnDelete(obj interface{}) {
+	obj, finalStateUnknown := unwrapTombstone(obj)
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	spanInfo, ok := WorkloadCtxSet.Get(u.GetUID())
+	if !ok {
+		log.Println("not found carrier:", u.GetKind(), u.GetName())
+		return
+	}
+	WorkloadCtxSet.Remove(u.GetUID())
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	endLifecycle(d.tracer(), spanInfo, u, strings.ToLower(d.rule.kind), evalJSONPath(d.rule.spanName, u), finalStateUnknown, d.attributes(u)...)
+}
+
+// finish 生命周期span还在记录时，按失败、成功条件的顺序判断是否结束
+func (d *DynamicHandler) finish(lifeSpan oteltrace.Span, u *unstructured.Unstructured) {
+	if !lifeSpan.IsRecording() {
+		return
+	}
+	for _, c := range d.rule.failure {
+		if desc, ok := c.match(u); ok {
+			lifeSpan.SetAttributes(d.attributes(u)...)
+			lifeSpan.SetStatus(codes.Error, desc)
+			lifeSpan.End()
+			return
+		}
+	}
+	for _, c := range d.rule.success {
+		if desc, ok := c.match(u); ok {
+			lifeSpan.SetAttributes(d.attributes(u)...)
+			lifeSpan.SetStatus(codes.Ok, desc)
+			lifeSpan.End()
+			return
+		}
+	}
+}
+
+// attributes 规则中配置的属性，以及对象的基本信息
+func (d *DynamicHandler) attributes(u *unstructured.Unstructured) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		{
+			Key:   "kind",
+			Value: attribute.StringValue(u.GetKind()),
+		},
+		{
+			Key:   "apiVersion",
+			Value: attribute.StringValue(u.GetAPIVersion()),
+		},
+		{
+			Key:   "namespace",
+			Value: attribute.StringValue(u.GetNamespace()),
+		},
+		{
+			Key:   "name",
+			Value: attribute.StringValue(u.GetName()),
+		},
+	}
+	for name, p := range d.rule.attributes {
+		attrs = append(attrs, attribute.KeyValue{
+			Key:   attribute.Key(name),
+			Value: attribute.StringValue(evalJSONPath(p, u)),
+		})
+	}
+	return attrs
+}
@@ -0,0 +1,239 @@
+package k8s_resource_otel
+
+import (
+	"bytes"
+	"fmt"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/util/jsonpath"
+	"os"
+	"sigs.k8s.io/yaml"
+	"strings"
+)
+
+// DynamicResourceRules dynamic informer的规则文件，ex:
+//
+//	resources:
+//	- group: argoproj.io
+//	  version: v1alpha1
+//	  resource: rollouts
+//	  spanName: "rollout-{.metadata.name}/{.metadata.namespace}"
+//	  attributes:
+//	    replicas: "{.spec.replicas}"
+//	    phase: "{.status.phase}"
+//	  progress: ["{.status.readyReplicas}", "{.status.updatedReplicas}"]
+//	  success:
+//	  - jsonPath: "{.status.phase}"
+//	    value: Healthy
+//	  failure:
+//	  - type: Progressing
+//	    status: "False"
+//	    reason: ProgressDeadlineExceeded
+//
+// 表达式使用kubectl的JSONPath模板语法
+type DynamicResourceRules struct {
+	Resources []DynamicResourceRule `json:"resources"`
+}
+
+// DynamicResourceRule 一种资源的规则
+type DynamicResourceRule struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	// SpanName 根span名称的模板，为空时使用 kind-名称/namespace，集群级别的资源使用 kind-名称
+	SpanName string `json:"spanName"`
+	// Attributes 记录到span的属性，key为属性名，value为模板
+	Attributes map[string]string `json:"attributes"`
+	// Progress 表示进度的字段，任意字段变化时记录一个progress span
+	Progress []string `json:"progress"`
+	// Success Failure 任意一个条件满足时，以成功或失败结束生命周期span
+	Success []ConditionRule `json:"success"`
+	Failure []ConditionRule `json:"failure"`
+}
+
+// ConditionRule 结束条件：匹配status.conditions中的condition，或JSONPath的值，未设置的字段不参与匹配
+type ConditionRule struct {
+	// Type Status Reason 匹配status.conditions
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+	// JSONPath Value JSONPath模板的结果等于Value
+	JSONPath string `json:"jsonPath"`
+	Value    string `json:"value"`
+}
+
+// LoadDynamicResourceRules 读取并校验规则文件，使用前需要通过ResolveDynamicResourceRules确定资源的Kind与scope
+func LoadDynamicResourceRules(path string) ([]*compiledRule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read dynamic resource rules %s: %w", path, err)
+	}
+	rules := &DynamicResourceRules{}
+	if err := yaml.UnmarshalStrict(b, rules); err != nil {
+		return nil, fmt.Errorf("decode dynamic resource rules %s: %w", path, err)
+	}
+	compiled := make([]*compiledRule, 0, len(rules.Resources))
+	for i := range rules.Resources {
+		c, err := compileRule(&rules.Resources[i])
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// ResolveDynamicResourceRules 通过discovery确认规则中的资源存在，并确定资源的Kind与scope，
+// 资源不存在时直接返回错误，而不是让informer一直等待同步
+func ResolveDynamicResourceRules(client discovery.DiscoveryInterface, rules []*compiledRule) error {
+	groupResources, err := restmapper.GetAPIGroupResources(client)
+	if err != nil {
+		return fmt.Errorf("discover api resources: %w", err)
+	}
+	mapper := restmapper.NewDiscoveryRESTMapper(groupResources)
+	for _, c := range rules {
+		if err := c.resolve(mapper); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compiledRule 解析后的规则
+type compiledRule struct {
+	gvr schema.GroupVersionResource
+	// kind clusterScoped 由discovery确定
+	kind          string
+	clusterScoped bool
+	spanName      *jsonpath.JSONPath
+	attributes    map[string]*jsonpath.JSONPath
+	progress      []*jsonpath.JSONPath
+	success       []compiledCondition
+	failure       []compiledCondition
+}
+
+type compiledCondition struct {
+	ConditionRule
+	jsonPath *jsonpath.JSONPath
+}
+
+func compileRule(r *DynamicResourceRule) (*compiledRule, error) {
+	if r.Version == "" || r.Resource == "" {
+		return nil, fmt.Errorf("dynamic resource rule must set version and resource: %+v", *r)
+	}
+	gvr := schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+	c := &compiledRule{gvr: gvr, attributes: map[string]*jsonpath.JSONPath{}}
+
+	// 没有设置时在resolve中使用discovery得到的Kind
+	var err error
+	if r.SpanName != "" {
+		if c.spanName, err = parseJSONPath(gvr, "spanName", r.SpanName); err != nil {
+			return nil, err
+		}
+	}
+	for name, tmpl := range r.Attributes {
+		if c.attributes[name], err = parseJSONPath(gvr, name, tmpl); err != nil {
+			return nil, err
+		}
+	}
+	for i, tmpl := range r.Progress {
+		p, err := parseJSONPath(gvr, fmt.Sprintf("progress[%d]", i), tmpl)
+		if err != nil {
+			return nil, err
+		}
+		c.progress = append(c.progress, p)
+	}
+	if c.success, err = compileConditions(gvr, "success", r.Success); err != nil {
+		return nil, err
+	}
+	if c.failure, err = compileConditions(gvr, "failure", r.Failure); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// resolve 通过RESTMapper确定资源的Kind与scope，并生成默认的span名称模板
+func (c *compiledRule) resolve(mapper meta.RESTMapper) error {
+	gvk, err := mapper.KindFor(c.gvr)
+	if err != nil {
+		return fmt.Errorf("dynamic resource %s not found: %w", c.gvr, err)
+	}
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return fmt.Errorf("dynamic resource %s: %w", c.gvr, err)
+	}
+	c.kind = gvk.Kind
+	// 集群级别的资源不按namespace过滤
+	c.clusterScoped = mapping.Scope.Name() == meta.RESTScopeNameRoot
+
+	if c.spanName == nil {
+		spanName := strings.ToLower(gvk.Kind) + "-{.metadata.name}"
+		if !c.clusterScoped {
+			spanName += "/{.metadata.namespace}"
+		}
+		if c.spanName, err = parseJSONPath(c.gvr, "spanName", spanName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compileConditions(gvr schema.GroupVersionResource, name string, rules []ConditionRule) ([]compiledCondition, error) {
+	conditions := make([]compiledCondition, 0, len(rules))
+	for i, r := range rules {
+		c := compiledCondition{ConditionRule: r}
+		if r.JSONPath != "" {
+			p, err := parseJSONPath(gvr, fmt.Sprintf("%s[%d]", name, i), r.JSONPath)
+			if err != nil {
+				return nil, err
+			}
+			c.jsonPath = p
+		} else if r.Type == "" {
+			return nil, fmt.Errorf("%s %s[%d]: must set type or jsonPath", gvr, name, i)
+		}
+		conditions = append(conditions, c)
+	}
+	return conditions, nil
+}
+
+func parseJSONPath(gvr schema.GroupVersionResource, name, tmpl string) (*jsonpath.JSONPath, error) {
+	p := jsonpath.New(name).AllowMissingKeys(true)
+	if err := p.Parse(tmpl); err != nil {
+		return nil, fmt.Errorf("%s %s: invalid jsonpath %q: %w", gvr, name, tmpl, err)
+	}
+	return p, nil
+}
+
+// evalJSONPath 执行模板，出错时返回空字符串
+func evalJSONPath(p *jsonpath.JSONPath, obj *unstructured.Unstructured) string {
+	buf := &bytes.Buffer{}
+	if err := p.Execute(buf, obj.Object); err != nil {
+		return ""
+	}
+	return buf.String()
+}
+
+// match 对象是否满足条件，满足时返回描述
+func (c compiledCondition) match(obj *unstructured.Unstructured) (string, bool) {
+	if c.jsonPath != nil {
+		v := evalJSONPath(c.jsonPath, obj)
+		return fmt.Sprintf("%s=%s", c.JSONPath, v), v == c.Value
+	}
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, item := range conditions {
+		cond, ok := item.(map[string]interface{})
+		if !ok || cond["type"] != c.Type {
+			continue
+		}
+		status, _ := cond["status"].(string)
+		reason, _ := cond["reason"].(string)
+		message, _ := cond["message"].(string)
+		if (c.Status == "" || c.Status == status) && (c.Reason == "" || c.Reason == reason) {
+			return fmt.Sprintf("%s=%s %s: %s", c.Type, status, reason, message), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,292 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ cache.ResourceEventHandler = &EndpointSliceHandler{}
+
+// endpointSpan 一个pod地址在EndpointSlice中的span，从加入到移除
+type endpointSpan struct {
+	ctx  context.Context
+	span oteltrace.Span
+	// ready serving terminating 最近一次记录的endpoint condition
+	ready       bool
+	serving     bool
+	terminating bool
+	// gapObserved 已经统计过与pod Ready的间隔，只统计第一次变为ready
+	gapObserved bool
+}
+
+// EndpointSliceHandler 在pod生命周期span下记录pod地址加入Service endpoints、
+// ready/serving/terminating变化与移除，并统计pod Ready到endpoint ready的间隔。
+// 状态按已记录的endpoint对比，接管leader时重放的对象不会重复记录
+type EndpointSliceHandler struct {
+	provider *trace.TracerProvider
+	// pods 查找pod的Ready时间，每个scope一个lister
+	pods []corelisters.PodLister
+	lock sync.Mutex
+	// slices 每个EndpointSlice中已记录的endpoint，内层key为pod UID
+	slices map[types.UID]map[types.UID]*endpointSpan
+	// now 获取当前时间，方便替换
+	now func() time.Time
+}
+
+func NewEndpointSliceHandler(pods []corelisters.PodLister) *EndpointSliceHandler {
+	return &EndpointSliceHandler{
+		provider: GlobalJaegerProvider,
+		pods:     pods,
+		slices:   map[types.UID]map[types.UID]*endpointSpan{},
+		now:      time.Now,
+	}
+}
+
+func (e *EndpointSliceHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	if slice, ok := obj.(*discoveryv1.EndpointSlice); ok {
+		e.sync(nil, slice, isInInitialList)
+	}
+}
+
+func (e *EndpointSliceHandler) OnUpdate(oldObj, newObj interface{}) {
+	if slice, ok := newObj.(*discoveryv1.EndpointSlice); ok {
+		old, _ := oldObj.(*discoveryv1.EndpointSlice)
+		e.sync(old, slice, false)
+	}
+}
+
+// OnDelete Service删除或slice被合并时，slice中的地址全部移除
+func (e *EndpointSliceHandler) OnDelete(obj interface{}) {
+	obj, _ = unwrapTombstone(obj)
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, es := range e.slices[slice.UID] {
+		e.remove(es, slice)
+	}
+	delete(e.slices, slice.UID)
+}
+
+// sync 对比slice中的endpoint与已记录的endpoint，oldSlice为informer中的上一个版本，新增时为nil
+func (e *EndpointSliceHandler) sync(oldSlice, slice *discoveryv1.EndpointSlice, isInInitialList bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	// 上一个版本中endpoint的ready，只有观察到从not ready变为ready时才统计与pod Ready的间隔
+	oldReady := map[types.UID]bool{}
+	if oldSlice != nil {
+		for _, endpoint := range oldSlice.Endpoints {
+			if ref := endpoint.TargetRef; ref != nil && ref.Kind == "Pod" {
+				oldReady[ref.UID] = endpointReady(endpoint)
+			}
+		}
+	}
+
+	recorded, ok := e.slices[slice.UID]
+	if !ok {
+		recorded = map[types.UID]*endpointSpan{}
+		e.slices[slice.UID] = recorded
+	}
+	current := map[types.UID]bool{}
+	for _, endpoint := range slice.Endpoints {
+		ref := endpoint.TargetRef
+		if ref == nil || ref.Kind != "Pod" {
+			continue
+		}
+		current[ref.UID] = true
+		es, ok := recorded[ref.UID]
+		if !ok {
+			spanInfo, ok := PodCtxSet.Get(ref.UID)
+			if !ok {
+				continue
+			}
+			es = e.add(spanInfo, slice, endpoint, isInInitialList)
+			recorded[ref.UID] = es
+		}
+		wasReady, seen := oldReady[ref.UID]
+		e.update(es, slice, endpoint, seen && !wasReady)
+	}
+	for uid, es := range recorded {
+		if !current[uid] {
+			e.remove(es, slice)
+			delete(recorded, uid)
+		}
+	}
+}
+
+// add pod地址加入slice，开启endpoint span
+func (e *EndpointSliceHandler) add(spanInfo *SpanInfo, slice *discoveryv1.EndpointSlice, endpoint discoveryv1.Endpoint, isInInitialList bool) *endpointSpan {
+	ctx, span := e.provider.Tracer("endpoints").Start(spanInfo.Ctx, fmt.Sprintf("endpoint %s/%s", slice.Namespace, serviceName(slice)))
+	span.SetAttributes(
+		attribute.KeyValue{
+			Key:   "service",
+			Value: attribute.StringValue(serviceName(slice)),
+		},
+		attribute.KeyValue{
+			Key:   "endpointSlice",
+			Value: attribute.StringValue(slice.Name),
+		},
+		attribute.KeyValue{
+			Key:   "addressType",
+			Value: attribute.StringValue(string(slice.AddressType)),
+		},
+		attribute.KeyValue{
+			Key:   "addresses",
+			Value: attribute.StringSliceValue(endpoint.Addresses),
+		},
+		attribute.KeyValue{
+			Key:   "ports",
+			Value: attribute.StringValue(endpointPorts(slice.Ports)),
+		},
+		attribute.KeyValue{
+			Key:   "discoveredOnStartup",
+			Value: attribute.BoolValue(isInInitialList),
+		},
+	)
+	if endpoint.NodeName != nil {
+		span.SetAttributes(attribute.KeyValue{
+			Key:   "node",
+			Value: attribute.StringValue(*endpoint.NodeName),
+		})
+	}
+	return &endpointSpan{ctx: ctx, span: span}
+}
+
+// update endpoint condition变化时记录一个短span，
+// 上一个版本中endpoint为not ready(wasNotReady)且变为ready时统计与pod Ready的间隔
+func (e *EndpointSliceHandler) update(es *endpointSpan, slice *discoveryv1.EndpointSlice, endpoint discoveryv1.Endpoint, wasNotReady bool) {
+	// 与EndpointSlice API一致：serving为空时与ready相同，terminating为空时视为false
+	ready := endpointReady(endpoint)
+	serving := ready
+	if endpoint.Conditions.Serving != nil {
+		serving = *endpoint.Conditions.Serving
+	}
+	terminating := endpoint.Conditions.Terminating != nil && *endpoint.Conditions.Terminating
+
+	tracer := e.provider.Tracer("endpoints")
+	for _, c := range []struct {
+		name  string
+		old   *bool
+		value bool
+	}{
+		{name: "ready", old: &es.ready, value: ready},
+		{name: "serving", old: &es.serving, value: serving},
+		{name: "terminating", old: &es.terminating, value: terminating},
+	} {
+		if *c.old == c.value {
+			continue
+		}
+		*c.old = c.value
+		_, span := tracer.Start(es.ctx, fmt.Sprintf("%s %s=%t", serviceName(slice), c.name, c.value))
+		span.SetAttributes(
+			attribute.KeyValue{
+				Key:   "condition",
+				Value: attribute.StringValue(c.name),
+			},
+			attribute.KeyValue{
+				Key:   "value",
+				Value: attribute.BoolValue(c.value),
+			},
+		)
+		span.End()
+	}
+	es.span.SetAttributes(
+		attribute.KeyValue{
+			Key:   "ready",
+			Value: attribute.BoolValue(ready),
+		},
+		attribute.KeyValue{
+			Key:   "serving",
+			Value: attribute.BoolValue(serving),
+		},
+		attribute.KeyValue{
+			Key:   "terminating",
+			Value: attribute.BoolValue(terminating),
+		},
+	)
+
+	// 第一次看到的endpoint(初始列表、新增的slice、pod有trace前已经ready)无法得到真实的间隔
+	if ready && wasNotReady && !es.gapObserved {
+		es.gapObserved = true
+		if readyTime, ok := e.podReadyTime(endpoint.TargetRef.Namespace, endpoint.TargetRef.Name); ok {
+			gap := e.now().Sub(readyTime)
+			es.span.SetAttributes(attribute.KeyValue{
+				Key:   "podReadyGap",
+				Value: attribute.StringValue(gap.String()),
+			})
+			InformerMetrics.EndpointReadyGapHistogramVec.WithLabelValues(slice.Namespace).Observe(gap.Seconds())
+		}
+	}
+}
+
+// remove pod地址从slice中移除，结束endpoint span
+func (e *EndpointSliceHandler) remove(es *endpointSpan, slice *discoveryv1.EndpointSlice) {
+	es.span.AddEvent("removed", oteltrace.WithAttributes(attribute.KeyValue{
+		Key:   "endpointSlice",
+		Value: attribute.StringValue(slice.Name),
+	}))
+	es.span.End()
+}
+
+// podReadyTime pod Ready condition变为True的时间
+func (e *EndpointSliceHandler) podReadyTime(namespace, name string) (time.Time, bool) {
+	for _, lister := range e.pods {
+		pod, err := lister.Pods(namespace).Get(name)
+		if err != nil {
+			continue
+		}
+		cond := podCondition(pod, v1.PodReady)
+		if cond == nil || cond.Status != v1.ConditionTrue || cond.LastTransitionTime.IsZero() {
+			return time.Time{}, false
+		}
+		return cond.LastTransitionTime.Time, true
+	}
+	return time.Time{}, false
+}
+
+// endpointReady 与EndpointSlice API一致，ready为空时视为true
+func endpointReady(endpoint discoveryv1.Endpoint) bool {
+	return endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+}
+
+// serviceName slice所属的Service
+func serviceName(slice *discoveryv1.EndpointSlice) string {
+	if name, ok := slice.Labels[discoveryv1.LabelServiceName]; ok {
+		return name
+	}
+	return slice.Name
+}
+
+// endpointPorts ex: http:80/TCP,grpc:9090/TCP
+func endpointPorts(ports []discoveryv1.EndpointPort) string {
+	s := make([]string, 0, len(ports))
+	for _, port := range ports {
+		var name, protocol string
+		var number int32
+		if port.Name != nil {
+			name = *port.Name
+		}
+		if port.Port != nil {
+			number = *port.Port
+		}
+		if port.Protocol != nil {
+			protocol = string(*port.Protocol)
+		}
+		s = append(s, fmt.Sprintf("%s:%d/%s", name, number, protocol))
+	}
+	return strings.Join(s, ",")
+}
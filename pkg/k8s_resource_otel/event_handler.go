@@ -1,60 +1,316 @@
 package k8s_resource_otel
 
 import (
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/lru"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/cache"
+	"sync"
+	"time"
 )
 
+const (
+	// EventModeSpanEvent EventModeSpan event的记录方式：生命周期span上的span event，或一个短span
+	EventModeSpanEvent = "span-event"
+	EventModeSpan      = "span"
+
+	// EventsAPICoreV1 EventsAPIEventsV1 监听的event API
+	EventsAPICoreV1   = "core/v1"
+	EventsAPIEventsV1 = "events.k8s.io/v1"
+
+	// eventPendingTTL pod还没有进入PodCtxSet时，event的缓冲时间
+	eventPendingTTL = 30 * time.Second
+	// eventSeenTTL 记录event已处理count的时间，超过后同一event的更新会被当作新event
+	eventSeenTTL = time.Hour
+)
+
+// GlobalEventRecorder 全局event记录器，由event handler与pod handler共同驱动
+var GlobalEventRecorder *EventRecorder
+
 var _ cache.ResourceEventHandler = &EventHandler{}
 
+// k8sEvent core/v1与events.k8s.io/v1 event的统一形式
+type k8sEvent struct {
+	UID       types.UID
+	Type      string
+	Reason    string
+	Message   string
+	Action    string
+	Regarding v1.ObjectReference
+	// Related 与event相关的另一个对象，ex: Preempted event中的抢占者
+	Related *v1.ObjectReference
+	// ReportingController 产生event的组件
+	ReportingController string
+	// Count event(series)发生的次数
+	Count int32
+	// FirstTime LastTime 第一次与最近一次发生的时间
+	FirstTime time.Time
+	LastTime  time.Time
+}
 
-type EventHandler struct {
-	provider *trace.TracerProvider
+// fromCoreEvent 转换core/v1 event
+func fromCoreEvent(event *v1.Event) *k8sEvent {
+	e := &k8sEvent{
+		UID:                 event.UID,
+		Type:                event.Type,
+		Reason:              event.Reason,
+		Message:             event.Message,
+		Action:              event.Action,
+		Regarding:           event.InvolvedObject,
+		Related:             event.Related,
+		ReportingController: event.ReportingController,
+		Count:               event.Count,
+		FirstTime:           event.FirstTimestamp.Time,
+		LastTime:            event.LastTimestamp.Time,
+	}
+	if e.ReportingController == "" {
+		e.ReportingController = event.Source.Component
+	}
+	if e.FirstTime.IsZero() {
+		e.FirstTime = event.EventTime.Time
+	}
+	if event.Series != nil {
+		e.Count = event.Series.Count
+		e.LastTime = event.Series.LastObservedTime.Time
+	}
+	e.normalize(event.CreationTimestamp.Time)
+	return e
 }
 
-func NewEventHandler() *EventHandler {
-	return &EventHandler{
-		provider: GlobalJaegerProvider,
+// fromEventsV1 转换events.k8s.io/v1 event
+func fromEventsV1(event *eventsv1.Event) *k8sEvent {
+	e := &k8sEvent{
+		UID:                 event.UID,
+		Type:                event.Type,
+		Reason:              event.Reason,
+		Message:             event.Note,
+		Action:              event.Action,
+		Regarding:           event.Regarding,
+		Related:             event.Related,
+		ReportingController: event.ReportingController,
+		Count:               event.DeprecatedCount,
+		FirstTime:           event.EventTime.Time,
+		LastTime:            event.DeprecatedLastTimestamp.Time,
+	}
+	if e.FirstTime.IsZero() {
+		e.FirstTime = event.DeprecatedFirstTimestamp.Time
+	}
+	if event.Series != nil {
+		e.Count = event.Series.Count
+		e.LastTime = event.Series.LastObservedTime.Time
 	}
+	e.normalize(event.CreationTimestamp.Time)
+	return e
 }
 
-func (e EventHandler) OnAdd(obj interface{}, isInInitialList bool) {
-	if event, ok := obj.(*v1.Event); ok {
-		// 获取pod引起的event，并拿到缓存中的span，并设置trace
-		if event.InvolvedObject.Kind == "Pod" {
-			podID := event.InvolvedObject.UID
-			v, ok := PodCtxSet.Get(podID)
-			if !ok {
-				return
-			}
-			spanInfo := v.(*SpanInfo)
-
-			tracer := e.provider.Tracer("events")
-			_, evtSpan := tracer.
-				Start(spanInfo.RootCtx, event.Reason)
-			defer evtSpan.End()
-
-			evtSpan.SetAttributes(
-				attribute.KeyValue{
-					Key:   "message",
-					Value: attribute.StringValue(event.Message),
-				},
-			)
+// normalize 补全缺失的次数与时间
+func (e *k8sEvent) normalize(created time.Time) {
+	if e.Count <= 0 {
+		e.Count = 1
+	}
+	if e.FirstTime.IsZero() {
+		e.FirstTime = created
+	}
+	if e.LastTime.IsZero() {
+		e.LastTime = e.FirstTime
+	}
+}
+
+func (e *k8sEvent) attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		{
+			Key:   "message",
+			Value: attribute.StringValue(e.Message),
+		},
+		{
+			Key:   "type",
+			Value: attribute.StringValue(e.Type),
+		},
+		{
+			Key:   "reason",
+			Value: attribute.StringValue(e.Reason),
+		},
+		{
+			Key:   "action",
+			Value: attribute.StringValue(e.Action),
+		},
+		{
+			Key:   "reportingController",
+			Value: attribute.StringValue(e.ReportingController),
+		},
+		{
+			Key:   "count",
+			Value: attribute.IntValue(int(e.Count)),
+		},
+		{
+			Key:   "firstTimestamp",
+			Value: attribute.StringValue(e.FirstTime.String()),
+		},
+		{
+			Key:   "eventUID",
+			Value: attribute.StringValue(string(e.UID)),
+		},
+	}
+}
 
+// EventRecorder 把event记录到对象(pod 工作负载等)的生命周期span上，
+// 按event UID与count去重，pod还没有进入PodCtxSet时先缓冲，pod加入后再记录
+type EventRecorder struct {
+	provider *trace.TracerProvider
+	// mode 记录为span event或短span
+	mode string
+	// seen 每个event已经记录的count
+	seen *lru.Cache[types.UID, int32]
+	// lock 保护pending的读取与追加，以及seen的检查与标记
+	lock sync.Mutex
+	// pending 等待pod加入PodCtxSet的event，key为pod UID
+	pending *lru.Cache[types.UID, []*k8sEvent]
+	// rolling 没有生命周期trace的对象的滚动trace
+	rolling *rollingTraces
+	// scheduling 调度相关的event记录到pod的调度span
+	scheduling *SchedulingTracker
+	// volumes 挂载相关的event同时记录到PVC的trace
+	volumes *VolumeHandler
+}
+
+func NewEventRecorder(provider *trace.TracerProvider, mode string) *EventRecorder {
+	seenConfig := lru.NewCacheConfig[types.UID, int32](eventSeenTTL, 0, nil)
+	seenConfig.CleanupInterval = time.Minute
+	pendingConfig := lru.NewCacheConfig[types.UID, []*k8sEvent](eventPendingTTL, 0, nil)
+	pendingConfig.CleanupInterval = eventPendingTTL
+	return &EventRecorder{
+		provider:   provider,
+		mode:       mode,
+		seen:       lru.NewCache(seenConfig.TTLCacheMode(), seenConfig),
+		pending:    lru.NewCache(pendingConfig.TTLCacheMode(), pendingConfig),
+		rolling:    newRollingTraces(provider),
+		scheduling: GlobalSchedulingTracker,
+		volumes:    GlobalVolumeHandler,
+	}
+}
+
+// Record 记录一个event，已经记录过相同count的event会被忽略，
+// Flush在pod的worker中执行，可能与event的worker同时记录同一个event，去重的检查与标记在锁内完成
+func (r *EventRecorder) Record(e *k8sEvent) {
+	if e.Regarding.Kind != "Pod" && !eventObjectKinds[e.Regarding.Kind] {
+		return
+	}
+	if count, ok := r.seen.Peek(e.UID); ok && count >= e.Count {
+		return
+	}
+	if e.Regarding.Kind != "Pod" {
+		r.lock.Lock()
+		claimed := r.claim(e)
+		r.lock.Unlock()
+		if claimed {
+			r.recordObject(e)
 		}
+		return
 	}
+	spanInfo, ok := PodCtxSet.Get(e.Regarding.UID)
+	r.lock.Lock()
+	if !ok {
+		// 持有锁后再检查一次，避免pod在两次检查之间加入，而Flush已经执行过
+		if spanInfo, ok = PodCtxSet.Peek(e.Regarding.UID); !ok {
+			events, _ := r.pending.Peek(e.Regarding.UID)
+			r.pending.Add(e.Regarding.UID, append(events, e))
+			r.lock.Unlock()
+			return
+		}
+	}
+	claimed := r.claim(e)
+	r.lock.Unlock()
+	if !claimed {
+		return
+	}
+	if r.scheduling.RecordEvent(e) {
+		return
+	}
+	r.volumes.RecordEvent(e)
+	r.record(spanInfo, e)
 }
 
-func (e EventHandler) OnUpdate(oldObj, newObj interface{}) {
+// claim event还没有以相同或更大的count记录过时标记为已记录，返回是否需要记录，调用方需持有锁
+func (r *EventRecorder) claim(e *k8sEvent) bool {
+	if count, ok := r.seen.Peek(e.UID); ok && count >= e.Count {
+		return false
+	}
+	r.seen.Add(e.UID, e.Count)
+	return true
 }
 
-func (e EventHandler) OnDelete(obj interface{}) {
+// Flush pod加入PodCtxSet后，记录缓冲中的event
+func (r *EventRecorder) Flush(podUID types.UID) {
+	r.lock.Lock()
+	events, ok := r.pending.Peek(podUID)
+	if ok {
+		r.pending.Remove(podUID)
+	}
+	r.lock.Unlock()
+	for _, e := range events {
+		r.Record(e)
+	}
+}
+
+// recordObject 记录非pod对象的event，对象有生命周期trace(ex: 工作负载)时加入该trace，
+// 否则加入对象的滚动trace
+func (r *EventRecorder) recordObject(e *k8sEvent) {
+	spanInfo, ok := ObjectSpanInfo(e.Regarding.Kind, e.Regarding.UID)
+	if !ok {
+		spanInfo = r.rolling.get(e.Regarding)
+	}
+	r.record(spanInfo, e)
+}
+
+// record 生命周期span还在记录时，mode为span-event则记录为span event，否则记录为一个短span
+func (r *EventRecorder) record(spanInfo *SpanInfo, e *k8sEvent) {
+	lifeSpan := oteltrace.SpanFromContext(spanInfo.Ctx)
+	if r.mode == EventModeSpanEvent && lifeSpan.IsRecording() {
+		lifeSpan.AddEvent(e.Reason, oteltrace.WithTimestamp(e.LastTime), oteltrace.WithAttributes(e.attributes()...))
+		return
+	}
+
+	_, evtSpan := r.provider.Tracer("events").
+		Start(spanInfo.Ctx, fmt.Sprintf("%s(%d)", e.Reason, e.Count), oteltrace.WithTimestamp(e.LastTime))
+	defer evtSpan.End(oteltrace.WithTimestamp(e.LastTime))
 
+	evtSpan.SetAttributes(e.attributes()...)
 }
 
+// EventHandler 处理core/v1与events.k8s.io/v1的event
+type EventHandler struct {
+	recorder *EventRecorder
+}
+
+func NewEventHandler() *EventHandler {
+	return &EventHandler{
+		recorder: GlobalEventRecorder,
+	}
+}
+
+func (e EventHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	e.handle(obj)
+}
 
+// OnUpdate event重复发生时会更新count(series)，新的count会再记录一次
+func (e EventHandler) OnUpdate(oldObj, newObj interface{}) {
+	e.handle(newObj)
+}
 
+func (e EventHandler) OnDelete(obj interface{}) {
 
+}
 
+func (e EventHandler) handle(obj interface{}) {
+	switch event := obj.(type) {
+	case *v1.Event:
+		e.recorder.Record(fromCoreEvent(event))
+	case *eventsv1.Event:
+		e.recorder.Record(fromEventsV1(event))
+	}
+}
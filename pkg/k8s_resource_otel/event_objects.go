@@ -0,0 +1,119 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/lru"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sync"
+	"time"
+)
+
+const (
+	// eventRollingWindow 没有生命周期trace的对象，event记录在按时间滚动的trace中，每个窗口一个trace
+	eventRollingWindow = time.Hour
+	// eventRollingMaxEntries 同时存在的滚动trace数量
+	eventRollingMaxEntries = 4096
+)
+
+// eventObjectKinds 除pod外，记录event的对象类型
+var eventObjectKinds = map[string]bool{
+	"Node":                    true,
+	"Deployment":              true,
+	"ReplicaSet":              true,
+	"StatefulSet":             true,
+	"DaemonSet":               true,
+	"Job":                     true,
+	"CronJob":                 true,
+	"PersistentVolumeClaim":   true,
+	"Service":                 true,
+	"HorizontalPodAutoscaler": true,
+}
+
+// objectKey 以kind/UID标识一个对象
+type objectKey struct {
+	Kind string
+	UID  types.UID
+}
+
+// ObjectSpanInfo 根据kind/UID查找对象的生命周期SpanInfo
+func ObjectSpanInfo(kind string, uid types.UID) (*SpanInfo, bool) {
+	switch kind {
+	case "Pod":
+		return PodCtxSet.Get(uid)
+	case "Deployment", "ReplicaSet", "StatefulSet", "DaemonSet", "Job", "CronJob":
+		return WorkloadCtxSet.Get(uid)
+	case "Node":
+		return GlobalNodeHandler.spanInfo(uid)
+	case "PersistentVolumeClaim":
+		return GlobalVolumeHandler.spanInfo(uid)
+	}
+	return nil, false
+}
+
+// rollingTraces 没有生命周期trace的对象的滚动trace，过期或淘汰时结束根span
+type rollingTraces struct {
+	provider *trace.TracerProvider
+	// lock 避免同一对象同时开启多个trace
+	lock   sync.Mutex
+	traces *lru.Cache[objectKey, *SpanInfo]
+}
+
+func newRollingTraces(provider *trace.TracerProvider) *rollingTraces {
+	cacheConfig := lru.NewCacheConfig[objectKey, *SpanInfo](eventRollingWindow, eventRollingMaxEntries, lru.ChangeCallbacks[objectKey, *SpanInfo]{
+		EvictFunc: func(_ objectKey, spanInfo *SpanInfo, _ lru.EvictReason) {
+			oteltrace.SpanFromContext(spanInfo.RootCtx).End()
+		},
+	})
+	cacheConfig.CleanupInterval = time.Minute
+	return &rollingTraces{
+		provider: provider,
+		traces:   lru.NewCache(cacheConfig.LRUWithTTLCacheMode(), cacheConfig),
+	}
+}
+
+// get 获取对象当前窗口的trace，没有时开启一个新的trace
+func (r *rollingTraces) get(ref v1.ObjectReference) *SpanInfo {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := objectKey{Kind: ref.Kind, UID: ref.UID}
+	if spanInfo, ok := r.traces.Get(key); ok {
+		return spanInfo
+	}
+	ctx, span := r.provider.Tracer("events").Start(context.Background(), fmt.Sprintf("%s-%s/%s(events)", ref.Kind, ref.Name, ref.Namespace))
+	span.SetAttributes(
+		attribute.KeyValue{
+			Key:   "kind",
+			Value: attribute.StringValue(ref.Kind),
+		},
+		attribute.KeyValue{
+			Key:   "name",
+			Value: attribute.StringValue(ref.Name),
+		},
+		attribute.KeyValue{
+			Key:   "namespace",
+			Value: attribute.StringValue(ref.Namespace),
+		},
+		attribute.KeyValue{
+			Key:   "uid",
+			Value: attribute.StringValue(string(ref.UID)),
+		},
+	)
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	spanInfo := &SpanInfo{
+		RootCtx: ctx,
+		Ctx:     ctx,
+		Carrier: carrier,
+		Key:     ref.Namespace + "/" + ref.Name,
+	}
+	r.traces.Add(key, spanInfo)
+	return spanInfo
+}
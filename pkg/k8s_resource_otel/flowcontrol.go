@@ -0,0 +1,440 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/k8shelper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace"
+	flowcontrol "k8s.io/api/flowcontrol/v1beta3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	flowcontrollisters "k8s.io/client-go/listers/flowcontrol/v1beta3"
+	"k8s.io/client-go/tools/cache"
+	"log"
+	"sort"
+	"strings"
+)
+
+const (
+	// serviceAccountUsernamePrefix ServiceAccount的用户名前缀，ex: system:serviceaccount:kube-system:default
+	serviceAccountUsernamePrefix = "system:serviceaccount:"
+	// serviceAccountsGroup 所有ServiceAccount所在的组
+	serviceAccountsGroup = "system:serviceaccounts"
+	// authenticatedGroup 所有通过认证的用户所在的组
+	authenticatedGroup = "system:authenticated"
+)
+
+var _ cache.ResourceEventHandler = &FlowControlHandler{}
+
+// FlowRequest 用于匹配FlowSchema的请求，Path不为空时为非资源请求(ex: /healthz)
+type FlowRequest struct {
+	User   string
+	Groups []string
+	Verb   string
+	// APIGroup Resource Subresource Namespace 资源请求的字段，Namespace为空时为集群级别的请求
+	APIGroup    string
+	Resource    string
+	Subresource string
+	Namespace   string
+	Path        string
+}
+
+// NewServiceAccountRequest ServiceAccount发出的请求，用户名与组与apiserver认证后的一致
+func NewServiceAccountRequest(namespace, name string) *FlowRequest {
+	return &FlowRequest{
+		User:   serviceAccountUsernamePrefix + namespace + ":" + name,
+		Groups: []string{serviceAccountsGroup, serviceAccountsGroup + ":" + namespace, authenticatedGroup},
+	}
+}
+
+// NewUserRequest 普通用户发出的请求，总是属于system:authenticated组
+func NewUserRequest(user string, groups []string) *FlowRequest {
+	return &FlowRequest{
+		User:   user,
+		Groups: sets.List(sets.New[string](groups...).Insert(authenticatedGroup)),
+	}
+}
+
+// OrderFlowSchemas 按apiserver的匹配顺序排列FlowSchema：matchingPrecedence小的优先，相同时按名字排序
+func OrderFlowSchemas(schemas []*flowcontrol.FlowSchema) []*flowcontrol.FlowSchema {
+	ordered := append(k8shelper.FlowSchemaSequence{}, schemas...)
+	sort.Sort(ordered)
+	return ordered
+}
+
+// MatchFlowSchema 按匹配顺序找出请求匹配的第一个FlowSchema，没有匹配时返回false
+func MatchFlowSchema(schemas []*flowcontrol.FlowSchema, r *FlowRequest) (*flowcontrol.FlowSchema, bool) {
+	for _, fs := range OrderFlowSchemas(schemas) {
+		for i := range fs.Spec.Rules {
+			if matchesPolicyRule(r, &fs.Spec.Rules[i]) {
+				return fs, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func matchesPolicyRule(r *FlowRequest, rule *flowcontrol.PolicyRulesWithSubjects) bool {
+	matched := false
+	for _, subject := range rule.Subjects {
+		if matchesSubject(r, subject) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+	if r.Path != "" {
+		for _, nr := range rule.NonResourceRules {
+			if containsName(nr.Verbs, r.Verb, flowcontrol.VerbAll) && matchesNonResourceURL(nr.NonResourceURLs, r.Path) {
+				return true
+			}
+		}
+		return false
+	}
+	resource := r.Resource
+	if r.Subresource != "" {
+		resource += "/" + r.Subresource
+	}
+	for _, rr := range rule.ResourceRules {
+		if !containsName(rr.Verbs, r.Verb, flowcontrol.VerbAll) ||
+			!containsName(rr.APIGroups, r.APIGroup, flowcontrol.APIGroupAll) ||
+			!containsName(rr.Resources, resource, flowcontrol.ResourceAll) {
+			continue
+		}
+		if r.Namespace == "" {
+			if rr.ClusterScope {
+				return true
+			}
+			continue
+		}
+		if containsName(rr.Namespaces, r.Namespace, flowcontrol.NamespaceEvery) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesSubject(r *FlowRequest, subject flowcontrol.Subject) bool {
+	switch subject.Kind {
+	case flowcontrol.SubjectKindUser:
+		return subject.User != nil && (subject.User.Name == flowcontrol.NameAll || subject.User.Name == r.User)
+	case flowcontrol.SubjectKindGroup:
+		return subject.Group != nil && (subject.Group.Name == flowcontrol.NameAll || sets.New[string](r.Groups...).Has(subject.Group.Name))
+	case flowcontrol.SubjectKindServiceAccount:
+		if subject.ServiceAccount == nil {
+			return false
+		}
+		namespace, name, ok := strings.Cut(strings.TrimPrefix(r.User, serviceAccountUsernamePrefix), ":")
+		if !ok || !strings.HasPrefix(r.User, serviceAccountUsernamePrefix) || namespace != subject.ServiceAccount.Namespace {
+			return false
+		}
+		return subject.ServiceAccount.Name == flowcontrol.NameAll || subject.ServiceAccount.Name == name
+	}
+	return false
+}
+
+// matchesNonResourceURL 规则中的URL为*、完全相同，或以/*结尾且请求路径以其为前缀
+func matchesNonResourceURL(urls []string, path string) bool {
+	for _, url := range urls {
+		if url == flowcontrol.NonResourceAll || url == path {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(url, "*"); ok && strings.HasSuffix(prefix, "/") && strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsName(names []string, name, all string) bool {
+	for _, n := range names {
+		if n == all || n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FlowControlHandler 把FlowSchema与PriorityLevelConfiguration的变更记录为span，
+// 每次FlowSchema变更后记录生效的匹配顺序，用于排查controller被APF限流的问题
+type FlowControlHandler struct {
+	provider *trace.TracerProvider
+	// schemas 计算变更后的匹配顺序
+	schemas flowcontrollisters.FlowSchemaLister
+}
+
+func NewFlowControlHandler(schemas flowcontrollisters.FlowSchemaLister) *FlowControlHandler {
+	return &FlowControlHandler{
+		provider: GlobalJaegerProvider,
+		schemas:  schemas,
+	}
+}
+
+// OnAdd 初始列表中的对象已经存在，只记录新创建的对象
+func (f *FlowControlHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	if isInInitialList {
+		return
+	}
+	f.record("create", nil, obj)
+}
+
+// OnUpdate 只记录spec变化，apiserver会周期更新status
+func (f *FlowControlHandler) OnUpdate(oldObj, newObj interface{}) {
+	oldMeta, ok := flowControlMeta(oldObj)
+	if !ok {
+		return
+	}
+	meta, ok := flowControlMeta(newObj)
+	if !ok || oldMeta.Generation == meta.Generation {
+		return
+	}
+	f.record("update", oldObj, newObj)
+}
+
+func (f *FlowControlHandler) OnDelete(obj interface{}) {
+	obj, _ = unwrapTombstone(obj)
+	f.record("delete", obj, nil)
+}
+
+// record old为nil时为创建，obj为nil时为删除
+func (f *FlowControlHandler) record(verb string, old, obj interface{}) {
+	current := obj
+	if current == nil {
+		current = old
+	}
+	meta, ok := flowControlMeta(current)
+	if !ok {
+		return
+	}
+	kind := "FlowSchema"
+	if _, ok := current.(*flowcontrol.PriorityLevelConfiguration); ok {
+		kind = "PriorityLevelConfiguration"
+	}
+
+	_, span := f.provider.Tracer("flowcontrol").Start(context.Background(), fmt.Sprintf("%s %s/%s", verb, kind, meta.Name))
+	defer span.End()
+	span.SetAttributes(
+		attribute.KeyValue{
+			Key:   "kind",
+			Value: attribute.StringValue(kind),
+		},
+		attribute.KeyValue{
+			Key:   "name",
+			Value: attribute.StringValue(meta.Name),
+		},
+		attribute.KeyValue{
+			Key:   "verb",
+			Value: attribute.StringValue(verb),
+		},
+		attribute.KeyValue{
+			Key:   "generation",
+			Value: attribute.IntValue(int(meta.Generation)),
+		},
+	)
+	if old != nil && obj != nil {
+		span.SetAttributes(attribute.KeyValue{
+			Key:   "changes",
+			Value: attribute.StringSliceValue(flowControlChanges(old, obj)),
+		})
+	}
+
+	switch o := current.(type) {
+	case *flowcontrol.FlowSchema:
+		span.SetAttributes(flowSchemaAttributes(o)...)
+		order, err := f.effectiveOrder()
+		if err != nil {
+			log.Println("list flow schemas err:", err)
+			return
+		}
+		span.SetAttributes(attribute.KeyValue{
+			Key:   "effectiveOrder",
+			Value: attribute.StringSliceValue(order),
+		})
+	case *flowcontrol.PriorityLevelConfiguration:
+		span.SetAttributes(priorityLevelAttributes(o)...)
+	}
+}
+
+// effectiveOrder 变更后FlowSchema的匹配顺序，ex: 1000 system-leader-election -> leader-election
+func (f *FlowControlHandler) effectiveOrder() ([]string, error) {
+	schemas, err := f.schemas.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	order := make([]string, 0, len(schemas))
+	for _, fs := range OrderFlowSchemas(schemas) {
+		order = append(order, fmt.Sprintf("%d %s -> %s", fs.Spec.MatchingPrecedence, fs.Name, fs.Spec.PriorityLevelConfiguration.Name))
+	}
+	return order, nil
+}
+
+func flowControlMeta(obj interface{}) (*metav1.ObjectMeta, bool) {
+	switch o := obj.(type) {
+	case *flowcontrol.FlowSchema:
+		return &o.ObjectMeta, true
+	case *flowcontrol.PriorityLevelConfiguration:
+		return &o.ObjectMeta, true
+	}
+	return nil, false
+}
+
+// flowControlChanges spec中变化的字段，ex: matchingPrecedence: 1000 -> 500，
+// 规则按内容对比，记录新增与删除的规则，ex: rule added: subjects=Group:system:nodes ...
+func flowControlChanges(old, obj interface{}) []string {
+	var changes []string
+	change := func(field string, oldValue, value interface{}) {
+		if o, n := fmt.Sprint(oldValue), fmt.Sprint(value); o != n {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", field, o, n))
+		}
+	}
+	switch o := obj.(type) {
+	case *flowcontrol.FlowSchema:
+		oldFS, ok := old.(*flowcontrol.FlowSchema)
+		if !ok {
+			return nil
+		}
+		change("matchingPrecedence", oldFS.Spec.MatchingPrecedence, o.Spec.MatchingPrecedence)
+		change("priorityLevelConfiguration", oldFS.Spec.PriorityLevelConfiguration.Name, o.Spec.PriorityLevelConfiguration.Name)
+		change("distinguisherMethod", distinguisherMethod(oldFS), distinguisherMethod(o))
+		added, removed := diffStrings(flowRuleStrings(oldFS.Spec.Rules), flowRuleStrings(o.Spec.Rules))
+		for _, rule := range added {
+			changes = append(changes, "rule added: "+rule)
+		}
+		for _, rule := range removed {
+			changes = append(changes, "rule removed: "+rule)
+		}
+	case *flowcontrol.PriorityLevelConfiguration:
+		oldPL, ok := old.(*flowcontrol.PriorityLevelConfiguration)
+		if !ok {
+			return nil
+		}
+		change("type", oldPL.Spec.Type, o.Spec.Type)
+		if oldPL.Spec.Limited != nil && o.Spec.Limited != nil {
+			change("nominalConcurrencyShares", oldPL.Spec.Limited.NominalConcurrencyShares, o.Spec.Limited.NominalConcurrencyShares)
+			change("lendablePercent", int32Value(oldPL.Spec.Limited.LendablePercent), int32Value(o.Spec.Limited.LendablePercent))
+			change("borrowingLimitPercent", int32Value(oldPL.Spec.Limited.BorrowingLimitPercent), int32Value(o.Spec.Limited.BorrowingLimitPercent))
+			change("limitResponse", limitResponse(oldPL), limitResponse(o))
+		}
+	}
+	return changes
+}
+
+// flowRuleStrings 每条规则的字符串形式，用于对比，
+// ex: subjects=Group:system:nodes resourceRules=[verbs=* apiGroups=* resources=* namespaces=* clusterScope]
+func flowRuleStrings(rules []flowcontrol.PolicyRulesWithSubjects) []string {
+	s := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		subjects := make([]string, 0, len(rule.Subjects))
+		for _, subject := range rule.Subjects {
+			subjects = append(subjects, flowSubjectString(subject))
+		}
+		parts := []string{"subjects=" + strings.Join(subjects, ",")}
+		for _, rr := range rule.ResourceRules {
+			r := fmt.Sprintf("verbs=%s apiGroups=%s resources=%s", strings.Join(rr.Verbs, ","),
+				strings.Join(rr.APIGroups, ","), strings.Join(rr.Resources, ","))
+			if len(rr.Namespaces) != 0 {
+				r += " namespaces=" + strings.Join(rr.Namespaces, ",")
+			}
+			if rr.ClusterScope {
+				r += " clusterScope"
+			}
+			parts = append(parts, "resourceRules=["+r+"]")
+		}
+		for _, nr := range rule.NonResourceRules {
+			parts = append(parts, fmt.Sprintf("nonResourceRules=[verbs=%s nonResourceURLs=%s]",
+				strings.Join(nr.Verbs, ","), strings.Join(nr.NonResourceURLs, ",")))
+		}
+		s = append(s, strings.Join(parts, " "))
+	}
+	return s
+}
+
+// flowSubjectString ex: User:admin Group:system:nodes ServiceAccount:kube-system/default
+func flowSubjectString(subject flowcontrol.Subject) string {
+	switch {
+	case subject.User != nil:
+		return fmt.Sprintf("%s:%s", subject.Kind, subject.User.Name)
+	case subject.Group != nil:
+		return fmt.Sprintf("%s:%s", subject.Kind, subject.Group.Name)
+	case subject.ServiceAccount != nil:
+		return fmt.Sprintf("%s:%s/%s", subject.Kind, subject.ServiceAccount.Namespace, subject.ServiceAccount.Name)
+	}
+	return string(subject.Kind)
+}
+
+func flowSchemaAttributes(fs *flowcontrol.FlowSchema) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		{
+			Key:   "matchingPrecedence",
+			Value: attribute.IntValue(int(fs.Spec.MatchingPrecedence)),
+		},
+		{
+			Key:   "priorityLevelConfiguration",
+			Value: attribute.StringValue(fs.Spec.PriorityLevelConfiguration.Name),
+		},
+		{
+			Key:   "distinguisherMethod",
+			Value: attribute.StringValue(distinguisherMethod(fs)),
+		},
+		{
+			Key:   "rules",
+			Value: attribute.IntValue(len(fs.Spec.Rules)),
+		},
+	}
+}
+
+func priorityLevelAttributes(pl *flowcontrol.PriorityLevelConfiguration) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		{
+			Key:   "type",
+			Value: attribute.StringValue(string(pl.Spec.Type)),
+		},
+	}
+	if limited := pl.Spec.Limited; limited != nil {
+		attrs = append(attrs,
+			attribute.KeyValue{
+				Key:   "nominalConcurrencyShares",
+				Value: attribute.IntValue(int(limited.NominalConcurrencyShares)),
+			},
+			attribute.KeyValue{
+				Key:   "lendablePercent",
+				Value: attribute.IntValue(int(int32Value(limited.LendablePercent))),
+			},
+			attribute.KeyValue{
+				Key:   "limitResponse",
+				Value: attribute.StringValue(limitResponse(pl)),
+			},
+		)
+	}
+	return attrs
+}
+
+func distinguisherMethod(fs *flowcontrol.FlowSchema) string {
+	if fs.Spec.DistinguisherMethod == nil {
+		return ""
+	}
+	return string(fs.Spec.DistinguisherMethod.Type)
+}
+
+// limitResponse 与kubectl一致，Queue时带上队列参数，ex: Queue(queues=64 handSize=6 queueLengthLimit=50)
+func limitResponse(pl *flowcontrol.PriorityLevelConfiguration) string {
+	if pl.Spec.Limited == nil {
+		return ""
+	}
+	response := pl.Spec.Limited.LimitResponse
+	if q := response.Queuing; q != nil {
+		return fmt.Sprintf("%s(queues=%d handSize=%d queueLengthLimit=%d)", response.Type, q.Queues, q.HandSize, q.QueueLengthLimit)
+	}
+	return string(response.Type)
+}
+
+func int32Value(p *int32) int32 {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
@@ -0,0 +1,207 @@
+package k8s_resource_otel
+
+import (
+	flowcontrol "k8s.io/api/flowcontrol/v1beta3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+)
+
+func newFlowSchema(name string, precedence int32, rules ...flowcontrol.PolicyRulesWithSubjects) *flowcontrol.FlowSchema {
+	return &flowcontrol.FlowSchema{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: flowcontrol.FlowSchemaSpec{
+			PriorityLevelConfiguration: flowcontrol.PriorityLevelConfigurationReference{Name: name},
+			MatchingPrecedence:         precedence,
+			Rules:                      rules,
+		},
+	}
+}
+
+func userSubject(name string) flowcontrol.Subject {
+	return flowcontrol.Subject{Kind: flowcontrol.SubjectKindUser, User: &flowcontrol.UserSubject{Name: name}}
+}
+
+func groupSubject(name string) flowcontrol.Subject {
+	return flowcontrol.Subject{Kind: flowcontrol.SubjectKindGroup, Group: &flowcontrol.GroupSubject{Name: name}}
+}
+
+func serviceAccountSubject(namespace, name string) flowcontrol.Subject {
+	return flowcontrol.Subject{Kind: flowcontrol.SubjectKindServiceAccount,
+		ServiceAccount: &flowcontrol.ServiceAccountSubject{Namespace: namespace, Name: name}}
+}
+
+func TestMatchFlowSchema(t *testing.T) {
+	allResources := flowcontrol.ResourcePolicyRule{
+		Verbs:        []string{flowcontrol.VerbAll},
+		APIGroups:    []string{flowcontrol.APIGroupAll},
+		Resources:    []string{flowcontrol.ResourceAll},
+		Namespaces:   []string{flowcontrol.NamespaceEvery},
+		ClusterScope: true,
+	}
+	schemas := []*flowcontrol.FlowSchema{
+		newFlowSchema("catch-all", 10000, flowcontrol.PolicyRulesWithSubjects{
+			Subjects:      []flowcontrol.Subject{groupSubject(authenticatedGroup)},
+			ResourceRules: []flowcontrol.ResourcePolicyRule{allResources},
+			NonResourceRules: []flowcontrol.NonResourcePolicyRule{
+				{Verbs: []string{flowcontrol.VerbAll}, NonResourceURLs: []string{flowcontrol.NonResourceAll}},
+			},
+		}),
+		newFlowSchema("probes", 2, flowcontrol.PolicyRulesWithSubjects{
+			Subjects: []flowcontrol.Subject{groupSubject(authenticatedGroup)},
+			NonResourceRules: []flowcontrol.NonResourcePolicyRule{
+				{Verbs: []string{"get"}, NonResourceURLs: []string{"/healthz", "/readyz/*"}},
+			},
+		}),
+		newFlowSchema("admin", 100, flowcontrol.PolicyRulesWithSubjects{
+			Subjects:      []flowcontrol.Subject{userSubject("admin")},
+			ResourceRules: []flowcontrol.ResourcePolicyRule{allResources},
+		}),
+		newFlowSchema("kube-system-controllers", 800, flowcontrol.PolicyRulesWithSubjects{
+			Subjects: []flowcontrol.Subject{serviceAccountSubject("kube-system", flowcontrol.NameAll)},
+			ResourceRules: []flowcontrol.ResourcePolicyRule{{
+				Verbs:      []string{"get", "list", "watch"},
+				APIGroups:  []string{"apps"},
+				Resources:  []string{"deployments", "deployments/status"},
+				Namespaces: []string{"kube-system"},
+			}},
+		}),
+		newFlowSchema("nodes", 800, flowcontrol.PolicyRulesWithSubjects{
+			Subjects: []flowcontrol.Subject{groupSubject("system:nodes")},
+			ResourceRules: []flowcontrol.ResourcePolicyRule{{
+				Verbs:        []string{flowcontrol.VerbAll},
+				APIGroups:    []string{""},
+				Resources:    []string{"nodes", "nodes/status"},
+				ClusterScope: true,
+			}},
+		}),
+	}
+	withResource := func(r *FlowRequest, verb, group, resource, subresource, namespace string) *FlowRequest {
+		r.Verb, r.APIGroup, r.Resource, r.Subresource, r.Namespace = verb, group, resource, subresource, namespace
+		return r
+	}
+	withPath := func(r *FlowRequest, verb, path string) *FlowRequest {
+		r.Verb, r.Path = verb, path
+		return r
+	}
+	tests := []struct {
+		name     string
+		request  *FlowRequest
+		expected string
+	}{
+		{
+			name:     "user subject",
+			request:  withResource(NewUserRequest("admin", nil), "delete", "", "pods", "", "default"),
+			expected: "admin",
+		},
+		{
+			name:     "other user falls through to catch-all",
+			request:  withResource(NewUserRequest("alice", nil), "delete", "", "pods", "", "default"),
+			expected: "catch-all",
+		},
+		{
+			name:     "service account in namespace",
+			request:  withResource(NewServiceAccountRequest("kube-system", "deployment-controller"), "list", "apps", "deployments", "", "kube-system"),
+			expected: "kube-system-controllers",
+		},
+		{
+			name:     "subresource",
+			request:  withResource(NewServiceAccountRequest("kube-system", "deployment-controller"), "get", "apps", "deployments", "status", "kube-system"),
+			expected: "kube-system-controllers",
+		},
+		{
+			name:     "service account in other namespace",
+			request:  withResource(NewServiceAccountRequest("default", "deployment-controller"), "list", "apps", "deployments", "", "kube-system"),
+			expected: "catch-all",
+		},
+		{
+			name:     "namespace not in rule",
+			request:  withResource(NewServiceAccountRequest("kube-system", "deployment-controller"), "list", "apps", "deployments", "", "default"),
+			expected: "catch-all",
+		},
+		{
+			name:     "cluster scoped request does not match namespaced rule",
+			request:  withResource(NewServiceAccountRequest("kube-system", "deployment-controller"), "list", "apps", "deployments", "", ""),
+			expected: "catch-all",
+		},
+		{
+			name:     "group subject with cluster scope",
+			request:  withResource(NewUserRequest("system:node:node1", []string{"system:nodes"}), "patch", "", "nodes", "status", ""),
+			expected: "nodes",
+		},
+		{
+			name:     "subresource not in rule",
+			request:  withResource(NewUserRequest("system:node:node1", []string{"system:nodes"}), "update", "", "nodes", "proxy", ""),
+			expected: "catch-all",
+		},
+		{
+			name:     "exact non-resource url",
+			request:  withPath(NewUserRequest("alice", nil), "get", "/healthz"),
+			expected: "probes",
+		},
+		{
+			name:     "non-resource url prefix",
+			request:  withPath(NewUserRequest("alice", nil), "get", "/readyz/etcd"),
+			expected: "probes",
+		},
+		{
+			name:     "non-resource url verb not in rule",
+			request:  withPath(NewUserRequest("alice", nil), "post", "/healthz"),
+			expected: "catch-all",
+		},
+		{
+			name:     "non-resource url not in rule",
+			request:  withPath(NewUserRequest("alice", nil), "get", "/readyz"),
+			expected: "catch-all",
+		},
+		{
+			name:     "resource rules do not match non-resource requests",
+			request:  withPath(NewUserRequest("admin", nil), "get", "/metrics"),
+			expected: "catch-all",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, ok := MatchFlowSchema(schemas, tt.request)
+			if !ok {
+				t.Fatalf("expected %s, got no match", tt.expected)
+			}
+			if fs.Name != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, fs.Name)
+			}
+		})
+	}
+
+	// 没有被认证的请求不属于system:authenticated组
+	if fs, ok := MatchFlowSchema(schemas, withPath(&FlowRequest{User: "system:anonymous"}, "get", "/version")); ok {
+		t.Errorf("expected no match for anonymous request, got %s", fs.Name)
+	}
+}
+
+func TestFlowControlChangesRules(t *testing.T) {
+	rule := func(subject flowcontrol.Subject, verbs ...string) flowcontrol.PolicyRulesWithSubjects {
+		return flowcontrol.PolicyRulesWithSubjects{
+			Subjects: []flowcontrol.Subject{subject},
+			ResourceRules: []flowcontrol.ResourcePolicyRule{{
+				Verbs:      verbs,
+				APIGroups:  []string{"apps"},
+				Resources:  []string{"deployments"},
+				Namespaces: []string{flowcontrol.NamespaceEvery},
+			}},
+		}
+	}
+	old := newFlowSchema("controllers", 800, rule(groupSubject("system:nodes"), "get"), rule(userSubject("admin"), "list"))
+	// 规则数量不变，但其中一条规则的动作发生变化
+	obj := newFlowSchema("controllers", 800, rule(groupSubject("system:nodes"), "get"), rule(userSubject("admin"), "watch"))
+
+	expected := []string{
+		"rule added: subjects=User:admin resourceRules=[verbs=watch apiGroups=apps resources=deployments namespaces=*]",
+		"rule removed: subjects=User:admin resourceRules=[verbs=list apiGroups=apps resources=deployments namespaces=*]",
+	}
+	if changes := flowControlChanges(old, obj); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected changes %q, got %q", expected, changes)
+	}
+	if changes := flowControlChanges(old, old.DeepCopy()); len(changes) != 0 {
+		t.Errorf("expected no changes, got %q", changes)
+	}
+}
@@ -0,0 +1,171 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store 简单的嵌入式kv存储，数据保存在内存中，并以json快照的方式持久化到本地文件，
+// 写入时只标记dirty，由后台goroutine按flushInterval批量落盘，Close时会再落盘一次
+type Store struct {
+	path string
+	lock sync.Mutex
+	data map[string]json.RawMessage
+	// dirty 是否有未落盘的修改
+	dirty bool
+
+	flushInterval time.Duration
+	stopCh        chan struct{}
+	doneCh        chan struct{}
+}
+
+// Open 打开(或创建)path对应的存储，并启动后台落盘goroutine，
+// flushInterval为0时每次写入都会立即落盘
+func Open(path string, flushInterval time.Duration) (*Store, error) {
+	s := &Store{
+		path:          path,
+		data:          map[string]json.RawMessage{},
+		flushInterval: flushInterval,
+		stopCh:        make(chan struct{}),
+		doneCh:        make(chan struct{}),
+	}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("read kv store %s: %w", path, err)
+	case len(b) != 0:
+		if err := json.Unmarshal(b, &s.data); err != nil {
+			return nil, fmt.Errorf("decode kv store %s: %w", path, err)
+		}
+	}
+
+	if flushInterval > 0 {
+		go s.run()
+	} else {
+		close(s.doneCh)
+	}
+	return s, nil
+}
+
+// Get 获取key对应的值，并反序列化到value中
+func (s *Store) Get(key string, value interface{}) (bool, error) {
+	s.lock.Lock()
+	raw, ok := s.data[key]
+	s.lock.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, value); err != nil {
+		return false, fmt.Errorf("decode key %s: %w", key, err)
+	}
+	return true, nil
+}
+
+// Put 序列化value并写入
+func (s *Store) Put(key string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encode key %s: %w", key, err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data[key] = raw
+	return s.markDirty()
+}
+
+// Delete 删除key
+func (s *Store) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.data[key]; !ok {
+		return nil
+	}
+	delete(s.data, key)
+	return s.markDirty()
+}
+
+// Keys 返回所有key，按字典序排序
+func (s *Store) Keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := make([]string, 0, len(s.data))
+	for k := range s.data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Flush 把内存中的数据落盘
+func (s *Store) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.flush()
+}
+
+// Close 停止后台落盘goroutine，并落盘最后一次
+func (s *Store) Close() error {
+	if s.flushInterval > 0 {
+		close(s.stopCh)
+		<-s.doneCh
+	}
+	return s.Flush()
+}
+
+// markDirty 调用方需持有锁
+func (s *Store) markDirty() error {
+	s.dirty = true
+	if s.flushInterval == 0 {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush 先写入临时文件再rename，避免进程退出时写出不完整的文件，调用方需持有锁
+func (s *Store) flush() error {
+	if !s.dirty {
+		return nil
+	}
+	b, err := json.Marshal(s.data)
+	if err != nil {
+		return fmt.Errorf("encode kv store: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("create kv store dir: %w", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return fmt.Errorf("write kv store %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("rename kv store %s: %w", tmp, err)
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *Store) run() {
+	defer close(s.doneCh)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				// 落盘失败保留dirty，下次重试
+				log.Println("kv store flush err:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package lru
+
+import (
+	"strconv"
+	"testing"
+)
+
+const (
+	benchmarkEntries = 10000
+	benchmarkShards  = 16
+)
+
+// benchmarkKeys 预先生成的key，避免在并发循环中分配
+var benchmarkKeys = func() []string {
+	keys := make([]string, benchmarkEntries*2)
+	for i := range keys {
+		keys[i] = "pod-" + strconv.Itoa(i)
+	}
+	return keys
+}()
+
+func newBenchmarkCache() Interface[string, int] {
+	config := NewCacheConfig[string, int](0, benchmarkEntries, nil)
+	return NewCache(config.LRUCacheMode(), config)
+}
+
+func newBenchmarkShardedCache() Interface[string, int] {
+	config := NewCacheConfig[string, int](0, benchmarkEntries, nil)
+	return NewShardedCache[string, int](benchmarkShards, StringHasher[string], config, (*CacheConfig[string, int]).LRUCacheMode)
+}
+
+// runParallel 多个goroutine同时操作缓存，每次操作中writePercent%为Add，其余为Get，
+// key的范围是容量的两倍，会持续触发LRU淘汰
+func runParallel(b *testing.B, cache Interface[string, int], writePercent int) {
+	for i := 0; i < benchmarkEntries; i++ {
+		cache.Add(benchmarkKeys[i], i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := benchmarkKeys[i%len(benchmarkKeys)]
+			if i%100 < writePercent {
+				cache.Add(key, i)
+			} else {
+				cache.Get(key)
+			}
+			i += 7
+		}
+	})
+}
+
+func BenchmarkCacheParallel(b *testing.B) {
+	for _, bc := range []struct {
+		name         string
+		writePercent int
+	}{
+		{name: "read-heavy", writePercent: 10},
+		{name: "mixed", writePercent: 50},
+		{name: "write-heavy", writePercent: 90},
+	} {
+		b.Run("Cache/"+bc.name, func(b *testing.B) {
+			runParallel(b, newBenchmarkCache(), bc.writePercent)
+		})
+		b.Run("ShardedCache/"+bc.name, func(b *testing.B) {
+			runParallel(b, newBenchmarkShardedCache(), bc.writePercent)
+		})
+	}
+}
+
+// BenchmarkGetOrAdd informer回调中常见的先查找再加入
+func BenchmarkGetOrAdd(b *testing.B) {
+	for name, newCache := range map[string]func() Interface[string, int]{
+		"Cache":        newBenchmarkCache,
+		"ShardedCache": newBenchmarkShardedCache,
+	} {
+		b.Run(name, func(b *testing.B) {
+			cache := newCache()
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					cache.GetOrAdd(benchmarkKeys[i%len(benchmarkKeys)], i)
+					i += 7
+				}
+			})
+		})
+	}
+}
@@ -9,137 +9,250 @@ import (
 // 1. LRUCache: 有淘汰机制的缓存
 // 2. LRUWithTTLCache: 有淘汰机制加上过期时间的缓存
 // 3. TTLCache: 有过期时间的缓存
-// 且内部也维护需要传入的CacheConfig对象
-type Cache struct {
+// 且内部也维护需要传入的CacheConfig对象。
+// 所有操作共用一把锁，高并发时可以使用ShardedCache
+type Cache[K comparable, V any] struct {
 	// Cache 缓存接口对象
-	Cache ICache
+	Cache ICache[K, V]
 	lock  sync.Mutex
 	// Config 缓存配置项
-	Config *CacheConfig
+	Config *CacheConfig[K, V]
+	// stats 命中、未命中与淘汰统计
+	stats stats
+	// stopCh stopOnce 停止后台清理goroutine
+	stopCh   chan struct{}
+	stopOnce sync.Once
 }
 
-func NewCache(cache ICache, config *CacheConfig) *Cache {
-	return &Cache{Cache: cache, Config: config, lock: sync.Mutex{}}
+// NewCache 创建缓存，如果设置了CleanupInterval，会启动后台清理goroutine，
+// 不再使用时需要调用Stop
+func NewCache[K comparable, V any](cache ICache[K, V], config *CacheConfig[K, V]) *Cache[K, V] {
+	c := &Cache[K, V]{Cache: cache, Config: config, lock: sync.Mutex{}, stats: newStats(), stopCh: make(chan struct{})}
+	cache.setOnEvict(c.onEvict)
+	if config.CleanupInterval > 0 {
+		go c.janitor(config.CleanupInterval)
+	}
+	return c
 }
 
-type CacheConfig struct {
+type CacheConfig[K comparable, V any] struct {
 	// TTL 过期时间，如果有使用，可以设置，不使用可以为空。
 	// 如果需要使用，但没有设置，会默认使用10s过期时间
 	TTL time.Duration
 	// MaxEntries 最大缓存数
 	MaxEntries int
 	// Callbacks 当缓存出现修改时，可执行的回调方法
-	Callbacks ChangeCallbackHandler
+	Callbacks ChangeCallbackHandler[K, V]
+	// SlidingExpiration 每次Get命中时为对象续期，而不是从加入时开始计算
+	SlidingExpiration bool
+	// CleanupInterval 后台清理过期对象的周期，为0时只在Get时惰性删除
+	CleanupInterval time.Duration
+	// Clock 计算过期时间使用的时钟，为空时使用time.Now，测试时可以替换
+	Clock func() time.Time
 }
 
-func NewCacheConfig(TTL time.Duration, maxEntries int, callbacks ChangeCallbackHandler) *CacheConfig {
-	return &CacheConfig{TTL: TTL, MaxEntries: maxEntries, Callbacks: callbacks}
+func NewCacheConfig[K comparable, V any](TTL time.Duration, maxEntries int, callbacks ChangeCallbackHandler[K, V]) *CacheConfig[K, V] {
+	return &CacheConfig[K, V]{TTL: TTL, MaxEntries: maxEntries, Callbacks: callbacks}
 }
 
-// ChangeCallbackHandler 回调接口，可提供用户实现相应方法
-type ChangeCallbackHandler interface {
-	OnAdd()
-	OnGet()
-	OnRemove()
+// entry 存入缓存的Value对象
+type entry[K comparable, V any] struct {
+	key K
+	// ttl 过期的时间点
+	ttl time.Time
+	// expiry 对象的过期时长，续期时使用
+	expiry time.Duration
+	value  V
 }
 
-// ChangeCallbackFunc 回调方法
-type ChangeCallbackFunc struct {
-	// OnAdd 加入缓存时，可执行的回调
-	AddFunc func()
-	// OnGet 获取缓存时，可执行的回调
-	GetFunc func()
-	// OnRemove 删除缓存时，可执行的回调
-	RemoveFunc func()
+func newEntry[K comparable, V any](key K, value V, expiry time.Duration, now time.Time) *entry[K, V] {
+	e := &entry[K, V]{key: key, value: value, expiry: expiry}
+	e.touch(now)
+	return e
 }
 
-func (c ChangeCallbackFunc) OnAdd() {
-	if c.AddFunc != nil {
-		c.AddFunc()
-	}
+// expired 是否已经过期
+func (e *entry[K, V]) expired(now time.Time) bool {
+	return now.After(e.ttl)
 }
 
-func (c ChangeCallbackFunc) OnGet() {
-	if c.GetFunc != nil {
-		c.GetFunc()
-	}
+// touch 从now开始重新计算过期时间
+func (e *entry[K, V]) touch(now time.Time) {
+	e.ttl = now.Add(e.expiry)
 }
 
-func (c ChangeCallbackFunc) OnRemove() {
-	if c.RemoveFunc != nil {
-		c.RemoveFunc()
+// clock 配置的时钟，没有设置时使用time.Now
+func (cc *CacheConfig[K, V]) clock() func() time.Time {
+	if cc.Clock != nil {
+		return cc.Clock
 	}
-}
-
-type Key interface{}
-
-// entry 存入缓存的Value对象
-type entry struct {
-	key   Key
-	ttl   time.Time
-	value interface{}
+	return time.Now
 }
 
 const (
 	maxDuration     time.Duration = 1<<63 - 1
-	defaultDuration time.Duration = 10
+	defaultDuration time.Duration = 10 * time.Second
 )
 
-// LRUCacheMode LRUCache缓存模式
-func (cc *CacheConfig) LRUCacheMode() ICache {
-	c := newLRU(cc.MaxEntries, maxDuration)
+// LRUCacheMode LRUCache缓存模式，对象默认不过期，可以通过AddWithTTL单独设置
+func (cc *CacheConfig[K, V]) LRUCacheMode() ICache[K, V] {
+	c := newLRU[K, V](cc.MaxEntries, maxDuration, cc.SlidingExpiration, cc.clock())
 	return c
 }
 
 // LRUWithTTLCacheMode LRUWithTTL缓存模式，如果没有设置，就使用默认过期时间
-func (cc *CacheConfig) LRUWithTTLCacheMode() ICache {
+func (cc *CacheConfig[K, V]) LRUWithTTLCacheMode() ICache[K, V] {
 	if cc.TTL == 0 {
 		cc.TTL = defaultDuration
 	}
-	c := newLRU(cc.MaxEntries, cc.TTL)
+	c := newLRU[K, V](cc.MaxEntries, cc.TTL, cc.SlidingExpiration, cc.clock())
 	return c
 }
 
-// Add 放入缓存，如果OnAdd回调有值，就会调用
-func (c *Cache) Add(key Key, value interface{}) {
+// TTLCacheMode TTLCache缓存模式，不限制数量，如果没有设置，就使用默认过期时间
+func (cc *CacheConfig[K, V]) TTLCacheMode() ICache[K, V] {
+	if cc.TTL == 0 {
+		cc.TTL = defaultDuration
+	}
+	c := newTTL[K, V](cc.TTL, cc.SlidingExpiration, cc.clock())
+	return c
+}
+
+// Add 放入缓存，使用缓存的默认过期时间，如果OnAdd回调有值，就会调用
+func (c *Cache[K, V]) Add(key K, value V) {
+	c.AddWithTTL(key, value, 0)
+}
+
+// AddWithTTL 放入缓存，并单独设置该对象的过期时间，ttl为0时使用缓存的默认过期时间
+func (c *Cache[K, V]) AddWithTTL(key K, value V, ttl time.Duration) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	c.add(key, value, ttl)
+}
 
-	c.Cache.add(key, value)
-	if c.Config.Callbacks.OnAdd != nil {
-		c.Config.Callbacks.OnAdd()
+// add 调用方需持有锁
+func (c *Cache[K, V]) add(key K, value V, ttl time.Duration) {
+	c.Cache.add(key, value, ttl)
+	c.stats.adds++
+	if c.Config.Callbacks != nil {
+		c.Config.Callbacks.OnAdd(key, value)
 	}
 }
 
-func (c *Cache) Size() int {
+func (c *Cache[K, V]) Size() int {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	return c.Cache.size()
 }
 
 // Get 获取缓存，如果OnGet回调有值，就会调用
-func (c *Cache) Get(key Key) (value interface{}, ok bool) {
+func (c *Cache[K, V]) Get(key K) (value V, ok bool) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	if c.Config.Callbacks.OnGet != nil {
-		c.Config.Callbacks.OnGet()
+	return c.get(key)
+}
+
+// get 调用方需持有锁
+func (c *Cache[K, V]) get(key K) (value V, ok bool) {
+	value, ok = c.Cache.get(key)
+	if ok {
+		c.stats.hits++
+	} else {
+		c.stats.misses++
+	}
+	if c.Config.Callbacks != nil {
+		c.Config.Callbacks.OnGet(key, ok)
 	}
+	return value, ok
+}
+
+// GetOrAdd 如果key存在，返回已有的value，loaded为true；
+// 否则放入value并返回，判断与放入在同一把锁内完成
+func (c *Cache[K, V]) GetOrAdd(key K, value V) (actual V, loaded bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if actual, loaded = c.get(key); loaded {
+		return actual, true
+	}
+	c.add(key, value, 0)
+	return value, false
+}
 
-	return c.Cache.get(key)
+// Peek 获取缓存，但不更新最近使用顺序、过期时间与统计，也不执行回调
+func (c *Cache[K, V]) Peek(key K) (value V, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Cache.peek(key)
 }
 
-// Remove 删除缓存，如果OnRemove回调有值，就会调用
-func (c *Cache) Remove(key Key) {
+// Remove 删除缓存，如果OnEvict回调有值，就会以EvictReasonRemoved调用
+func (c *Cache[K, V]) Remove(key K) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	c.Cache.remove(key)
-	if c.Config.Callbacks.OnRemove != nil {
-		c.Config.Callbacks.OnRemove()
-	}
 }
 
-func (c *Cache) Clear() {
+// Keys 获取所有key，从最新到最旧
+func (c *Cache[K, V]) Keys() []K {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Cache.keys()
+}
+
+// Range 按Keys的顺序遍历未过期的对象，fn返回false时停止，
+// 遍历时持有锁，不能在fn中再操作缓存
+func (c *Cache[K, V]) Range(fn func(key K, value V) bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Cache.rangeEntries(fn)
+}
+
+// Clear 清空缓存，每个对象都会以EvictReasonCleared调用OnEvict回调
+func (c *Cache[K, V]) Clear() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	c.Cache.clear()
 }
+
+// DeleteExpired 删除所有过期的对象，每个对象都会以EvictReasonExpired调用OnEvict回调
+func (c *Cache[K, V]) DeleteExpired() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Cache.deleteExpired()
+}
+
+// Stop 停止后台清理goroutine，可以重复调用
+func (c *Cache[K, V]) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+	})
+}
+
+// janitor 按周期删除过期对象，使过期回调按时执行，而不是等到下一次Get
+func (c *Cache[K, V]) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopCh:
+			return
+		case <-ticker.C:
+			c.DeleteExpired()
+		}
+	}
+}
+
+// Stats 获取缓存的统计信息
+func (c *Cache[K, V]) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats.snapshot(c.Cache.size())
+}
+
+// onEvict 对象离开缓存时由ICache调用，此时已持有锁
+func (c *Cache[K, V]) onEvict(key K, value V, reason EvictReason) {
+	c.stats.evictions[reason]++
+	if c.Config.Callbacks != nil {
+		c.Config.Callbacks.OnEvict(key, value, reason)
+	}
+}
@@ -0,0 +1,91 @@
+package lru
+
+// EvictReason 对象离开缓存的原因
+type EvictReason string
+
+const (
+	// EvictReasonRemoved 调用Remove主动删除
+	EvictReasonRemoved EvictReason = "removed"
+	// EvictReasonCapacity 超过MaxEntries，淘汰最旧的对象
+	EvictReasonCapacity EvictReason = "capacity"
+	// EvictReasonExpired 超过TTL过期
+	EvictReasonExpired EvictReason = "expired"
+	// EvictReasonCleared 调用Clear清空
+	EvictReasonCleared EvictReason = "cleared"
+)
+
+// ChangeCallbackHandler 回调接口，可提供用户实现相应方法，
+// 回调在持有缓存锁时执行，不能在回调中再操作缓存
+type ChangeCallbackHandler[K comparable, V any] interface {
+	// OnAdd 加入缓存时调用
+	OnAdd(key K, value V)
+	// OnGet 获取缓存时调用，hit表示是否命中
+	OnGet(key K, hit bool)
+	// OnEvict 对象离开缓存时调用，reason为离开的原因
+	OnEvict(key K, value V, reason EvictReason)
+}
+
+// ChangeCallbacks 以方法字段实现ChangeCallbackHandler，未设置的回调不会执行
+type ChangeCallbacks[K comparable, V any] struct {
+	AddFunc   func(key K, value V)
+	GetFunc   func(key K, hit bool)
+	EvictFunc func(key K, value V, reason EvictReason)
+}
+
+func (c ChangeCallbacks[K, V]) OnAdd(key K, value V) {
+	if c.AddFunc != nil {
+		c.AddFunc(key, value)
+	}
+}
+
+func (c ChangeCallbacks[K, V]) OnGet(key K, hit bool) {
+	if c.GetFunc != nil {
+		c.GetFunc(key, hit)
+	}
+}
+
+func (c ChangeCallbacks[K, V]) OnEvict(key K, value V, reason EvictReason) {
+	if c.EvictFunc != nil {
+		c.EvictFunc(key, value, reason)
+	}
+}
+
+// ChangeCallbackFunc 无参数的回调方法，兼容旧的回调接口，不依赖缓存的key与value类型，
+// 通过FuncCallbacks转为ChangeCallbackHandler，
+// RemoveFunc只在主动Remove时执行，与之前的行为一致
+type ChangeCallbackFunc struct {
+	// OnAdd 加入缓存时，可执行的回调
+	AddFunc func()
+	// OnGet 获取缓存时，可执行的回调
+	GetFunc func()
+	// OnRemove 删除缓存时，可执行的回调
+	RemoveFunc func()
+}
+
+// FuncCallbacks 把ChangeCallbackFunc转为指定key与value类型的ChangeCallbackHandler，
+// ex: NewCacheConfig[string, int](0, 100, FuncCallbacks[string, int](ChangeCallbackFunc{AddFunc: f}))
+func FuncCallbacks[K comparable, V any](c ChangeCallbackFunc) ChangeCallbackHandler[K, V] {
+	return funcCallbacks[K, V]{funcs: c}
+}
+
+type funcCallbacks[K comparable, V any] struct {
+	funcs ChangeCallbackFunc
+}
+
+func (c funcCallbacks[K, V]) OnAdd(K, V) {
+	if c.funcs.AddFunc != nil {
+		c.funcs.AddFunc()
+	}
+}
+
+func (c funcCallbacks[K, V]) OnGet(K, bool) {
+	if c.funcs.GetFunc != nil {
+		c.funcs.GetFunc()
+	}
+}
+
+func (c funcCallbacks[K, V]) OnEvict(_ K, _ V, reason EvictReason) {
+	if c.funcs.RemoveFunc != nil && reason == EvictReasonRemoved {
+		c.funcs.RemoveFunc()
+	}
+}
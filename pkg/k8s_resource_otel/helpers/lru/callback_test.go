@@ -0,0 +1,25 @@
+package lru
+
+import "testing"
+
+// TestFuncCallbacks 旧的无参数回调通过FuncCallbacks继续使用，RemoveFunc只在主动Remove时执行
+func TestFuncCallbacks(t *testing.T) {
+	var adds, gets, removes int
+	config := NewCacheConfig[string, int](0, 1, FuncCallbacks[string, int](ChangeCallbackFunc{
+		AddFunc:    func() { adds++ },
+		GetFunc:    func() { gets++ },
+		RemoveFunc: func() { removes++ },
+	}))
+	cache := NewCache(config.LRUCacheMode(), config)
+
+	cache.Add("a", 1)
+	cache.Get("a")
+	cache.Get("missing")
+	// 超过容量淘汰a，不执行RemoveFunc
+	cache.Add("b", 2)
+	cache.Remove("b")
+
+	if adds != 2 || gets != 2 || removes != 1 {
+		t.Fatalf("expected adds=2 gets=2 removes=1, got adds=%d gets=%d removes=%d", adds, gets, removes)
+	}
+}
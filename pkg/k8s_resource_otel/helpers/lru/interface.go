@@ -1,15 +1,52 @@
 package lru
 
+import "time"
+
 // ICache 接口对象，需要实现缓存各个方法
-type ICache interface {
-	// add 放入缓存
-	add(key Key, value interface{})
-	// size 数量
+type ICache[K comparable, V any] interface {
+	// add 放入缓存，ttl为0时使用缓存的默认过期时间
+	add(key K, value V, ttl time.Duration)
+	// size 缓存中的数量，包括还未删除的过期对象，不遍历对象
 	size() int
 	// get 获取缓存
-	get(key Key) (value interface{}, ok bool)
+	get(key K) (value V, ok bool)
+	// peek 获取缓存，但不更新最近使用顺序与过期时间，也不删除过期对象
+	peek(key K) (value V, ok bool)
 	// remove 删除缓存
-	remove(key Key)
+	remove(key K)
 	// clear 清理所有缓存
 	clear()
+	// keys 所有未过期的key，从最新到最旧
+	keys() []K
+	// rangeEntries 按keys的顺序遍历未过期的对象，fn返回false时停止
+	rangeEntries(fn func(key K, value V) bool)
+	// deleteExpired 删除所有过期的对象，返回删除的数量
+	deleteExpired() int
+	// setOnEvict 设置对象离开缓存时的回调，由Cache统一处理统计与用户回调
+	setOnEvict(fn evictFunc[K, V])
 }
+
+// evictFunc 对象离开缓存时的内部回调
+type evictFunc[K comparable, V any] func(key K, value V, reason EvictReason)
+
+// Interface Cache与ShardedCache共同的方法，调用方可以根据并发情况选择实现
+type Interface[K comparable, V any] interface {
+	Add(key K, value V)
+	AddWithTTL(key K, value V, ttl time.Duration)
+	Get(key K) (value V, ok bool)
+	GetOrAdd(key K, value V) (actual V, loaded bool)
+	Peek(key K) (value V, ok bool)
+	Remove(key K)
+	Keys() []K
+	Range(fn func(key K, value V) bool)
+	Size() int
+	Clear()
+	DeleteExpired() int
+	Stats() Stats
+	Stop()
+}
+
+var (
+	_ Interface[string, any] = &Cache[string, any]{}
+	_ Interface[string, any] = &ShardedCache[string, any]{}
+)
@@ -6,38 +6,52 @@ import (
 )
 
 // lruCache 实现LRU淘汰机制的缓存，使用链表记录所有对象的value
-type lruCache struct {
+type lruCache[K comparable, V any] struct {
 	maxEntries int
 	ll         *list.List
-	cache      map[Key]*list.Element
+	cache      map[K]*list.Element
 	expiry     time.Duration
+	// sliding 获取时是否为对象续期
+	sliding bool
+	// now 当前时间，用于计算过期
+	now func() time.Time
+	// onEvict 对象离开缓存时的回调
+	onEvict evictFunc[K, V]
 }
 
-func newLRU(maxEntries int, expiry time.Duration) *lruCache {
-	return &lruCache{
+func newLRU[K comparable, V any](maxEntries int, expiry time.Duration, sliding bool, now func() time.Time) *lruCache[K, V] {
+	return &lruCache[K, V]{
 		maxEntries: maxEntries,
 		ll:         list.New(),
-		cache:      make(map[Key]*list.Element),
+		cache:      make(map[K]*list.Element),
 		expiry:     expiry,
+		sliding:    sliding,
+		now:        now,
 	}
 }
 
 // add 加入缓存
-func (c *lruCache) add(key Key, value interface{}) {
+func (c *lruCache[K, V]) add(key K, value V, ttl time.Duration) {
 	// 1. 如果没有map，先创建map
 	if c.cache == nil {
-		c.cache = make(map[Key]*list.Element)
+		c.cache = make(map[K]*list.Element)
 		c.ll = list.New()
 	}
+	if ttl <= 0 {
+		ttl = c.expiry
+	}
+	now := c.now()
 	// 2. 如果能从map中找到，先放到链表最前面，更新 ttl 与 value
 	if ee, ok := c.cache[key]; ok {
 		c.ll.MoveToFront(ee)
-		ee.Value.(*entry).ttl = time.Now().Add(c.expiry)
-		ee.Value.(*entry).value = value
+		kv := ee.Value.(*entry[K, V])
+		kv.expiry = ttl
+		kv.touch(now)
+		kv.value = value
 		return
 	}
 	// 3. 创建 entry 放入最链表前端，并放入map中
-	ele := c.ll.PushFront(&entry{key, time.Now().Add(c.expiry), value})
+	ele := c.ll.PushFront(newEntry(key, value, ttl, now))
 	c.cache[key] = ele
 	// 4. 如果长度超过，必须删除最后一个
 	if c.maxEntries != 0 && c.ll.Len() > c.maxEntries {
@@ -45,65 +59,148 @@ func (c *lruCache) add(key Key, value interface{}) {
 	}
 }
 
-func (c *lruCache) size() int {
-	if c.cache == nil {
+// size 缓存中的数量，包括还未删除的过期对象
+func (c *lruCache[K, V]) size() int {
+	if c.ll == nil {
 		return 0
 	}
 	return c.ll.Len()
 }
 
 // get 获取缓存
-func (c *lruCache) get(key Key) (value interface{}, ok bool) {
+func (c *lruCache[K, V]) get(key K) (value V, ok bool) {
 
 	if c.cache == nil {
 		return
 	}
 
 	// 如果获取到，先查看是否过期，如果过期直接返回，
-	// 没有过期就放入链表前头，并返回
+	// 没有过期就放入链表前头，滑动过期时为对象续期，并返回
 	if ele, hit := c.cache[key]; hit {
-		if time.Now().After(ele.Value.(*entry).ttl) {
-			c.remove(key)
+		kv := ele.Value.(*entry[K, V])
+		now := c.now()
+		if kv.expired(now) {
+			c.evictElement(ele, EvictReasonExpired)
 			return
 		}
 		c.ll.MoveToFront(ele)
-		return ele.Value.(*entry).value, true
+		if c.sliding {
+			kv.touch(now)
+		}
+		return kv.value, true
+	}
+	return
+}
+
+// peek 获取缓存，不移动链表位置
+func (c *lruCache[K, V]) peek(key K) (value V, ok bool) {
+	if ele, hit := c.cache[key]; hit {
+		if kv := ele.Value.(*entry[K, V]); !kv.expired(c.now()) {
+			return kv.value, true
+		}
 	}
 	return
 }
 
 // remove 删除缓存
-func (c *lruCache) remove(key Key) {
+func (c *lruCache[K, V]) remove(key K) {
 	if c.cache == nil {
 		return
 	}
 	// 找到就删除
 	if ele, hit := c.cache[key]; hit {
-		c.removeElement(ele)
+		c.evictElement(ele, EvictReasonRemoved)
 	}
 }
 
 // removeOldest 删除最老的
-func (c *lruCache) removeOldest() {
+func (c *lruCache[K, V]) removeOldest() {
 	if c.cache == nil {
 		return
 	}
 	// 找到最老的ele，并删除
 	ele := c.ll.Back()
 	if ele != nil {
-		c.removeElement(ele)
+		c.evictElement(ele, EvictReasonCapacity)
+	}
+}
+
+// evictElement 删除元素，并执行回调
+func (c *lruCache[K, V]) evictElement(e *list.Element, reason EvictReason) {
+	c.removeElement(e)
+	if c.onEvict != nil {
+		kv := e.Value.(*entry[K, V])
+		c.onEvict(kv.key, kv.value, reason)
 	}
 }
 
 // removeElement 删除元素
-func (c *lruCache) removeElement(e *list.Element) {
+func (c *lruCache[K, V]) removeElement(e *list.Element) {
 	c.ll.Remove(e)
-	kv := e.Value.(*entry)
+	kv := e.Value.(*entry[K, V])
 	delete(c.cache, kv.key)
 }
 
-// clear 清除链表与
-func (c *lruCache) clear() {
+// keys 从链表头到尾遍历所有未过期的key
+func (c *lruCache[K, V]) keys() []K {
+	if c.cache == nil {
+		return nil
+	}
+	keys := make([]K, 0, c.ll.Len())
+	c.rangeEntries(func(key K, _ V) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// rangeEntries 从链表头到尾遍历所有未过期的对象
+func (c *lruCache[K, V]) rangeEntries(fn func(key K, value V) bool) {
+	if c.cache == nil {
+		return
+	}
+	now := c.now()
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		kv := e.Value.(*entry[K, V])
+		if kv.expired(now) {
+			continue
+		}
+		if !fn(kv.key, kv.value) {
+			return
+		}
+	}
+}
+
+// deleteExpired 遍历链表删除过期的对象，
+// 每个对象的过期时间可能不同，不能只检查链表尾部
+func (c *lruCache[K, V]) deleteExpired() int {
+	if c.cache == nil {
+		return 0
+	}
+	now, n := c.now(), 0
+	for e := c.ll.Back(); e != nil; {
+		prev := e.Prev()
+		if e.Value.(*entry[K, V]).expired(now) {
+			c.evictElement(e, EvictReasonExpired)
+			n++
+		}
+		e = prev
+	}
+	return n
+}
+
+// clear 清除链表与map，每个对象都会执行回调
+func (c *lruCache[K, V]) clear() {
+	if c.onEvict != nil && c.ll != nil {
+		for e := c.ll.Front(); e != nil; e = e.Next() {
+			kv := e.Value.(*entry[K, V])
+			c.onEvict(kv.key, kv.value, EvictReasonCleared)
+		}
+	}
 	c.ll = nil
 	c.cache = nil
 }
+
+func (c *lruCache[K, V]) setOnEvict(fn evictFunc[K, V]) {
+	c.onEvict = fn
+}
@@ -0,0 +1,58 @@
+package lru
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ prometheus.Collector = &PrometheusCollector{}
+
+// StatsProvider 可以提供统计信息的缓存，Cache与ShardedCache都已实现
+type StatsProvider interface {
+	Stats() Stats
+}
+
+// PrometheusCollector 把缓存的Stats暴露为prometheus指标，使用cache label区分不同缓存
+type PrometheusCollector struct {
+	name  string
+	cache StatsProvider
+
+	size      *prometheus.Desc
+	hits      *prometheus.Desc
+	misses    *prometheus.Desc
+	adds      *prometheus.Desc
+	evictions *prometheus.Desc
+}
+
+// NewPrometheusCollector 创建缓存的prometheus collector，需要调用方注册，
+// ex: prometheus.MustRegister(lru.NewPrometheusCollector("pods", cache))
+func NewPrometheusCollector(name string, cache StatsProvider) *PrometheusCollector {
+	labels := prometheus.Labels{"cache": name}
+	return &PrometheusCollector{
+		name:      name,
+		cache:     cache,
+		size:      prometheus.NewDesc("lru_cache_entries", "The number of entries in the cache", nil, labels),
+		hits:      prometheus.NewDesc("lru_cache_hits_total", "The total number of cache hits", nil, labels),
+		misses:    prometheus.NewDesc("lru_cache_misses_total", "The total number of cache misses", nil, labels),
+		adds:      prometheus.NewDesc("lru_cache_adds_total", "The total number of entries added to the cache", nil, labels),
+		evictions: prometheus.NewDesc("lru_cache_evictions_total", "The total number of entries that left the cache by reason", []string{"reason"}, labels),
+	}
+}
+
+func (p *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.size
+	ch <- p.hits
+	ch <- p.misses
+	ch <- p.adds
+	ch <- p.evictions
+}
+
+func (p *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	s := p.cache.Stats()
+	ch <- prometheus.MustNewConstMetric(p.size, prometheus.GaugeValue, float64(s.Size))
+	ch <- prometheus.MustNewConstMetric(p.hits, prometheus.CounterValue, float64(s.Hits))
+	ch <- prometheus.MustNewConstMetric(p.misses, prometheus.CounterValue, float64(s.Misses))
+	ch <- prometheus.MustNewConstMetric(p.adds, prometheus.CounterValue, float64(s.Adds))
+	for _, reason := range []EvictReason{EvictReasonRemoved, EvictReasonCapacity, EvictReasonExpired, EvictReasonCleared} {
+		ch <- prometheus.MustNewConstMetric(p.evictions, prometheus.CounterValue, float64(s.Evictions[reason]), string(reason))
+	}
+}
@@ -0,0 +1,137 @@
+package lru
+
+import (
+	"hash/maphash"
+	"time"
+)
+
+// Hasher 计算key的hash，用于选择分片
+type Hasher[K comparable] func(key K) uint64
+
+var seed = maphash.MakeSeed()
+
+// StringHasher 字符串类型key(如types.UID)的Hasher
+func StringHasher[K ~string](key K) uint64 {
+	return maphash.String(seed, string(key))
+}
+
+// ShardedCache 按key的hash分片的缓存，每个分片是独立加锁的Cache，
+// 不同分片的操作可以并发执行。
+// 容量与LRU淘汰按分片计算(MaxEntries平均分配到每个分片)，Keys与Range只保证分片内的顺序
+type ShardedCache[K comparable, V any] struct {
+	shards []*Cache[K, V]
+	hasher Hasher[K]
+}
+
+// NewShardedCache 创建shards个分片，mode根据每个分片的配置创建ICache，
+// ex: lru.NewShardedCache(16, lru.StringHasher[types.UID], config, (*lru.CacheConfig[types.UID, *SpanInfo]).LRUCacheMode)
+func NewShardedCache[K comparable, V any](shards int, hasher Hasher[K], config *CacheConfig[K, V],
+	mode func(*CacheConfig[K, V]) ICache[K, V]) *ShardedCache[K, V] {
+	if shards <= 0 {
+		shards = 1
+	}
+	s := &ShardedCache[K, V]{shards: make([]*Cache[K, V], shards), hasher: hasher}
+	for i := range s.shards {
+		shardConfig := *config
+		if config.MaxEntries > 0 {
+			shardConfig.MaxEntries = (config.MaxEntries + shards - 1) / shards
+		}
+		s.shards[i] = NewCache(mode(&shardConfig), &shardConfig)
+	}
+	return s
+}
+
+func (s *ShardedCache[K, V]) shard(key K) *Cache[K, V] {
+	return s.shards[s.hasher(key)%uint64(len(s.shards))]
+}
+
+func (s *ShardedCache[K, V]) Add(key K, value V) {
+	s.shard(key).Add(key, value)
+}
+
+func (s *ShardedCache[K, V]) AddWithTTL(key K, value V, ttl time.Duration) {
+	s.shard(key).AddWithTTL(key, value, ttl)
+}
+
+func (s *ShardedCache[K, V]) Get(key K) (value V, ok bool) {
+	return s.shard(key).Get(key)
+}
+
+func (s *ShardedCache[K, V]) GetOrAdd(key K, value V) (actual V, loaded bool) {
+	return s.shard(key).GetOrAdd(key, value)
+}
+
+func (s *ShardedCache[K, V]) Peek(key K) (value V, ok bool) {
+	return s.shard(key).Peek(key)
+}
+
+func (s *ShardedCache[K, V]) Remove(key K) {
+	s.shard(key).Remove(key)
+}
+
+// Keys 依次获取每个分片的key
+func (s *ShardedCache[K, V]) Keys() []K {
+	var keys []K
+	for _, shard := range s.shards {
+		keys = append(keys, shard.Keys()...)
+	}
+	return keys
+}
+
+// Range 依次遍历每个分片，同一时间只持有一个分片的锁
+func (s *ShardedCache[K, V]) Range(fn func(key K, value V) bool) {
+	next := true
+	for _, shard := range s.shards {
+		shard.Range(func(key K, value V) bool {
+			next = fn(key, value)
+			return next
+		})
+		if !next {
+			return
+		}
+	}
+}
+
+func (s *ShardedCache[K, V]) Size() int {
+	n := 0
+	for _, shard := range s.shards {
+		n += shard.Size()
+	}
+	return n
+}
+
+func (s *ShardedCache[K, V]) Clear() {
+	for _, shard := range s.shards {
+		shard.Clear()
+	}
+}
+
+func (s *ShardedCache[K, V]) DeleteExpired() int {
+	n := 0
+	for _, shard := range s.shards {
+		n += shard.DeleteExpired()
+	}
+	return n
+}
+
+// Stats 汇总所有分片的统计信息
+func (s *ShardedCache[K, V]) Stats() Stats {
+	total := Stats{Evictions: map[EvictReason]uint64{}}
+	for _, shard := range s.shards {
+		st := shard.Stats()
+		total.Size += st.Size
+		total.Hits += st.Hits
+		total.Misses += st.Misses
+		total.Adds += st.Adds
+		for reason, n := range st.Evictions {
+			total.Evictions[reason] += n
+		}
+	}
+	return total
+}
+
+func (s *ShardedCache[K, V]) Stop() {
+	for _, shard := range s.shards {
+		shard.Stop()
+	}
+}
@@ -0,0 +1,40 @@
+package lru
+
+// Stats 缓存的统计信息
+type Stats struct {
+	// Size 当前缓存数，包括还未删除的过期对象
+	Size int
+	// Hits Misses 获取缓存命中与未命中次数
+	Hits   uint64
+	Misses uint64
+	// Adds 加入缓存次数
+	Adds uint64
+	// Evictions 按原因统计的离开缓存次数
+	Evictions map[EvictReason]uint64
+}
+
+// stats 内部计数，调用方需持有缓存锁
+type stats struct {
+	hits      uint64
+	misses    uint64
+	adds      uint64
+	evictions map[EvictReason]uint64
+}
+
+func newStats() stats {
+	return stats{evictions: map[EvictReason]uint64{}}
+}
+
+func (s *stats) snapshot(size int) Stats {
+	evictions := make(map[EvictReason]uint64, len(s.evictions))
+	for k, v := range s.evictions {
+		evictions[k] = v
+	}
+	return Stats{
+		Size:      size,
+		Hits:      s.hits,
+		Misses:    s.misses,
+		Adds:      s.adds,
+		Evictions: evictions,
+	}
+}
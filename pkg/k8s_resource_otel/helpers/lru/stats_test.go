@@ -0,0 +1,89 @@
+package lru
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestStats 统计命中、未命中与加入次数，每个对象离开缓存时只按一个原因统计并回调一次
+func TestStats(t *testing.T) {
+	clock := newFakeClock()
+	evicted := map[string][]EvictReason{}
+	config := NewCacheConfig[string, int](0, 2, ChangeCallbacks[string, int]{
+		EvictFunc: func(key string, _ int, reason EvictReason) {
+			evicted[key] = append(evicted[key], reason)
+		},
+	})
+	config.Clock = clock.Now
+	cache := NewCache(config.LRUCacheMode(), config)
+
+	cache.Add("capacity", 1)
+	cache.AddWithTTL("expired", 2, testTTL)
+	clock.advance(testTTL + time.Second)
+	// expired已经过期，Get删除并以EvictReasonExpired回调
+	if _, ok := cache.Get("expired"); ok {
+		t.Fatal("expected expired entry to miss")
+	}
+	cache.Add("removed", 3)
+	cache.Get("removed")
+	cache.Peek("capacity")
+	// 超过容量淘汰最旧的capacity
+	cache.Add("last", 4)
+	cache.Remove("removed")
+	// 重复删除与已淘汰的对象不再回调
+	cache.Remove("removed")
+	cache.Remove("capacity")
+	cache.Get("expired")
+	cache.DeleteExpired()
+
+	expected := map[string][]EvictReason{
+		"capacity": {EvictReasonCapacity},
+		"expired":  {EvictReasonExpired},
+		"removed":  {EvictReasonRemoved},
+	}
+	if !reflect.DeepEqual(evicted, expected) {
+		t.Errorf("expected evictions %v, got %v", expected, evicted)
+	}
+
+	stats := cache.Stats()
+	expectedStats := Stats{
+		Size:   1,
+		Hits:   1,
+		Misses: 2,
+		Adds:   4,
+		Evictions: map[EvictReason]uint64{
+			EvictReasonCapacity: 1,
+			EvictReasonExpired:  1,
+			EvictReasonRemoved:  1,
+		},
+	}
+	if !reflect.DeepEqual(stats, expectedStats) {
+		t.Errorf("expected stats %+v, got %+v", expectedStats, stats)
+	}
+
+	cache.Clear()
+	if stats := cache.Stats(); stats.Size != 0 || stats.Evictions[EvictReasonCleared] != 1 {
+		t.Errorf("expected clear to evict the last entry once, got %+v", stats)
+	}
+	if reasons := evicted["last"]; !reflect.DeepEqual(reasons, []EvictReason{EvictReasonCleared}) {
+		t.Errorf("expected last to be cleared once, got %v", reasons)
+	}
+}
+
+// TestShardedStats ShardedCache汇总所有分片的统计
+func TestShardedStats(t *testing.T) {
+	config := NewCacheConfig[string, int](0, 0, nil)
+	cache := NewShardedCache[string, int](4, StringHasher[string], config, (*CacheConfig[string, int]).LRUCacheMode)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		cache.Add(key, 0)
+		cache.Get(key)
+	}
+	cache.Get("missing")
+	cache.Remove("a")
+
+	stats := cache.Stats()
+	if stats.Size != 3 || stats.Hits != 4 || stats.Misses != 1 || stats.Adds != 4 || stats.Evictions[EvictReasonRemoved] != 1 {
+		t.Errorf("unexpected sharded stats %+v", stats)
+	}
+}
@@ -0,0 +1,150 @@
+package lru
+
+import (
+	"sort"
+	"time"
+)
+
+// ttlCache 只有过期机制的缓存，没有数量限制，对象只会因过期或主动删除离开缓存
+type ttlCache[K comparable, V any] struct {
+	cache  map[K]*entry[K, V]
+	expiry time.Duration
+	// sliding 获取时是否为对象续期
+	sliding bool
+	// now 当前时间，用于计算过期
+	now func() time.Time
+	// onEvict 对象离开缓存时的回调
+	onEvict evictFunc[K, V]
+}
+
+func newTTL[K comparable, V any](expiry time.Duration, sliding bool, now func() time.Time) *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		cache:   make(map[K]*entry[K, V]),
+		expiry:  expiry,
+		sliding: sliding,
+		now:     now,
+	}
+}
+
+// add 加入缓存，已存在时更新 ttl 与 value
+func (c *ttlCache[K, V]) add(key K, value V, ttl time.Duration) {
+	if c.cache == nil {
+		c.cache = make(map[K]*entry[K, V])
+	}
+	if ttl <= 0 {
+		ttl = c.expiry
+	}
+	now := c.now()
+	if e, ok := c.cache[key]; ok {
+		e.expiry = ttl
+		e.touch(now)
+		e.value = value
+		return
+	}
+	c.cache[key] = newEntry(key, value, ttl, now)
+}
+
+// size 缓存中的数量，包括还未删除的过期对象
+func (c *ttlCache[K, V]) size() int {
+	return len(c.cache)
+}
+
+// get 获取缓存，过期的对象会被删除
+func (c *ttlCache[K, V]) get(key K) (value V, ok bool) {
+	e, hit := c.cache[key]
+	if !hit {
+		return
+	}
+	now := c.now()
+	if e.expired(now) {
+		c.evict(e, EvictReasonExpired)
+		return
+	}
+	if c.sliding {
+		e.touch(now)
+	}
+	return e.value, true
+}
+
+// peek 获取缓存，不续期
+func (c *ttlCache[K, V]) peek(key K) (value V, ok bool) {
+	if e, hit := c.cache[key]; hit && !e.expired(c.now()) {
+		return e.value, true
+	}
+	return
+}
+
+// remove 删除缓存
+func (c *ttlCache[K, V]) remove(key K) {
+	if e, hit := c.cache[key]; hit {
+		c.evict(e, EvictReasonRemoved)
+	}
+}
+
+// evict 删除对象，并执行回调
+func (c *ttlCache[K, V]) evict(e *entry[K, V], reason EvictReason) {
+	delete(c.cache, e.key)
+	if c.onEvict != nil {
+		c.onEvict(e.key, e.value, reason)
+	}
+}
+
+// sorted 所有未过期的对象，按过期时间从晚到早排序
+func (c *ttlCache[K, V]) sorted() []*entry[K, V] {
+	now := c.now()
+	entries := make([]*entry[K, V], 0, len(c.cache))
+	for _, e := range c.cache {
+		if !e.expired(now) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ttl.After(entries[j].ttl)
+	})
+	return entries
+}
+
+// keys 所有未过期的key，按过期时间从晚到早排序
+func (c *ttlCache[K, V]) keys() []K {
+	entries := c.sorted()
+	keys := make([]K, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+// rangeEntries 按过期时间从晚到早遍历未过期的对象
+func (c *ttlCache[K, V]) rangeEntries(fn func(key K, value V) bool) {
+	for _, e := range c.sorted() {
+		if !fn(e.key, e.value) {
+			return
+		}
+	}
+}
+
+// deleteExpired 删除所有过期的对象
+func (c *ttlCache[K, V]) deleteExpired() int {
+	now, n := c.now(), 0
+	for _, e := range c.cache {
+		if e.expired(now) {
+			c.evict(e, EvictReasonExpired)
+			n++
+		}
+	}
+	return n
+}
+
+// clear 清除map，每个对象都会执行回调
+func (c *ttlCache[K, V]) clear() {
+	if c.onEvict != nil {
+		for _, e := range c.cache {
+			c.onEvict(e.key, e.value, EvictReasonCleared)
+		}
+	}
+	c.cache = make(map[K]*entry[K, V])
+}
+
+func (c *ttlCache[K, V]) setOnEvict(fn evictFunc[K, V]) {
+	c.onEvict = fn
+}
@@ -0,0 +1,249 @@
+package lru
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock 测试使用的时钟，只有调用advance时才前进
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+const testTTL = 10 * time.Second
+
+type cacheMode func(*CacheConfig[string, int]) ICache[string, int]
+
+var (
+	lruMode        cacheMode = (*CacheConfig[string, int]).LRUCacheMode
+	lruWithTTLMode cacheMode = (*CacheConfig[string, int]).LRUWithTTLCacheMode
+	ttlMode        cacheMode = (*CacheConfig[string, int]).TTLCacheMode
+)
+
+// action 前进advance后对key执行op，wantHit为Get与Peek期望的结果
+type action struct {
+	advance time.Duration
+	op      string
+	wantHit bool
+}
+
+func TestExpiration(t *testing.T) {
+	modes := map[string]cacheMode{
+		"LRUWithTTL": lruWithTTLMode,
+		"TTL":        ttlMode,
+	}
+	tests := []struct {
+		name    string
+		sliding bool
+		// entryTTL 不为0时使用AddWithTTL
+		entryTTL time.Duration
+		actions  []action
+	}{
+		{
+			name: "hit before ttl",
+			actions: []action{
+				{advance: testTTL - time.Second, op: "get", wantHit: true},
+			},
+		},
+		{
+			name: "expires after ttl",
+			actions: []action{
+				{advance: testTTL + time.Second, op: "get"},
+			},
+		},
+		{
+			name: "get does not renew without sliding expiration",
+			actions: []action{
+				{advance: testTTL * 6 / 10, op: "get", wantHit: true},
+				{advance: testTTL * 6 / 10, op: "get"},
+			},
+		},
+		{
+			name:    "sliding expiration renews on get",
+			sliding: true,
+			actions: []action{
+				{advance: testTTL * 6 / 10, op: "get", wantHit: true},
+				{advance: testTTL * 6 / 10, op: "get", wantHit: true},
+				{advance: testTTL + time.Second, op: "get"},
+			},
+		},
+		{
+			name:    "peek does not renew",
+			sliding: true,
+			actions: []action{
+				{advance: testTTL * 6 / 10, op: "peek", wantHit: true},
+				{advance: testTTL * 6 / 10, op: "peek"},
+			},
+		},
+		{
+			name: "add again renews",
+			actions: []action{
+				{advance: testTTL * 6 / 10, op: "add"},
+				{advance: testTTL * 6 / 10, op: "get", wantHit: true},
+			},
+		},
+		{
+			name:     "longer per-entry ttl",
+			entryTTL: testTTL * 3,
+			actions: []action{
+				{advance: testTTL * 2, op: "get", wantHit: true},
+				{advance: testTTL + time.Second, op: "get"},
+			},
+		},
+		{
+			name:     "shorter per-entry ttl",
+			entryTTL: testTTL / 2,
+			actions: []action{
+				{advance: testTTL * 6 / 10, op: "get"},
+			},
+		},
+	}
+	for modeName, mode := range modes {
+		for _, tt := range tests {
+			t.Run(modeName+"/"+tt.name, func(t *testing.T) {
+				clock := newFakeClock()
+				var evictions []EvictReason
+				config := NewCacheConfig[string, int](testTTL, 0, ChangeCallbacks[string, int]{
+					EvictFunc: func(_ string, _ int, reason EvictReason) {
+						evictions = append(evictions, reason)
+					},
+				})
+				config.SlidingExpiration = tt.sliding
+				config.Clock = clock.Now
+				cache := NewCache(mode(config), config)
+				cache.AddWithTTL("key", 1, tt.entryTTL)
+
+				hit := true
+				for i, a := range tt.actions {
+					clock.advance(a.advance)
+					switch a.op {
+					case "add":
+						cache.AddWithTTL("key", 1, tt.entryTTL)
+						continue
+					case "get":
+						_, hit = cache.Get("key")
+					case "peek":
+						_, hit = cache.Peek("key")
+					}
+					if hit != a.wantHit {
+						t.Fatalf("action %d %s: expected hit=%t, got %t", i, a.op, a.wantHit, hit)
+					}
+				}
+				// Get删除过期对象时回调一次，Peek不删除
+				var expected []EvictReason
+				if !hit && tt.actions[len(tt.actions)-1].op == "get" {
+					expected = []EvictReason{EvictReasonExpired}
+				}
+				if !reflect.DeepEqual(evictions, expected) {
+					t.Errorf("expected evictions %v, got %v", expected, evictions)
+				}
+			})
+		}
+	}
+}
+
+// TestLRUModePerEntryTTL LRUCache模式默认不过期，AddWithTTL的对象单独过期
+func TestLRUModePerEntryTTL(t *testing.T) {
+	clock := newFakeClock()
+	config := NewCacheConfig[string, int](0, 0, nil)
+	config.Clock = clock.Now
+	cache := NewCache(lruMode(config), config)
+	cache.Add("forever", 1)
+	cache.AddWithTTL("short", 2, testTTL)
+
+	clock.advance(100 * 365 * 24 * time.Hour)
+	if _, ok := cache.Get("forever"); !ok {
+		t.Error("expected entry without ttl to never expire")
+	}
+	if _, ok := cache.Get("short"); ok {
+		t.Error("expected entry with ttl to expire")
+	}
+}
+
+// TestDeleteExpired 过期对象在删除前仍然计入Size，但不会出现在Keys中
+func TestDeleteExpired(t *testing.T) {
+	for modeName, mode := range map[string]cacheMode{"LRUWithTTL": lruWithTTLMode, "TTL": ttlMode} {
+		t.Run(modeName, func(t *testing.T) {
+			clock := newFakeClock()
+			config := NewCacheConfig[string, int](testTTL, 0, nil)
+			config.Clock = clock.Now
+			cache := NewCache(mode(config), config)
+			cache.Add("a", 1)
+			cache.Add("b", 2)
+			cache.AddWithTTL("c", 3, testTTL*3)
+
+			clock.advance(testTTL * 2)
+			if size := cache.Size(); size != 3 {
+				t.Errorf("expected 3 entries before cleanup, got %d", size)
+			}
+			if keys := cache.Keys(); !reflect.DeepEqual(keys, []string{"c"}) {
+				t.Errorf("expected only c to be listed, got %v", keys)
+			}
+			if n := cache.DeleteExpired(); n != 2 {
+				t.Errorf("expected 2 expired entries, got %d", n)
+			}
+			if size := cache.Size(); size != 1 {
+				t.Errorf("expected 1 entry after cleanup, got %d", size)
+			}
+			if stats := cache.Stats(); stats.Evictions[EvictReasonExpired] != 2 {
+				t.Errorf("expected 2 expired evictions, got %+v", stats)
+			}
+		})
+	}
+}
+
+// TestJanitor 后台清理过期对象并执行回调，不需要等到下一次Get
+func TestJanitor(t *testing.T) {
+	clock := newFakeClock()
+	expired := make(chan string, 1)
+	config := NewCacheConfig[string, int](testTTL, 0, ChangeCallbacks[string, int]{
+		EvictFunc: func(key string, _ int, reason EvictReason) {
+			if reason == EvictReasonExpired {
+				expired <- key
+			}
+		},
+	})
+	config.Clock = clock.Now
+	config.CleanupInterval = time.Millisecond
+	cache := NewCache(ttlMode(config), config)
+	defer cache.Stop()
+	cache.Add("key", 1)
+
+	select {
+	case key := <-expired:
+		t.Fatalf("%s expired before its ttl", key)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	clock.advance(testTTL + time.Second)
+	select {
+	case key := <-expired:
+		if key != "key" {
+			t.Errorf("expected key to expire, got %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("janitor did not delete the expired entry")
+	}
+	if size := cache.Size(); size != 0 {
+		t.Errorf("expected janitor to delete the expired entry, got size %d", size)
+	}
+}
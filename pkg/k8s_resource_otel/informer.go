@@ -1,31 +1,446 @@
 package k8s_resource_otel
 
 import (
+	"context"
+	"fmt"
 	"github.com/practice/opentelemetry-practice/pkg/common"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/lru"
 	"github.com/practice/opentelemetry-practice/pkg/opentelemetry/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
+	"net/http"
 	"os"
 	"os/signal"
+	"time"
 )
 
-func K8sResourceInformer(c *common.ServerConfig) {
-	client := common.NewK8sConfig().InitClientSet()
-	fact := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace("default"))
+// informerFor 从工厂中获取某种资源的informer
+type informerFor func(f informers.SharedInformerFactory) cache.SharedIndexInformer
+
+// registration 已注册的handler，成为leader时按注册顺序重放informer缓存，接管进行中的对象
+type registration struct {
+	informer cache.SharedIndexInformer
+	handler  cache.ResourceEventHandler
+}
+
+func K8sResourceInformer(c *common.ServerConfig) error {
+	startedAt := time.Now()
+	client, err := c.K8s.InitClientSet()
+	if err != nil {
+		return fmt.Errorf("init k8s client: %w", err)
+	}
+	// 配置了dynamic informer规则时，才需要dynamic客户端
+	var rules []*compiledRule
+	var dynamicClient dynamic.Interface
+	if c.Informer.DynamicResourcesFile != "" {
+		if rules, err = LoadDynamicResourceRules(c.Informer.DynamicResourcesFile); err != nil {
+			return err
+		}
+		if err := ResolveDynamicResourceRules(client.Discovery(), rules); err != nil {
+			return err
+		}
+		if dynamicClient, err = c.K8s.InitDynamicClient(); err != nil {
+			return fmt.Errorf("init k8s dynamic client: %w", err)
+		}
+	}
+	scopes, err := newInformerScopes(client, dynamicClient, c.Informer)
+	if err != nil {
+		return err
+	}
 	GlobalJaegerProvider = exporter.NewJaegerProvider(c.JaegerEndpoint, exporter.ServiceInformer)
-	podInformer := fact.Core().V1().Pods().Informer()
-	podInformer.AddEventHandler(NewPodHandler())
+	leaderElection := c.LeaderElection != nil && c.LeaderElection.Enabled
+	GlobalSpanStore, err = newSpanStore(client, c.Informer, leaderElection)
+	if err != nil {
+		return err
+	}
+	if closer, ok := GlobalSpanStore.(io.Closer); ok {
+		defer closer.Close()
+	}
+	GlobalRolloutTracker = NewRolloutTracker(GlobalJaegerProvider)
+	go GlobalRolloutTracker.Run(wait.NeverStop)
+	GlobalContainerTracker = NewContainerTracker(GlobalJaegerProvider)
+	if err := validateEventConfig(c.Informer); err != nil {
+		return err
+	}
+	GlobalSchedulingTracker = NewSchedulingTracker(GlobalJaegerProvider)
+	// 集群级别的资源(node PV StorageClass ClusterRole等)使用不按namespace过滤的工厂
+	clusterFact := informers.NewSharedInformerFactory(client, 0)
+	if c.Informer.TraceVolumes {
+		GlobalVolumeHandler = NewVolumeHandler(GlobalJaegerProvider, clusterFact.Storage().V1().StorageClasses().Lister())
+	}
+	GlobalEventRecorder = NewEventRecorder(GlobalJaegerProvider, c.Informer.EventMode)
+	if len(c.Informer.TerminalReasons) != 0 {
+		PodTerminalReasons = c.Informer.TerminalReasons
+	}
+
+	// 没有开启选主时，当前副本直接作为leader
+	gate := NewLeaderGate()
+	if !leaderElection {
+		gate.setLeader(true)
+	}
+	var adoptions []registration
+
+	// 规则中的资源(通常是CRD)最先同步，其创建的工作负载与pod可以加入其trace
+	if len(rules) != 0 {
+		dynamicAdoptions, err := registerDynamicInformers(dynamicClient, scopes, rules, c.Informer.LabelSelector, gate)
+		if err != nil {
+			return err
+		}
+		adoptions = append(adoptions, dynamicAdoptions...)
+	}
+
+	// 工作负载按owner层级依次同步，子资源与pod才能通过OwnerReferences加入owner的trace
+	// 1. 顶层工作负载
+	topLevel := map[string]informerFor{
+		"Deployment": func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return f.Apps().V1().Deployments().Informer()
+		},
+		"StatefulSet": func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return f.Apps().V1().StatefulSets().Informer()
+		},
+		"DaemonSet": func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return f.Apps().V1().DaemonSets().Informer()
+		},
+		"CronJob": func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return f.Batch().V1().CronJobs().Informer()
+		},
+	}
+	// 2. 由顶层工作负载创建的ReplicaSet Job
+	secondLevel := map[string]informerFor{
+		"ReplicaSet": func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return f.Apps().V1().ReplicaSets().Informer()
+		},
+		"Job": func(f informers.SharedInformerFactory) cache.SharedIndexInformer {
+			return f.Batch().V1().Jobs().Informer()
+		},
+	}
+	for _, level := range []map[string]informerFor{topLevel, secondLevel} {
+		synced := make([]cache.InformerSynced, 0, len(level)*len(scopes))
+		for _, scope := range scopes {
+			for kind, informer := range level {
+				handler := NewWorkloadHandler(kind)
+				inf := informer(scope.workloadFact)
+				reg, err := inf.AddEventHandler(gate.Wrap(handler))
+				if err != nil {
+					return err
+				}
+				synced = append(synced, reg.HasSynced)
+				adoptions = append(adoptions, registration{informer: inf, handler: handler})
+			}
+			scope.start(wait.NeverStop)
+		}
+		// 等待handler处理完初始列表，而不仅仅是informer缓存同步
+		cache.WaitForCacheSync(wait.NeverStop, synced...)
+	}
+
+	// 节点与PVC在pod之前同步，pod的span才能link到节点的condition span与PVC的trace
+	var clusterSynced []cache.InformerSynced
+	if c.Informer.TraceNodes {
+		GlobalNodeHandler = NewNodeHandler(GlobalJaegerProvider)
+		nodeInformer := clusterFact.Core().V1().Nodes().Informer()
+		reg, err := nodeInformer.AddEventHandler(gate.Wrap(GlobalNodeHandler))
+		if err != nil {
+			return err
+		}
+		clusterSynced = append(clusterSynced, reg.HasSynced)
+		adoptions = append(adoptions, registration{informer: nodeInformer, handler: GlobalNodeHandler})
+	}
+	if c.Informer.TraceVolumes {
+		// VolumeHandler的StorageClass lister使用同一个informer
+		clusterSynced = append(clusterSynced, clusterFact.Storage().V1().StorageClasses().Informer().HasSynced)
+		// PVC先于PV注册，接管leader时PV才能找到PVC的trace
+		for _, scope := range scopes {
+			pvcInformer := scope.eventFact.Core().V1().PersistentVolumeClaims().Informer()
+			reg, err := pvcInformer.AddEventHandler(gate.Wrap(GlobalVolumeHandler))
+			if err != nil {
+				return err
+			}
+			clusterSynced = append(clusterSynced, reg.HasSynced)
+			adoptions = append(adoptions, registration{informer: pvcInformer, handler: GlobalVolumeHandler})
+			scope.start(wait.NeverStop)
+		}
+		pvInformer := clusterFact.Core().V1().PersistentVolumes().Informer()
+		reg, err := pvInformer.AddEventHandler(gate.Wrap(GlobalVolumeHandler))
+		if err != nil {
+			return err
+		}
+		clusterSynced = append(clusterSynced, reg.HasSynced)
+		adoptions = append(adoptions, registration{informer: pvInformer, handler: GlobalVolumeHandler})
+	}
+	// RBAC对象的变更与pod无关，不需要等待同步
+	if c.Informer.TraceRBAC {
+		rbacHandler := gate.Wrap(NewRBACHandler())
+		rbacInformers := []cache.SharedIndexInformer{
+			clusterFact.Rbac().V1().ClusterRoles().Informer(),
+			clusterFact.Rbac().V1().ClusterRoleBindings().Informer(),
+		}
+		for _, scope := range scopes {
+			rbacInformers = append(rbacInformers,
+				scope.eventFact.Rbac().V1().Roles().Informer(),
+				scope.eventFact.Rbac().V1().RoleBindings().Informer(),
+			)
+		}
+		for _, inf := range rbacInformers {
+			if _, err := inf.AddEventHandler(rbacHandler); err != nil {
+				return err
+			}
+		}
+		for _, scope := range scopes {
+			scope.start(wait.NeverStop)
+		}
+	}
+	if c.Informer.TraceFlowControl {
+		flowSchemas := clusterFact.Flowcontrol().V1beta3().FlowSchemas()
+		flowControlHandler := gate.Wrap(NewFlowControlHandler(flowSchemas.Lister()))
+		for _, inf := range []cache.SharedIndexInformer{
+			flowSchemas.Informer(),
+			clusterFact.Flowcontrol().V1beta3().PriorityLevelConfigurations().Informer(),
+		} {
+			if _, err := inf.AddEventHandler(flowControlHandler); err != nil {
+				return err
+			}
+		}
+	}
+	clusterFact.Start(wait.NeverStop)
+	cache.WaitForCacheSync(wait.NeverStop, clusterSynced...)
+
+	// pod与event的处理放入队列，由worker异步执行，不阻塞informer的分发
+	var podHandler, eventHandler cache.ResourceEventHandler = NewPodHandler(), NewEventHandler()
+	if c.Informer.Workers > 0 {
+		podQueue := NewQueuedHandler("pods", podHandler, GlobalJaegerProvider)
+		eventQueue := NewQueuedHandler("events", eventHandler, GlobalJaegerProvider)
+		go podQueue.Run(wait.NeverStop, c.Informer.Workers)
+		go eventQueue.Run(wait.NeverStop, c.Informer.Workers)
+		podHandler, eventHandler = podQueue, eventQueue
+	}
+
+	// EndpointSlice与pod的informer各自并发处理通知，注册顺序不保证slice在pod之后处理：
+	// pod还没有trace时跳过其地址，在slice下一次更新时记录；只有接管leader时按注册顺序重放
+	var endpointHandler *EndpointSliceHandler
+	if c.Informer.TraceEndpoints {
+		podListers := make([]corelisters.PodLister, 0, len(scopes))
+		for _, scope := range scopes {
+			podListers = append(podListers, scope.podFact.Core().V1().Pods().Lister())
+		}
+		endpointHandler = NewEndpointSliceHandler(podListers)
+	}
+
+	podInformers := make([]cache.SharedIndexInformer, 0, len(scopes))
+	for _, scope := range scopes {
+		podInformer := scope.podFact.Core().V1().Pods().Informer()
+		podInformers = append(podInformers, podInformer)
+		if _, err := podInformer.AddEventHandler(gate.Wrap(podHandler)); err != nil {
+			return err
+		}
+		adoptions = append(adoptions, registration{informer: podInformer, handler: podHandler})
+
+		eventInformer := scope.eventFact.Core().V1().Events().Informer()
+		if c.Informer.EventsAPI == EventsAPIEventsV1 {
+			eventInformer = scope.eventFact.Events().V1().Events().Informer()
+		}
+		if _, err := eventInformer.AddEventHandler(gate.Wrap(eventHandler)); err != nil {
+			return err
+		}
+
+		if endpointHandler != nil {
+			sliceInformer := scope.eventFact.Discovery().V1().EndpointSlices().Informer()
+			if _, err := sliceInformer.AddEventHandler(gate.Wrap(endpointHandler)); err != nil {
+				return err
+			}
+			adoptions = append(adoptions, registration{informer: sliceInformer, handler: endpointHandler})
+		}
+
+		klog.Infof("k8s resource informer trace server start, namespace: %q", scope.namespace)
+
+		// 启动shareInformer
+		scope.start(wait.NeverStop)
+	}
 
-	eventInformer := fact.Core().V1().Events().Informer()
-	eventInformer.AddEventHandler(NewEventHandler())
+	// 对账：结束错过删除事件的pod的span
+	go NewPodHandler().RunReconciler(wait.NeverStop, c.Informer.ReconcileInterval, gate, podInformers...)
+	if fileStore, ok := GlobalSpanStore.(*FileSpanStore); ok {
+		go pruneSpanStore(fileStore, startedAt, podInformers...)
+	}
 
-	klog.Infof("k8s resource informer trace server start...")
+	prometheus.MustRegister(
+		lru.NewPrometheusCollector("pods", PodCtxSet),
+		lru.NewPrometheusCollector("workloads", WorkloadCtxSet),
+	)
+	go serveMetrics(c.Port)
 
-	// 启动shareInformer
-	fact.Start(wait.NeverStop)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	electionDone := make(chan struct{})
+	if leaderElection {
+		go func() {
+			defer close(electionDone)
+			err := runLeaderElection(ctx, client, c.LeaderElection, GlobalJaegerProvider, gate, func(leadingCtx context.Context) {
+				adopt(leadingCtx, adoptions)
+			})
+			if err != nil {
+				klog.Errorf("leader election: %s", err)
+			}
+		}()
+	} else {
+		close(electionDone)
+	}
 
 	notifyCh := make(chan os.Signal, 1)
 	signal.Notify(notifyCh, os.Interrupt, os.Kill)
 	<-notifyCh
+
+	// 退出时释放lease，standby副本可以立即接管
+	cancel()
+	<-electionDone
+	return nil
+}
+
+// adopt 成为leader时，按注册顺序把informer缓存中的对象当作初始列表重放给handler，
+// 接管上一个leader正在追踪的对象，handler跳过已经在追踪的对象(ex: 本副本上一个任期中的对象)，
+// ctx在失去lease时结束
+func adopt(ctx context.Context, adoptions []registration) {
+	synced := make([]cache.InformerSynced, 0, len(adoptions))
+	for _, r := range adoptions {
+		synced = append(synced, r.informer.HasSynced)
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return
+	}
+	for _, r := range adoptions {
+		for _, obj := range r.informer.GetStore().List() {
+			if ctx.Err() != nil {
+				return
+			}
+			r.handler.OnAdd(obj, true)
+		}
+	}
+}
+
+// pruneSpanStore 等待pod informer同步后，删除进程启动前写入且没有对应pod的记录(进程停止期间删除的pod)
+func pruneSpanStore(store *FileSpanStore, startedAt time.Time, podInformers ...cache.SharedIndexInformer) {
+	synced := make([]cache.InformerSynced, 0, len(podInformers))
+	for _, inf := range podInformers {
+		synced = append(synced, inf.HasSynced)
+	}
+	if !cache.WaitForCacheSync(wait.NeverStop, synced...) {
+		return
+	}
+	live := sets.New[types.UID]()
+	for _, inf := range podInformers {
+		for _, obj := range inf.GetStore().List() {
+			if pod, ok := obj.(*v1.Pod); ok {
+				live.Insert(pod.UID)
+			}
+		}
+	}
+	if pruned := store.Prune(live, startedAt); pruned != 0 {
+		klog.Infof("pruned %d span records of pods deleted while the informer was stopped", pruned)
+	}
+}
+
+// serveMetrics 暴露prometheus指标
+func serveMetrics(port string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(fmt.Sprintf(":%v", port), mux); err != nil {
+		klog.Errorf("metrics server: %s", err)
+	}
+}
+
+// newSpanStore 根据配置创建SpanInfo的存储，
+// 开启选主时新leader需要从存储中延续上一个leader的trace，默认使用annotation，不允许只保存在内存中
+func newSpanStore(client kubernetes.Interface, c *common.InformerConfig, leaderElection bool) (SpanStore, error) {
+	store := c.SpanStore
+	if leaderElection {
+		switch store {
+		case "":
+			store = SpanStoreAnnotation
+		case SpanStoreMemory:
+			return nil, fmt.Errorf("span store %q can not be used with leader election, the new leader could not continue traces of the previous one, use %s or %s", SpanStoreMemory, SpanStoreAnnotation, SpanStoreFile)
+		case SpanStoreFile:
+			klog.Warningf("span store %q is used with leader election, %s must be on storage shared by all replicas", SpanStoreFile, c.SpanStoreFile)
+		}
+	}
+	switch store {
+	case "", SpanStoreMemory:
+		return nopSpanStore{}, nil
+	case SpanStoreFile:
+		return NewFileSpanStore(c.SpanStoreFile, spanStoreFlushInterval)
+	case SpanStoreAnnotation:
+		return NewAnnotationSpanStore(client), nil
+	}
+	return nil, fmt.Errorf("unknown span store %q, must be one of %s %s %s", store, SpanStoreMemory, SpanStoreFile, SpanStoreAnnotation)
+}
+
+// validateEventConfig 检查event的记录方式与API
+func validateEventConfig(c *common.InformerConfig) error {
+	switch c.EventMode {
+	case "", EventModeSpan, EventModeSpanEvent:
+	default:
+		return fmt.Errorf("unknown event mode %q, must be one of %s %s", c.EventMode, EventModeSpan, EventModeSpanEvent)
+	}
+	switch c.EventsAPI {
+	case "", EventsAPICoreV1, EventsAPIEventsV1:
+	default:
+		return fmt.Errorf("unknown events api %q, must be one of %s %s", c.EventsAPI, EventsAPICoreV1, EventsAPIEventsV1)
+	}
+	return nil
+}
+
+// dynamicInformerSyncTimeout 等待dynamic informer处理完初始列表的最长时间
+const dynamicInformerSyncTimeout = 5 * time.Minute
+
+// registerDynamicInformers 为每条规则注册dynamic informer并等待处理完初始列表，
+// namespace级别的资源使用各scope的工厂，集群级别的资源使用一个不按namespace过滤的工厂
+func registerDynamicInformers(client dynamic.Interface, scopes []*informerScope, rules []*compiledRule,
+	labelSelector string, gate *LeaderGate) ([]registration, error) {
+	clusterFact := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, metav1.NamespaceAll, func(options *metav1.ListOptions) {
+		options.LabelSelector = labelSelector
+	})
+	var adoptions []registration
+	var synced []cache.InformerSynced
+	for _, rule := range rules {
+		handler := NewDynamicHandler(rule)
+		facts := []dynamicinformer.DynamicSharedInformerFactory{clusterFact}
+		if !rule.clusterScoped {
+			facts = facts[:0]
+			for _, scope := range scopes {
+				facts = append(facts, scope.dynamicFact)
+			}
+		}
+		for _, f := range facts {
+			inf := f.ForResource(rule.gvr).Informer()
+			reg, err := inf.AddEventHandler(gate.Wrap(handler))
+			if err != nil {
+				return nil, err
+			}
+			synced = append(synced, reg.HasSynced)
+			adoptions = append(adoptions, registration{informer: inf, handler: handler})
+		}
+		klog.Infof("k8s resource informer watch dynamic resource: %s", rule.gvr)
+	}
+	clusterFact.Start(wait.NeverStop)
+	for _, scope := range scopes {
+		scope.start(wait.NeverStop)
+	}
+	// 没有list/watch权限时informer会一直重试，超时后返回错误
+	ctx, cancel := context.WithTimeout(context.Background(), dynamicInformerSyncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		return nil, fmt.Errorf("dynamic informers not synced in %s, check the rbac of the resources in rules", dynamicInformerSyncTimeout)
+	}
+	return adoptions, nil
 }
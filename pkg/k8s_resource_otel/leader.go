@@ -0,0 +1,264 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/common"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// gateStandby gateAdopting gateLeading LeaderGate的状态
+	gateStandby int32 = iota
+	gateAdopting
+	gateLeading
+)
+
+// LeaderGate 控制handler是否记录trace，
+// 只有leader会把informer事件交给handler，standby副本只保持informer缓存同步，
+// 接管进行中的对象期间到达的事件先缓存，接管完成后按顺序交给handler
+type LeaderGate struct {
+	state atomic.Int32
+	lock  sync.Mutex
+	// term 每次获得或失去lease时加一，上一个任期的接管完成时不能处理当前任期缓存的事件
+	term uint64
+	// buffered 当前任期接管期间到达的事件
+	buffered []func()
+	// adoption 同一时间只有一个任期在接管
+	adoption sync.Mutex
+}
+
+func NewLeaderGate() *LeaderGate {
+	return &LeaderGate{}
+}
+
+func (g *LeaderGate) IsLeader() bool {
+	return g.state.Load() == gateLeading
+}
+
+func (g *LeaderGate) setLeader(leading bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.term++
+	g.buffered = nil
+	if leading {
+		g.state.Store(gateLeading)
+		InformerMetrics.LeaderGauge.Set(1)
+	} else {
+		g.state.Store(gateStandby)
+		InformerMetrics.LeaderGauge.Set(0)
+	}
+}
+
+// adopt 获得lease后开始新的任期，调用fn接管进行中的对象，期间到达的事件先缓存，
+// 上一个任期的接管(失去lease后还没有返回)结束后才开始接管。
+// 接管期间失去lease(ctx结束或已调用setLeader(false))时不再打开gate，返回false
+func (g *LeaderGate) adopt(ctx context.Context, fn func(ctx context.Context)) bool {
+	term := g.startAdopting()
+	g.adoption.Lock()
+	defer g.adoption.Unlock()
+	fn(ctx)
+	return g.finishAdopting(ctx, term)
+}
+
+// startAdopting 开始新的任期并缓存事件，直到接管完成
+func (g *LeaderGate) startAdopting() uint64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.term++
+	g.buffered = nil
+	g.state.Store(gateAdopting)
+	return g.term
+}
+
+// finishAdopting 接管完成后把缓存的事件交给handler并开始正常处理，
+// 只处理自己任期的缓存，任期已经结束时不修改gate，返回false
+func (g *LeaderGate) finishAdopting(ctx context.Context, term uint64) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if term != g.term || g.state.Load() != gateAdopting {
+		return false
+	}
+	if ctx.Err() != nil {
+		g.buffered = nil
+		g.state.Store(gateStandby)
+		return false
+	}
+	for _, f := range g.buffered {
+		f()
+	}
+	g.buffered = nil
+	g.state.Store(gateLeading)
+	InformerMetrics.LeaderGauge.Set(1)
+	return true
+}
+
+// dispatch leader直接处理事件，接管期间缓存事件，standby丢弃事件
+func (g *LeaderGate) dispatch(f func()) {
+	switch g.state.Load() {
+	case gateLeading:
+		f()
+		return
+	case gateStandby:
+		return
+	}
+	g.lock.Lock()
+	if g.state.Load() == gateAdopting {
+		g.buffered = append(g.buffered, f)
+		g.lock.Unlock()
+		return
+	}
+	// 等待锁期间接管已经完成，缓存的事件已经处理
+	leading := g.state.Load() == gateLeading
+	g.lock.Unlock()
+	if leading {
+		f()
+	}
+}
+
+// Wrap 包装handler，非leader时丢弃事件
+func (g *LeaderGate) Wrap(h cache.ResourceEventHandler) cache.ResourceEventHandler {
+	return &leaderGatedHandler{gate: g, handler: h}
+}
+
+type leaderGatedHandler struct {
+	gate    *LeaderGate
+	handler cache.ResourceEventHandler
+}
+
+func (l *leaderGatedHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	l.gate.dispatch(func() { l.handler.OnAdd(obj, isInInitialList) })
+}
+
+func (l *leaderGatedHandler) OnUpdate(oldObj, newObj interface{}) {
+	l.gate.dispatch(func() { l.handler.OnUpdate(oldObj, newObj) })
+}
+
+func (l *leaderGatedHandler) OnDelete(obj interface{}) {
+	l.gate.dispatch(func() { l.handler.OnDelete(obj) })
+}
+
+var _ cache.ResourceEventHandler = &leaderGatedHandler{}
+
+// runLeaderElection 使用Lease锁选主，失去leader后重新参与选主，作为standby等待下次接管，
+// 接管时调用onStartedLeading接管正在进行中的对象，失去lease时传入的ctx结束
+func runLeaderElection(ctx context.Context, client kubernetes.Interface, c *common.LeaderElectionConfig,
+	provider *trace.TracerProvider, gate *LeaderGate, onStartedLeading func(ctx context.Context)) error {
+	identity := c.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("get hostname for leader election identity: %w", err)
+		}
+		identity = hostname + "_" + string(uuid.NewUUID())
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: c.Namespace,
+			Name:      c.Name,
+		},
+		Client: client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	tracer := provider.Tracer("leader-election")
+	leaseAttrs := []attribute.KeyValue{
+		{
+			Key:   "lease",
+			Value: attribute.StringValue(fmt.Sprintf("%s/%s", c.Namespace, c.Name)),
+		},
+		{
+			Key:   "identity",
+			Value: attribute.StringValue(identity),
+		},
+	}
+
+	// termSpan 记录一次任期：获得lease时开始，失去lease时结束
+	var (
+		termLock sync.Mutex
+		termSpan oteltrace.Span
+	)
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   c.LeaseDuration,
+		RenewDeadline:   c.RenewDeadline,
+		RetryPeriod:     c.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            c.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leadingCtx context.Context) {
+				klog.Infof("leader lease %s/%s acquired by %s", c.Namespace, c.Name, identity)
+				InformerMetrics.LeaderTransitionCounterVec.WithLabelValues("acquired").Inc()
+				termLock.Lock()
+				_, termSpan = tracer.Start(context.Background(), "leader-term")
+				termSpan.SetAttributes(leaseAttrs...)
+				termLock.Unlock()
+
+				// 先接管进行中的对象，再处理接管期间缓存的与之后的informer事件，
+				// 接管期间失去lease时OnStoppedLeading已经关闭gate，不能再打开
+				if !gate.adopt(leadingCtx, onStartedLeading) {
+					klog.Infof("leader lease %s/%s lost by %s while adopting objects", c.Namespace, c.Name, identity)
+				}
+			},
+			// 每次Run返回时都会调用，包括没有获得过lease的副本
+			OnStoppedLeading: func() {
+				gate.setLeader(false)
+				termLock.Lock()
+				defer termLock.Unlock()
+				if termSpan == nil {
+					return
+				}
+				klog.Infof("leader lease %s/%s lost by %s", c.Namespace, c.Name, identity)
+				InformerMetrics.LeaderTransitionCounterVec.WithLabelValues("lost").Inc()
+				if ctx.Err() != nil {
+					termSpan.SetStatus(codes.Unset, "leader lease released")
+				} else {
+					termSpan.SetStatus(codes.Error, "leader lease lost")
+				}
+				termSpan.End()
+				termSpan = nil
+			},
+			OnNewLeader: func(current string) {
+				if current == identity {
+					return
+				}
+				_, span := tracer.Start(context.Background(), "leader-observed")
+				span.SetAttributes(leaseAttrs...)
+				span.SetAttributes(attribute.KeyValue{
+					Key:   "leader",
+					Value: attribute.StringValue(current),
+				})
+				span.End()
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("create leader elector: %w", err)
+	}
+
+	// 失去leader后继续参与选主，作为warm standby
+	for {
+		le.Run(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeaderGateStaleAdoptionKeepsNewTermBuffer(t *testing.T) {
+	gate := NewLeaderGate()
+	oldCtx, cancel := context.WithCancel(context.Background())
+	oldTerm := gate.startAdopting()
+	// 接管期间失去lease，随后再次获得lease
+	cancel()
+	gate.setLeader(false)
+	newTerm := gate.startAdopting()
+
+	var handled []string
+	gate.dispatch(func() { handled = append(handled, "event") })
+
+	// 上一个任期的接管结束，不能丢弃或处理新任期缓存的事件
+	if gate.finishAdopting(oldCtx, oldTerm) {
+		t.Fatal("stale adoption should not open the gate")
+	}
+	if len(handled) != 0 {
+		t.Fatalf("stale adoption replayed the new term's buffer: %v", handled)
+	}
+	if !gate.finishAdopting(context.Background(), newTerm) {
+		t.Fatal("expected the current term to open the gate")
+	}
+	if len(handled) != 1 || !gate.IsLeader() {
+		t.Fatalf("expected the buffered event to be handled by the leader, got %v leader=%t", handled, gate.IsLeader())
+	}
+}
+
+func TestLeaderGateAdoptionsDoNotOverlap(t *testing.T) {
+	gate := NewLeaderGate()
+	oldCtx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	oldDone := make(chan bool)
+	go func() {
+		oldDone <- gate.adopt(oldCtx, func(ctx context.Context) { <-release })
+	}()
+	// 等待上一个任期开始接管
+	for gate.state.Load() != gateAdopting {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	gate.setLeader(false)
+
+	newStarted := make(chan struct{})
+	newDone := make(chan bool)
+	go func() {
+		newDone <- gate.adopt(context.Background(), func(ctx context.Context) { close(newStarted) })
+	}()
+	select {
+	case <-newStarted:
+		t.Fatal("new adoption started before the previous one returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if <-oldDone {
+		t.Error("stale adoption should not open the gate")
+	}
+	<-newStarted
+	if !<-newDone || !gate.IsLeader() {
+		t.Error("expected the new term to lead after adopting")
+	}
+}
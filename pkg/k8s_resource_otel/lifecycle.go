@@ -0,0 +1,78 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// startLifecycle 开启对象的根span与生命周期span，pod node PVC workload与dynamic资源共用，
+// 调用方需要先确认对象没有在追踪(接管leader时重放的对象已经有trace)；
+// 初始列表中的对象在informer启动前就已存在，span从对象创建时间开始
+func startLifecycle(tracer oteltrace.Tracer, parentCtx context.Context, obj metav1.Object,
+	rootName, lifeName string, isInInitialList bool, attrs ...attribute.KeyValue) *SpanInfo {
+	var startOpts []oteltrace.SpanStartOption
+	if isInInitialList {
+		startOpts = append(startOpts, oteltrace.WithTimestamp(obj.GetCreationTimestamp().Time))
+	}
+	rootCtx, rootSpan := tracer.Start(parentCtx, rootName, startOpts...)
+	lifeCtx, _ := tracer.Start(rootCtx, lifeName, startOpts...)
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(lifeCtx, carrier)
+
+	rootSpan.SetAttributes(attrs...)
+	rootSpan.SetAttributes(
+		attribute.KeyValue{
+			Key:   "creationTimestamp",
+			Value: attribute.StringValue(obj.GetCreationTimestamp().String()),
+		},
+		attribute.KeyValue{
+			Key:   "discoveredOnStartup",
+			Value: attribute.BoolValue(isInInitialList),
+		},
+	)
+
+	key := obj.GetName()
+	if obj.GetNamespace() != "" {
+		key = obj.GetNamespace() + "/" + key
+	}
+	return &SpanInfo{
+		RootCtx: rootCtx,
+		Ctx:     lifeCtx,
+		Carrier: carrier,
+		Key:     key,
+	}
+}
+
+// endLifecycle 对象删除时结束根span与生命周期span，根span名称加上(deleted)，
+// 生命周期span记录attrs、是否为最终状态未知的删除(finalStateUnknown)与删除时间，
+// 生命周期span已经结束(ex: pod进入终止状态)时，使用新的span记录
+func endLifecycle(tracer oteltrace.Tracer, info *SpanInfo, obj metav1.Object, kind, rootName string, finalStateUnknown bool, attrs ...attribute.KeyValue) {
+	parentSpan := oteltrace.SpanFromContext(info.RootCtx)
+	childSpan := oteltrace.SpanFromContext(info.Ctx)
+	if !childSpan.IsRecording() {
+		_, childSpan = tracer.Start(info.Ctx, rootName+"(deleted)")
+	}
+
+	parentSpan.SetStatus(codes.Unset, kind+" deleted")
+	parentSpan.SetName(rootName + "(deleted)")
+
+	defer childSpan.End()
+	defer parentSpan.End()
+
+	childSpan.SetAttributes(attrs...)
+	childSpan.SetAttributes(attribute.KeyValue{
+		Key:   "finalStateUnknown",
+		Value: attribute.BoolValue(finalStateUnknown),
+	})
+	if obj.GetDeletionTimestamp() != nil {
+		childSpan.SetAttributes(attribute.KeyValue{
+			Key:   "deletionTimestamp",
+			Value: attribute.StringValue(obj.GetDeletionTimestamp().String()),
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+func TestEndLifecycle(t *testing.T) {
+	for _, lifecycleEnded := range []bool{false, true} {
+		recorder := tracetest.NewSpanRecorder()
+		tracer := trace.NewTracerProvider(trace.WithSpanProcessor(recorder)).Tracer("test")
+		obj := &metav1.ObjectMeta{Name: "foo", Namespace: "default"}
+		info := startLifecycle(tracer, context.Background(), obj, "pod-foo/default", "pod-lifecycle", false)
+		if info.Key != "default/foo" {
+			t.Fatalf("expected key default/foo, got %s", info.Key)
+		}
+		// pod进入终止状态时生命周期span已经结束
+		if lifecycleEnded {
+			oteltrace.SpanFromContext(info.Ctx).End()
+		}
+
+		endLifecycle(tracer, info, obj, "pod", "pod-foo/default", true)
+
+		ended := recorder.Ended()
+		names := map[string]bool{}
+		var deleted trace.ReadOnlySpan
+		for _, span := range ended {
+			names[span.Name()] = true
+			for _, attr := range span.Attributes() {
+				if attr == (attribute.KeyValue{Key: "finalStateUnknown", Value: attribute.BoolValue(true)}) {
+					deleted = span
+				}
+			}
+		}
+		if !names["pod-foo/default(deleted)"] || !names["pod-lifecycle"] {
+			t.Errorf("lifecycleEnded=%t: expected root and lifecycle spans to end, got %v", lifecycleEnded, names)
+		}
+		// 生命周期span已经结束时，删除记录在新的span上
+		expectedName := "pod-lifecycle"
+		if lifecycleEnded {
+			expectedName = "pod-foo/default(deleted)"
+		}
+		if deleted == nil || deleted.Name() != expectedName || deleted.Parent().SpanID() == (oteltrace.SpanID{}) {
+			t.Errorf("lifecycleEnded=%t: expected deletion recorded on a child span %s, got %v", lifecycleEnded, expectedName, deleted)
+		}
+	}
+}
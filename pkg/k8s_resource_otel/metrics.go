@@ -0,0 +1,62 @@
+package k8s_resource_otel
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// InformerMetrics informer的prometheus收集器
+var InformerMetrics *InformerCollector
+
+func init() {
+	InformerMetrics = NewInformerCollector()
+}
+
+// InformerCollector informer的prometheus收集器
+type InformerCollector struct {
+	// LeaderGauge 当前副本是否为leader
+	LeaderGauge prometheus.Gauge
+	// LeaderTransitionCounterVec 获得与失去leader的次数
+	LeaderTransitionCounterVec *prometheus.CounterVec
+	// PodCacheEvictionCounter 被PodCtxSet淘汰的pod数量
+	PodCacheEvictionCounter prometheus.Counter
+	// PodPhaseDurationHistogramVec pod各阶段(调度 init 容器启动 就绪)的耗时
+	PodPhaseDurationHistogramVec *prometheus.HistogramVec
+	// SchedulingLatencyHistogramVec pod从创建到调度完成的耗时
+	SchedulingLatencyHistogramVec *prometheus.HistogramVec
+	// EndpointReadyGapHistogramVec pod Ready到其地址在EndpointSlice中ready的间隔
+	EndpointReadyGapHistogramVec *prometheus.HistogramVec
+}
+
+// NewInformerCollector prometheus collector
+func NewInformerCollector() *InformerCollector {
+	return &InformerCollector{
+		LeaderGauge: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "k8s_informer_leader",
+			Help: "Whether this replica is the leader that emits spans (1) or a standby (0)",
+		}),
+		LeaderTransitionCounterVec: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "k8s_informer_leader_transitions_total",
+			Help: "The total number of leader lease acquisitions and losses",
+		}, []string{"event"}),
+		PodCacheEvictionCounter: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "k8s_informer_pod_cache_evictions_total",
+			Help: "The total number of pods evicted from the tracking cache before they were deleted",
+		}),
+		PodPhaseDurationHistogramVec: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "k8s_informer_pod_phase_duration_seconds",
+			Help:    "The duration of pod lifecycle phases derived from pod condition transition times",
+			Buckets: podPhaseBuckets,
+		}, []string{"phase"}),
+		SchedulingLatencyHistogramVec: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "k8s_informer_pod_scheduling_latency_seconds",
+			Help:    "The duration from pod creation to PodScheduled=True",
+			Buckets: podPhaseBuckets,
+		}, []string{"namespace", "priority_class"}),
+		EndpointReadyGapHistogramVec: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "k8s_informer_endpoint_ready_gap_seconds",
+			Help:    "The gap between a pod becoming Ready and its address becoming ready in an EndpointSlice",
+			Buckets: podPhaseBuckets,
+		}, []string{"namespace"}),
+	}
+}
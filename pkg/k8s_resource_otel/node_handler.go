@@ -0,0 +1,371 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"log"
+	"sync"
+	"time"
+)
+
+// GlobalNodeHandler 全局node handler，pod handler从中查找pod所在节点的异常condition
+var GlobalNodeHandler *NodeHandler
+
+var _ cache.ResourceEventHandler = &NodeHandler{}
+
+// nodeConditionTypes 需要追踪的condition，Ready为True时正常，其余为False时正常
+var nodeConditionTypes = []v1.NodeConditionType{
+	v1.NodeReady,
+	v1.NodeMemoryPressure,
+	v1.NodeDiskPressure,
+	v1.NodePIDPressure,
+	v1.NodeNetworkUnavailable,
+}
+
+// nodeTrace 一个节点的生命周期trace
+type nodeTrace struct {
+	info *SpanInfo
+	uid  types.UID
+	// joined 节点是否已经就绪过，第一次就绪时记录join span
+	joined bool
+	// conditions 进行中的异常condition span
+	conditions map[v1.NodeConditionType]oteltrace.Span
+	// cordon 节点被cordon(drain)期间的span
+	cordon oteltrace.Span
+}
+
+// NodeHandler 追踪节点的加入、condition变化、cordon/drain与taint、删除，
+// condition异常期间的span保存下来，同一节点上pod的span通过link指向它，展示节点故障的影响范围
+type NodeHandler struct {
+	provider *trace.TracerProvider
+	lock     sync.RWMutex
+	// nodes key为节点名，pod通过spec.nodeName关联节点
+	nodes map[string]*nodeTrace
+}
+
+func NewNodeHandler(provider *trace.TracerProvider) *NodeHandler {
+	return &NodeHandler{
+		provider: provider,
+		nodes:    map[string]*nodeTrace{},
+	}
+}
+
+func (n *NodeHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	// 接管leader时重放的节点已经在追踪
+	if _, ok := n.nodes[node.Name]; ok {
+		return
+	}
+	info := startLifecycle(n.provider.Tracer("nodes"), context.Background(), node,
+		fmt.Sprintf("node-%s", node.Name), "node-lifecycle", isInInitialList, nodeAttributes(node)...)
+	nt := &nodeTrace{
+		info:       info,
+		uid:        node.UID,
+		conditions: map[v1.NodeConditionType]oteltrace.Span{},
+	}
+	n.nodes[node.Name] = nt
+
+	// 已经发生的就绪、异常condition与cordon按当前状态补记
+	n.recordJoin(nt, node, isInInitialList)
+	n.recordConditions(nt, nil, node)
+	n.recordCordon(nt, nil, node)
+}
+
+// OnUpdate kubelet会周期更新condition的心跳时间，只有condition状态、cordon与taint变化时才记录
+func (n *NodeHandler) OnUpdate(oldObj, newObj interface{}) {
+	oldNode, ok := oldObj.(*v1.Node)
+	if !ok {
+		return
+	}
+	node, ok := newObj.(*v1.Node)
+	if !ok {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	nt, ok := n.nodes[node.Name]
+	if !ok {
+		log.Println("not found carrier:", node.Name)
+		return
+	}
+	n.recordJoin(nt, node, false)
+	n.recordConditions(nt, oldNode, node)
+	n.recordCordon(nt, oldNode, node)
+	n.recordTaints(nt, oldNode, node)
+}
+
+func (n *NodeHandler) OnDelete(obj interface{}) {
+	obj, finalStateUnknown := unwrapTombstone(obj)
+	node, ok := obj.(*v1.Node)
+	if !ok {
+		return
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	nt, ok := n.nodes[node.Name]
+	if !ok {
+		log.Println("not found carrier:", node.Name)
+		return
+	}
+	delete(n.nodes, node.Name)
+
+	for _, span := range nt.conditions {
+		span.End()
+	}
+	if nt.cordon != nil {
+		nt.cordon.End()
+	}
+
+	endLifecycle(n.provider.Tracer("nodes"), nt.info, node, "node", fmt.Sprintf("node-%s", node.Name), finalStateUnknown)
+}
+
+// ConditionLinks 节点当前异常condition span的link，节点没有异常或没有监听node时返回nil
+func (n *NodeHandler) ConditionLinks(nodeName string) []oteltrace.Link {
+	if n == nil || nodeName == "" {
+		return nil
+	}
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	nt, ok := n.nodes[nodeName]
+	if !ok {
+		return nil
+	}
+	links := make([]oteltrace.Link, 0, len(nt.conditions))
+	for conditionType, span := range nt.conditions {
+		links = append(links, oteltrace.Link{
+			SpanContext: span.SpanContext(),
+			Attributes: []attribute.KeyValue{
+				{
+					Key:   "node",
+					Value: attribute.StringValue(nodeName),
+				},
+				{
+					Key:   "condition",
+					Value: attribute.StringValue(string(conditionType)),
+				},
+			},
+		})
+	}
+	return links
+}
+
+// spanInfo 根据event中的UID查找节点的SpanInfo，kubelet产生的event使用节点名作为UID
+func (n *NodeHandler) spanInfo(uid types.UID) (*SpanInfo, bool) {
+	if n == nil {
+		return nil, false
+	}
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	if nt, ok := n.nodes[string(uid)]; ok {
+		return nt.info, true
+	}
+	for _, nt := range n.nodes {
+		if nt.uid == uid {
+			return nt.info, true
+		}
+	}
+	return nil, false
+}
+
+// recordJoin 节点第一次就绪时，记录从创建到就绪的join span，
+// 初始列表中已经就绪的节点不再补记
+func (n *NodeHandler) recordJoin(nt *nodeTrace, node *v1.Node, isInInitialList bool) {
+	if nt.joined {
+		return
+	}
+	ready := nodeCondition(node, v1.NodeReady)
+	if ready == nil || ready.Status != v1.ConditionTrue {
+		return
+	}
+	nt.joined = true
+	if isInInitialList {
+		return
+	}
+	_, span := n.provider.Tracer("nodes").Start(nt.info.Ctx, "node-join", oteltrace.WithTimestamp(node.CreationTimestamp.Time))
+	span.SetAttributes(nodeAttributes(node)...)
+	span.End(oteltrace.WithTimestamp(ready.LastTransitionTime.Time))
+}
+
+// recordConditions condition进入异常状态时开启span，恢复或变为另一种异常状态时结束，
+// 开始与结束时间使用condition的LastTransitionTime
+func (n *NodeHandler) recordConditions(nt *nodeTrace, oldNode, node *v1.Node) {
+	for _, conditionType := range nodeConditionTypes {
+		condition := nodeCondition(node, conditionType)
+		if condition == nil {
+			continue
+		}
+		if oldNode != nil {
+			if old := nodeCondition(oldNode, conditionType); old != nil && old.Status == condition.Status {
+				continue
+			}
+		}
+		transitionTime := condition.LastTransitionTime.Time
+		if transitionTime.IsZero() {
+			transitionTime = time.Now()
+		}
+		if span, ok := nt.conditions[conditionType]; ok {
+			span.End(oteltrace.WithTimestamp(transitionTime))
+			delete(nt.conditions, conditionType)
+		}
+		if nodeConditionHealthy(condition) {
+			continue
+		}
+
+		_, span := n.provider.Tracer("nodes").Start(nt.info.Ctx, fmt.Sprintf("%s=%s", conditionType, condition.Status),
+			oteltrace.WithTimestamp(transitionTime))
+		span.SetStatus(codes.Error, fmt.Sprintf("%s: %s", condition.Reason, condition.Message))
+		span.SetAttributes(
+			attribute.KeyValue{
+				Key:   "node",
+				Value: attribute.StringValue(node.Name),
+			},
+			attribute.KeyValue{
+				Key:   "condition",
+				Value: attribute.StringValue(string(conditionType)),
+			},
+			attribute.KeyValue{
+				Key:   "status",
+				Value: attribute.StringValue(string(condition.Status)),
+			},
+			attribute.KeyValue{
+				Key:   "reason",
+				Value: attribute.StringValue(condition.Reason),
+			},
+			attribute.KeyValue{
+				Key:   "message",
+				Value: attribute.StringValue(condition.Message),
+			},
+		)
+		nt.conditions[conditionType] = span
+	}
+}
+
+// recordCordon 节点被cordon(kubectl cordon/drain)时开启span，uncordon时结束
+func (n *NodeHandler) recordCordon(nt *nodeTrace, oldNode, node *v1.Node) {
+	if oldNode != nil && oldNode.Spec.Unschedulable == node.Spec.Unschedulable {
+		return
+	}
+	if !node.Spec.Unschedulable {
+		if nt.cordon != nil {
+			nt.cordon.End()
+			nt.cordon = nil
+		}
+		return
+	}
+	// 优先使用unschedulable taint的添加时间作为cordon时间
+	var startOpts []oteltrace.SpanStartOption
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == v1.TaintNodeUnschedulable && taint.TimeAdded != nil {
+			startOpts = append(startOpts, oteltrace.WithTimestamp(taint.TimeAdded.Time))
+		}
+	}
+	_, nt.cordon = n.provider.Tracer("nodes").Start(nt.info.Ctx, "cordoned", startOpts...)
+	nt.cordon.SetAttributes(attribute.KeyValue{
+		Key:   "node",
+		Value: attribute.StringValue(node.Name),
+	})
+}
+
+// recordTaints 对比新旧taint，增加与删除的taint记录为生命周期span上的event
+func (n *NodeHandler) recordTaints(nt *nodeTrace, oldNode, node *v1.Node) {
+	lifeSpan := oteltrace.SpanFromContext(nt.info.Ctx)
+	for _, taint := range node.Spec.Taints {
+		if !hasTaint(oldNode.Spec.Taints, taint) {
+			lifeSpan.AddEvent("taint-added", oteltrace.WithAttributes(taintAttributes(taint)...))
+		}
+	}
+	for _, taint := range oldNode.Spec.Taints {
+		if !hasTaint(node.Spec.Taints, taint) {
+			lifeSpan.AddEvent("taint-removed", oteltrace.WithAttributes(taintAttributes(taint)...))
+		}
+	}
+}
+
+// nodeConditionHealthy Ready为True，其余condition为False时正常
+func nodeConditionHealthy(condition *v1.NodeCondition) bool {
+	if condition.Type == v1.NodeReady {
+		return condition.Status == v1.ConditionTrue
+	}
+	return condition.Status == v1.ConditionFalse
+}
+
+func nodeCondition(node *v1.Node, conditionType v1.NodeConditionType) *v1.NodeCondition {
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == conditionType {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// hasTaint taint以key与effect标识
+func hasTaint(taints []v1.Taint, taint v1.Taint) bool {
+	for _, t := range taints {
+		if t.Key == taint.Key && t.Effect == taint.Effect {
+			return true
+		}
+	}
+	return false
+}
+
+func taintAttributes(taint v1.Taint) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		{
+			Key:   "key",
+			Value: attribute.StringValue(taint.Key),
+		},
+		{
+			Key:   "value",
+			Value: attribute.StringValue(taint.Value),
+		},
+		{
+			Key:   "effect",
+			Value: attribute.StringValue(string(taint.Effect)),
+		},
+	}
+}
+
+func nodeAttributes(node *v1.Node) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		{
+			Key:   "node",
+			Value: attribute.StringValue(node.Name),
+		},
+		{
+			Key:   "kubeletVersion",
+			Value: attribute.StringValue(node.Status.NodeInfo.KubeletVersion),
+		},
+		{
+			Key:   "containerRuntimeVersion",
+			Value: attribute.StringValue(node.Status.NodeInfo.ContainerRuntimeVersion),
+		},
+		{
+			Key:   "osImage",
+			Value: attribute.StringValue(node.Status.NodeInfo.OSImage),
+		},
+		{
+			Key:   "kernelVersion",
+			Value: attribute.StringValue(node.Status.NodeInfo.KernelVersion),
+		},
+		{
+			Key:   "instanceType",
+			Value: attribute.StringValue(node.Labels[v1.LabelInstanceTypeStable]),
+		},
+		{
+			Key:   "zone",
+			Value: attribute.StringValue(node.Labels[v1.LabelTopologyZone]),
+		},
+	}
+}
@@ -0,0 +1,174 @@
+package k8s_resource_otel
+
+import (
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/k8shelper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+// 失败分类，记录为span的error.type属性
+const (
+	FailureTypeCrashLoop        = "CrashLoop"
+	FailureTypeImagePull        = "ImagePull"
+	FailureTypeOutOfMemory      = "OutOfMemory"
+	FailureTypeEvicted          = "Evicted"
+	FailureTypeNodeLost         = "NodeLost"
+	FailureTypeContainerConfig  = "ContainerConfig"
+	FailureTypeDeadlineExceeded = "DeadlineExceeded"
+	FailureTypeContainerError   = "ContainerError"
+
+	// initReasonPrefix PrintPod中init容器失败的reason前缀，ex: Init:CrashLoopBackOff
+	initReasonPrefix = "Init:"
+	// nodeLostReason node失联时node controller设置的pod reason
+	nodeLostReason = "NodeLost"
+)
+
+// DefaultTerminalReasons 默认结束pod生命周期span的reason，
+// 以*结尾时按前缀匹配，ex: Init:*
+var DefaultTerminalReasons = []string{"Completed", "Error", "Evicted", "DeadlineExceeded", nodeLostReason}
+
+// PodTerminalReasons 结束pod生命周期span的reason，可通过配置修改
+var PodTerminalReasons = DefaultTerminalReasons
+
+// failureTypes kubectl展示的reason到失败分类的映射
+var failureTypes = map[string]string{
+	"CrashLoopBackOff":           FailureTypeCrashLoop,
+	"ImagePullBackOff":           FailureTypeImagePull,
+	"ErrImagePull":               FailureTypeImagePull,
+	"InvalidImageName":           FailureTypeImagePull,
+	"ErrImageNeverPull":          FailureTypeImagePull,
+	"OOMKilled":                  FailureTypeOutOfMemory,
+	"Evicted":                    FailureTypeEvicted,
+	nodeLostReason:               FailureTypeNodeLost,
+	"CreateContainerConfigError": FailureTypeContainerConfig,
+	"CreateContainerError":       FailureTypeContainerConfig,
+	"RunContainerError":          FailureTypeContainerConfig,
+	"DeadlineExceeded":           FailureTypeDeadlineExceeded,
+	"Error":                      FailureTypeContainerError,
+	"ContainerCannotRun":         FailureTypeContainerError,
+}
+
+// failureDescriptions 失败分类的说明，记录在exception event中
+var failureDescriptions = map[string]string{
+	FailureTypeCrashLoop:        "container keeps exiting and is restarted with back-off",
+	FailureTypeImagePull:        "container image cannot be pulled",
+	FailureTypeOutOfMemory:      "container was killed for exceeding its memory limit",
+	FailureTypeEvicted:          "pod was evicted from the node",
+	FailureTypeNodeLost:         "node running the pod is unreachable",
+	FailureTypeContainerConfig:  "container cannot be created from its configuration",
+	FailureTypeDeadlineExceeded: "pod exceeded activeDeadlineSeconds",
+	FailureTypeContainerError:   "container exited with an error",
+}
+
+// PodFailure 分类后的pod失败
+type PodFailure struct {
+	// Reason PrintPod的reason，ex: Init:CrashLoopBackOff
+	Reason string
+	// Type 失败分类，init容器的失败带Init前缀，ex: InitCrashLoop
+	Type string
+	// Init 是否为init容器的失败
+	Init bool
+	// Message pod或容器状态中的message
+	Message string
+}
+
+func (f *PodFailure) Error() string {
+	desc := failureDescriptions[strings.TrimPrefix(f.Type, "Init")]
+	if f.Init {
+		desc = "init " + desc
+	}
+	if f.Message != "" {
+		return fmt.Sprintf("%s: %s: %s", f.Reason, desc, f.Message)
+	}
+	return fmt.Sprintf("%s: %s", f.Reason, desc)
+}
+
+// ClassifyPodFailure 根据PrintPod的reason对pod失败分类，不是失败时返回false
+func ClassifyPodFailure(pod *v1.Pod, info *k8shelper.PodInfo) (*PodFailure, bool) {
+	reason := info.Reason
+	// PrintPod会把node失联且正在删除的pod显示为Unknown
+	if pod.Status.Reason == nodeLostReason {
+		reason = nodeLostReason
+	}
+
+	init := strings.HasPrefix(reason, initReasonPrefix)
+	r := strings.TrimPrefix(reason, initReasonPrefix)
+	failureType, ok := failureTypes[r]
+	if !ok {
+		switch {
+		// 没有reason时PrintPod使用退出码或信号
+		case strings.HasPrefix(r, "ExitCode:") || strings.HasPrefix(r, "Signal:"):
+			failureType = FailureTypeContainerError
+		default:
+			return nil, false
+		}
+	}
+	if init {
+		failureType = "Init" + failureType
+	}
+	return &PodFailure{
+		Reason:  reason,
+		Type:    failureType,
+		Init:    init,
+		Message: failureMessage(pod, r),
+	}, true
+}
+
+// failureMessage 从pod或容器状态中找到与reason对应的message
+func failureMessage(pod *v1.Pod, reason string) string {
+	if pod.Status.Reason == reason && pod.Status.Message != "" {
+		return pod.Status.Message
+	}
+	statuses := append(append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		switch {
+		case status.State.Waiting != nil && status.State.Waiting.Reason == reason:
+			return status.State.Waiting.Message
+		case status.State.Terminated != nil && status.State.Terminated.Reason == reason:
+			return status.State.Terminated.Message
+		case status.LastTerminationState.Terminated != nil && status.LastTerminationState.Terminated.Reason == reason:
+			return status.LastTerminationState.Terminated.Message
+		}
+	}
+	return pod.Status.Message
+}
+
+// isTerminalReason reason是否会结束pod生命周期span，规则以*结尾时按前缀匹配，
+// 前缀规则只用于已分类的失败reason(failure为true)，
+// 否则Init:*会匹配到Init:0/1这样的正常进度，pod在第一次更新时就会结束生命周期span
+func isTerminalReason(reasons []string, reason string, failure bool) bool {
+	for _, r := range reasons {
+		if prefix, ok := strings.CutSuffix(r, "*"); ok {
+			if failure && strings.HasPrefix(reason, prefix) {
+				return true
+			}
+		} else if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// recordFailure 把失败记录到span：状态、error.type属性与exception event
+func recordFailure(span oteltrace.Span, failure *PodFailure) {
+	span.SetStatus(codes.Error, failure.Error())
+	span.SetAttributes(
+		attribute.KeyValue{
+			Key:   "error.type",
+			Value: attribute.StringValue(failure.Type),
+		},
+		attribute.KeyValue{
+			Key:   "failureReason",
+			Value: attribute.StringValue(failure.Reason),
+		},
+	)
+	span.AddEvent(semconv.ExceptionEventName, oteltrace.WithAttributes(
+		semconv.ExceptionType(failure.Type),
+		semconv.ExceptionMessage(failure.Error()),
+	))
+}
@@ -2,6 +2,7 @@ package k8s_resource_otel
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/k8shelper"
 	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/lru"
@@ -12,112 +13,285 @@ import (
 	"go.opentelemetry.io/otel/sdk/trace"
 	oteltrace "go.opentelemetry.io/otel/trace"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/cache"
 	"log"
 )
 
 // PodCtxSet 使用lru缓存存入pod对象，
-// 当update或delete时，先从缓存内获取，延续trace
-var PodCtxSet *lru.Cache
+// 当update或delete时，先从缓存内获取，延续trace。
+// 按UID分片，不同pod的informer回调不会竞争同一把锁
+var PodCtxSet *lru.ShardedCache[types.UID, *SpanInfo]
 
 // SpanInfo 贯穿整个链路的Span
 type SpanInfo struct {
 	// RootCtx 根context，理解为最上层trace需要传递的context
 	RootCtx context.Context
 	// Ctx 子context，第二层级context
-	Ctx     context.Context
+	Ctx context.Context
 	// Carrier 载体
 	Carrier propagation.TextMapCarrier
+	// Key 对象的 namespace/name，用于对象已不在informer缓存时记录
+	Key string
 }
 
+// errPodNotTracked pod更新时还没有trace(ex: 接管leader时pod的新增还在处理)
+var errPodNotTracked = errors.New("not found carrier")
+
+const (
+	// PodEvictedStatus pod被PodCtxSet淘汰时span的状态描述
+	PodEvictedStatus = "evicted from tracking cache"
+
+	// podCacheMaxEntries podCacheShards PodCtxSet的容量与分片数
+	podCacheMaxEntries = 12800
+	podCacheShards     = 16
+)
+
 func init() {
-	cacheConfig := lru.NewCacheConfig(0, 12800, lru.ChangeCallbackFunc{})
-	PodCtxSet = lru.NewCache(cacheConfig.LRUCacheMode(), cacheConfig)
+	cacheConfig := lru.NewCacheConfig[types.UID, *SpanInfo](0, podCacheMaxEntries, lru.ChangeCallbacks[types.UID, *SpanInfo]{EvictFunc: onPodEvicted})
+	PodCtxSet = lru.NewShardedCache[types.UID, *SpanInfo](podCacheShards, lru.StringHasher[types.UID], cacheConfig, (*lru.CacheConfig[types.UID, *SpanInfo]).LRUCacheMode)
+}
+
+// onPodEvicted 缓存满时pod被淘汰，结束其span，否则span永远不会导出，
+// 主动Remove(pod删除)时span已由调用方处理
+func onPodEvicted(uid types.UID, spanInfo *SpanInfo, reason lru.EvictReason) {
+	if reason != lru.EvictReasonCapacity && reason != lru.EvictReasonExpired {
+		return
+	}
+	GlobalContainerTracker.OnPodDelete(uid)
+	GlobalSchedulingTracker.OnPodDelete(uid)
+	InformerMetrics.PodCacheEvictionCounter.Inc()
+	log.Println("pod evicted from tracking cache:", spanInfo.Key)
+	NewPodHandler().endPodTrace(spanInfo, fmt.Sprintf("%s(%s)", spanInfo.Key, PodEvictedStatus), codes.Error, PodEvictedStatus,
+		attribute.KeyValue{
+			Key:   "cacheMaxEntries",
+			Value: attribute.IntValue(podCacheMaxEntries),
+		},
+	)
 }
 
 type PodHandler struct {
 	provider *trace.TracerProvider
+	// store 持久化SpanInfo，informer重启后延续pod的trace
+	store SpanStore
+	// containers 记录容器与init容器的span
+	containers *ContainerTracker
+	// events pod加入缓存后，记录之前缓冲的event
+	events *EventRecorder
+	// scheduling 记录调度span
+	scheduling *SchedulingTracker
+	// nodes pod所在节点异常时，pod的span通过link指向节点的condition span
+	nodes *NodeHandler
+	// volumes pod等待挂载卷时，pod的span通过link指向PVC的trace
+	volumes *VolumeHandler
 }
 
 var GlobalJaegerProvider *trace.TracerProvider
 
-
 func NewPodHandler() *PodHandler {
 	return &PodHandler{
-		provider: GlobalJaegerProvider,
+		provider:   GlobalJaegerProvider,
+		store:      GlobalSpanStore,
+		containers: GlobalContainerTracker,
+		events:     GlobalEventRecorder,
+		scheduling: GlobalSchedulingTracker,
+		nodes:      GlobalNodeHandler,
+		volumes:    GlobalVolumeHandler,
 	}
 }
 
 func (p *PodHandler) OnAdd(obj interface{}, isInInitialList bool) {
 	if pod, ok := obj.(*v1.Pod); ok {
 		tracer := p.provider.Tracer("pods")
-		// 初始化 rootCtx podLifeCtx
-		rootCtx, rootSpan := tracer.Start(context.Background(), fmt.Sprintf("pod-%s/%s", pod.Name, pod.Namespace))
-		podLifeCtx, _ := tracer.Start(rootCtx, "pod-lifecycle")
-
-		carrier := propagation.MapCarrier{}
-		otel.GetTextMapPropagator().Inject(podLifeCtx, carrier) // 注入
-		defer func() {
-			// 保存信息
-			PodCtxSet.Add(pod.UID, &SpanInfo{
-				RootCtx:     rootCtx,
-				Ctx: podLifeCtx,
-				Carrier: carrier,
-			})
-		}()
 
-		// 最外层trace需要记录的信息字段
-		rootSpan.SetName(fmt.Sprintf("%s - %s", pod.Spec.NodeName, pod.Name))
-		rootSpan.SetAttributes(
-			attribute.KeyValue{
+		// 接管leader时重放的pod已经在追踪(本副本上一个任期中的pod)，不能再开启新的trace
+		if _, ok := PodCtxSet.Peek(pod.UID); ok {
+			return
+		}
+		// informer重启或接管leader时，从存储中恢复pod的trace并继续
+		if p.resume(pod, isInInitialList) {
+			return
+		}
+
+		// pod有owner(ex: ReplicaSet Job)时，加入owner的trace
+		parentCtx := context.Background()
+		if owner, ok := ownerSpanInfo(pod.OwnerReferences); ok {
+			parentCtx = owner.Ctx
+		}
+		attrs := []attribute.KeyValue{
+			{
 				Key:   "node",
 				Value: attribute.StringValue(pod.Spec.NodeName),
 			},
-			attribute.KeyValue{
-				Key:   "creationTimestamp",
-				Value: attribute.StringValue(pod.CreationTimestamp.String()),
-			},
-		)
+		}
 		if len(pod.OwnerReferences) != 0 {
-			rootSpan.SetAttributes(attribute.KeyValue{
-				Key: "ownerReference",
+			attrs = append(attrs, attribute.KeyValue{
+				Key:   "ownerReference",
 				Value: attribute.StringValue(fmt.Sprintf("name: %s kind: %s", pod.OwnerReferences[0].Name, pod.OwnerReferences[0].Kind)),
 			})
 		}
+		// 初始化 rootCtx podLifeCtx，初始列表中没有记录的pod在informer启动前就已存在，span从pod创建时间开始
+		spanInfo := startLifecycle(tracer, parentCtx, pod, fmt.Sprintf("%s - %s", pod.Spec.NodeName, pod.Name),
+			"pod-lifecycle", isInInitialList, attrs...)
+		p.scheduling.OnPodUpdate(spanInfo.Ctx, pod)
+		// 已经发生的阶段(ex: 初始列表中已就绪的pod)按condition时间补记
+		p.recordPhases(spanInfo.Ctx, nil, pod)
+		p.containers.OnPodUpdate(spanInfo.Ctx, nil, pod)
+
+		// 保存信息
+		PodCtxSet.Add(pod.UID, spanInfo)
+		p.events.Flush(pod.UID)
+		if err := p.store.Save(pod, NewSpanRecord(spanInfo)); err != nil {
+			log.Println("save span record err:", pod.Name, err)
+		}
 	}
 }
 
+// resume 从存储中找到pod在上一个进程中的trace，开启一个resumed根span并通过link指向上一个trace，
+// 上一个进程的span没有结束、不会被导出，不能作为父span，
+// 区分informer重启的初始列表重放与新创建的pod
+func (p *PodHandler) resume(pod *v1.Pod, isInInitialList bool) bool {
+	record, ok, err := p.store.Load(pod)
+	if err != nil {
+		log.Println("load span record err:", pod.Name, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	previous, err := record.SpanInfo()
+	if err != nil {
+		log.Println("restore span record err:", pod.Name, err)
+		return false
+	}
+	tracer := p.provider.Tracer("pods")
+
+	links := []oteltrace.Link{
+		{
+			SpanContext: oteltrace.SpanContextFromContext(previous.Ctx),
+			Attributes: []attribute.KeyValue{
+				{
+					Key:   "previous",
+					Value: attribute.StringValue("pod-lifecycle"),
+				},
+			},
+		},
+	}
+	if root := oteltrace.SpanContextFromContext(previous.RootCtx); !root.Equal(links[0].SpanContext) {
+		links = append(links, oteltrace.Link{
+			SpanContext: root,
+			Attributes: []attribute.KeyValue{
+				{
+					Key:   "previous",
+					Value: attribute.StringValue("pod"),
+				},
+			},
+		})
+	}
+	parentCtx := context.Background()
+	if owner, ok := ownerSpanInfo(pod.OwnerReferences); ok {
+		parentCtx = owner.Ctx
+	}
+	rootCtx, rootSpan := tracer.Start(parentCtx, fmt.Sprintf("%s - %s(resumed)", pod.Spec.NodeName, pod.Name), oteltrace.WithLinks(links...))
+	podLifeCtx, _ := tracer.Start(rootCtx, "pod-lifecycle")
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(podLifeCtx, carrier)
+	spanInfo := &SpanInfo{
+		RootCtx: rootCtx,
+		Ctx:     podLifeCtx,
+		Carrier: carrier,
+		Key:     pod.Namespace + "/" + pod.Name,
+	}
+	PodCtxSet.Add(pod.UID, spanInfo)
+	p.scheduling.OnPodUpdate(spanInfo.Ctx, pod)
+	p.containers.OnPodUpdate(spanInfo.Ctx, nil, pod)
+	p.events.Flush(pod.UID)
+	// 之后的重启从本次的trace继续
+	if err := p.store.Save(pod, NewSpanRecord(spanInfo)); err != nil {
+		log.Println("save span record err:", pod.Name, err)
+	}
+
+	rootSpan.SetAttributes(
+		attribute.KeyValue{
+			Key:   "node",
+			Value: attribute.StringValue(pod.Spec.NodeName),
+		},
+		attribute.KeyValue{
+			Key:   "creationTimestamp",
+			Value: attribute.StringValue(pod.CreationTimestamp.String()),
+		},
+		attribute.KeyValue{
+			Key:   "discoveredOnStartup",
+			Value: attribute.BoolValue(isInInitialList),
+		},
+		attribute.KeyValue{
+			Key:   "phase",
+			Value: attribute.StringValue(string(pod.Status.Phase)),
+		},
+		attribute.KeyValue{
+			Key:   "previousTraceID",
+			Value: attribute.StringValue(links[0].SpanContext.TraceID().String()),
+		},
+		attribute.KeyValue{
+			Key:   "recordUpdatedAt",
+			Value: attribute.StringValue(record.UpdatedAt.String()),
+		},
+	)
+	return true
+}
+
 func (p *PodHandler) OnUpdate(oldObj, newObj interface{}) {
+	if err := p.OnUpdateWithError(oldObj, newObj); err != nil {
+		log.Println(err)
+	}
+}
+
+// OnUpdateWithError 记录pod更新，pod还没有trace时返回错误，QueuedHandler会限速重试，
+// 等待pod的新增(ex: 从存储恢复)处理完成
+func (p *PodHandler) OnUpdateWithError(oldObj, newObj interface{}) error {
 	if pod, ok := newObj.(*v1.Pod); ok {
+		// 只是写入了trace annotation，不需要记录
+		oldPod, _ := oldObj.(*v1.Pod)
+		if oldPod != nil && isTraceAnnotationOnlyUpdate(oldPod, pod) {
+			return nil
+		}
 		// 从缓存获取
-		v, ok := PodCtxSet.Get(pod.UID)
+		spanInfo, ok := PodCtxSet.Get(pod.UID)
 		if !ok {
-			log.Println("not found carrier:", pod.Name)
-			return
+			return fmt.Errorf("%w: %s", errPodNotTracked, pod.Name)
 		}
-		spanInfo := v.(*SpanInfo)
+		// condition变为True时，补记对应阶段的span
+		p.scheduling.OnPodUpdate(spanInfo.Ctx, pod)
+		p.recordPhases(spanInfo.Ctx, oldPod, pod)
+		p.containers.OnPodUpdate(spanInfo.Ctx, oldPod, pod)
 		// 把trace载体信息（ex: http特定的头)注入到新ctx
 		newCtx := otel.GetTextMapPropagator().Extract(context.Background(), spanInfo.Carrier)
 		tracer := p.provider.Tracer("pods")
 		info := k8shelper.PrintPod(pod)
+		failure, failed := ClassifyPodFailure(pod, info)
 
-		// 处理完成or异常情况
+		// 处理完成or异常情况，结束生命周期span的reason可配置
 		childSpan := oteltrace.SpanFromContext(spanInfo.Ctx)
 		if childSpan.IsRecording() {
-			if info.Reason == "Completed" || info.Reason == "Error" {
+			if isTerminalReason(PodTerminalReasons, info.Reason, false) || (failed && isTerminalReason(PodTerminalReasons, failure.Reason, true)) {
 				childSpan.SetName(fmt.Sprintf("%s - %s(%s) ", pod.Spec.NodeName, pod.Name, info.ContainerReady))
+				if failed {
+					recordFailure(childSpan, failure)
+				}
 				childSpan.End()
 			}
 		}
 
-		// 基于Ctx链路的trace继续跟踪
-		_, span := tracer.Start(newCtx, fmt.Sprintf("%s(%s) - %s", pod.Name, info.ContainerReady, info.Reason))
+		// 基于Ctx链路的trace继续跟踪，节点异常期间的更新link到节点的condition span，
+		// 等待挂载卷时link到PVC的trace
+		links := append(p.nodes.ConditionLinks(pod.Spec.NodeName), p.volumes.ClaimLinks(pod, info.Reason)...)
+		_, span := tracer.Start(newCtx, fmt.Sprintf("%s(%s) - %s", pod.Name, info.ContainerReady, info.Reason),
+			oteltrace.WithLinks(links...))
 
 		defer span.End()
 
-
-		if info.Reason == "Error" {
-			span.RecordError(fmt.Errorf("pod error"))
+		if failed {
+			recordFailure(span, failure)
 		}
 
 		// 记录需要的字段
@@ -140,30 +314,28 @@ func (p *PodHandler) OnUpdate(oldObj, newObj interface{}) {
 			},
 		)
 	}
+	return nil
 }
 
 func (p *PodHandler) OnDelete(obj interface{}) {
+	// watch中断期间错过的删除，会以DeletedFinalStateUnknown的形式传入，此时pod为最后一次已知状态
+	obj, finalStateUnknown := unwrapTombstone(obj)
 	if pod, ok := obj.(*v1.Pod); ok {
 
-		v, ok := PodCtxSet.Get(pod.UID)
+		spanInfo, ok := PodCtxSet.Get(pod.UID)
 		if !ok {
 			log.Println("not found carrier:", pod.Name)
 			return
 		}
-		spanInfo := v.(*SpanInfo)
+		PodCtxSet.Remove(pod.UID)
+		p.containers.OnPodDelete(pod.UID)
+		p.scheduling.OnPodDelete(pod.UID)
+		if err := p.store.Delete(pod); err != nil {
+			log.Println("delete span record err:", pod.Name, err)
+		}
 
 		// 当删除操作时，需要结束trace追踪
-		parentSpan := oteltrace.SpanFromContext(spanInfo.RootCtx)
-		childSpan := oteltrace.SpanFromContext(spanInfo.Ctx)
-
-		parentSpan.SetStatus(codes.Unset, "pod deleted")
-		parentSpan.SetName(fmt.Sprintf("%s - %s(deleted)", pod.Spec.NodeName, pod.Name))
-
-		defer childSpan.End()
-		defer parentSpan.End()
-
-
-		childSpan.SetAttributes(
+		endLifecycle(p.provider.Tracer("pods"), spanInfo, pod, "pod", fmt.Sprintf("%s - %s", pod.Spec.NodeName, pod.Name), finalStateUnknown,
 			attribute.KeyValue{
 				Key:   "node",
 				Value: attribute.StringValue(pod.Spec.NodeName),
@@ -172,12 +344,42 @@ func (p *PodHandler) OnDelete(obj interface{}) {
 				Key:   "creationTimestamp",
 				Value: attribute.StringValue(pod.CreationTimestamp.String()),
 			},
-			attribute.KeyValue{
-				Key:   "deletionTimestamp",
-				Value: attribute.StringValue(pod.DeletionTimestamp.String()),
-			},
 		)
 	}
 }
 
-var _ cache.ResourceEventHandler = &PodHandler{}
+// endPodTrace 结束pod的生命周期span与根span，
+// 生命周期span已经结束(pod进入终止状态)时，使用新的span记录结束原因
+func (p *PodHandler) endPodTrace(spanInfo *SpanInfo, name string, code codes.Code, description string, attrs ...attribute.KeyValue) {
+	parentSpan := oteltrace.SpanFromContext(spanInfo.RootCtx)
+	childSpan := oteltrace.SpanFromContext(spanInfo.Ctx)
+	if !childSpan.IsRecording() {
+		_, childSpan = p.provider.Tracer("pods").Start(spanInfo.Ctx, name)
+	}
+
+	parentSpan.SetStatus(code, description)
+	parentSpan.SetName(name)
+
+	defer childSpan.End()
+	defer parentSpan.End()
+
+	childSpan.SetAttributes(attrs...)
+	if code == codes.Error {
+		childSpan.SetStatus(code, description)
+	}
+}
+
+func (p *PodHandler) OnAddWithError(obj interface{}, isInInitialList bool) error {
+	p.OnAdd(obj, isInInitialList)
+	return nil
+}
+
+func (p *PodHandler) OnDeleteWithError(obj interface{}) error {
+	p.OnDelete(obj)
+	return nil
+}
+
+var (
+	_ cache.ResourceEventHandler = &PodHandler{}
+	_ ErrorHandler               = &PodHandler{}
+)
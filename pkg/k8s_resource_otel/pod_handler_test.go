@@ -0,0 +1,50 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/lru"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/apimachinery/pkg/types"
+	"testing"
+)
+
+func TestPodEvictedSpanEnded(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	GlobalJaegerProvider = trace.NewTracerProvider(trace.WithSpanProcessor(recorder))
+	GlobalContainerTracker = NewContainerTracker(GlobalJaegerProvider)
+	GlobalSchedulingTracker = NewSchedulingTracker(GlobalJaegerProvider)
+	cacheConfig := lru.NewCacheConfig[types.UID, *SpanInfo](0, 1, lru.ChangeCallbacks[types.UID, *SpanInfo]{EvictFunc: onPodEvicted})
+	pods := lru.NewShardedCache[types.UID, *SpanInfo](1, lru.StringHasher[types.UID], cacheConfig, (*lru.CacheConfig[types.UID, *SpanInfo]).LRUCacheMode)
+
+	tracer := GlobalJaegerProvider.Tracer("pods")
+	for _, name := range []string{"foo", "bar"} {
+		rootCtx, _ := tracer.Start(context.Background(), "pod-"+name+"/default")
+		podLifeCtx, _ := tracer.Start(rootCtx, "pod-lifecycle")
+		pods.Add(types.UID(name), &SpanInfo{RootCtx: rootCtx, Ctx: podLifeCtx, Key: "default/" + name})
+	}
+
+	// 缓存只能保存一个pod，foo被淘汰，其根span与生命周期span都已结束
+	ended := recorder.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("expected the evicted root and lifecycle spans to end, got %d spans", len(ended))
+	}
+	for _, span := range ended {
+		if span.Status().Code != codes.Error || span.Status().Description != PodEvictedStatus {
+			t.Errorf("span %s: expected evicted status, got %v", span.Name(), span.Status())
+		}
+	}
+	if _, ok := pods.Peek("foo"); ok {
+		t.Errorf("expected foo to be evicted")
+	}
+	if _, ok := pods.Peek("bar"); !ok {
+		t.Errorf("expected bar to be tracked")
+	}
+
+	// 主动删除的pod由调用方结束span，淘汰回调不能重复结束
+	pods.Remove("bar")
+	if len(recorder.Ended()) != 2 {
+		t.Errorf("removed pod's spans should be ended by the caller, got %d ended spans", len(recorder.Ended()))
+	}
+}
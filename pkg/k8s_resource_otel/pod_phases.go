@@ -0,0 +1,90 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	"time"
+)
+
+// podPhase pod生命周期中的一个阶段，从上一个阶段结束(或pod创建)开始，到condition变为True结束
+type podPhase struct {
+	name      string
+	condition v1.PodConditionType
+}
+
+// podPhases 按顺序排列的阶段：调度 -> init容器 -> 容器启动 -> 就绪
+var podPhases = []podPhase{
+	{name: "scheduling", condition: v1.PodScheduled},
+	{name: "initialization", condition: v1.PodInitialized},
+	{name: "containers-start", condition: v1.ContainersReady},
+	{name: "readiness", condition: v1.PodReady},
+}
+
+// recordPhases 根据condition的LastTransitionTime补记阶段span，span的开始与结束时间都是condition记录的时间，
+// 只记录oldPod中还不是True、pod中已变为True的condition，oldPod为nil时记录所有已为True的condition。
+// oldPod为nil(新增、informer重启或接管leader的重放)时只补记span，不统计耗时，
+// 否则每次重启都会重复统计已存在pod的阶段
+func (p *PodHandler) recordPhases(ctx context.Context, oldPod, pod *v1.Pod) {
+	tracer := p.provider.Tracer("pods")
+	observe := func(phase string, d time.Duration) {
+		if oldPod != nil {
+			InformerMetrics.PodPhaseDurationHistogramVec.WithLabelValues(phase).Observe(d.Seconds())
+		}
+	}
+	start := pod.CreationTimestamp.Time
+	for _, phase := range podPhases {
+		cond := podCondition(pod, phase.condition)
+		if cond == nil || cond.Status != v1.ConditionTrue || cond.LastTransitionTime.IsZero() {
+			continue
+		}
+		end := cond.LastTransitionTime.Time
+		if end.Before(start) {
+			end = start
+		}
+		if oldCond := podCondition(oldPod, phase.condition); oldCond == nil || oldCond.Status != v1.ConditionTrue {
+			// 调度阶段有进行中的span时由SchedulingTracker结束
+			if phase.condition == v1.PodScheduled && p.scheduling.OnScheduled(pod, start, end) {
+				observe(phase.name, end.Sub(start))
+				start = end
+				continue
+			}
+			_, span := tracer.Start(ctx, fmt.Sprintf("%s(%s)", pod.Name, phase.name), oteltrace.WithTimestamp(start))
+			span.SetAttributes(
+				attribute.KeyValue{
+					Key:   "phase",
+					Value: attribute.StringValue(phase.name),
+				},
+				attribute.KeyValue{
+					Key:   "condition",
+					Value: attribute.StringValue(string(phase.condition)),
+				},
+				attribute.KeyValue{
+					Key:   "duration",
+					Value: attribute.StringValue(end.Sub(start).String()),
+				},
+			)
+			span.End(oteltrace.WithTimestamp(end))
+			observe(phase.name, end.Sub(start))
+		}
+		start = end
+	}
+}
+
+// podCondition 获取pod指定类型的condition，pod为nil或没有该condition时返回nil
+func podCondition(pod *v1.Pod, conditionType v1.PodConditionType) *v1.PodCondition {
+	if pod == nil {
+		return nil
+	}
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == conditionType {
+			return &pod.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// podPhaseBuckets 阶段耗时(秒)的histogram桶，100ms到30分钟
+var podPhaseBuckets = []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60, 120, 300, 600, 1800}
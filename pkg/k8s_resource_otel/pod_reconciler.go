@@ -0,0 +1,102 @@
+package k8s_resource_otel
+
+import (
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"log"
+	"time"
+)
+
+const (
+	// PodDeletedMissedStatus 对账时发现pod已经不存在，删除事件被错过
+	PodDeletedMissedStatus = "deleted (missed)"
+	// DefaultReconcileInterval 默认对账周期
+	DefaultReconcileInterval = time.Minute
+)
+
+// unwrapTombstone 取出DeletedFinalStateUnknown中的对象，
+// 第二个返回值表示对象是否为watch中断后补发的删除(最后一次已知状态)
+func unwrapTombstone(obj interface{}) (interface{}, bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj, true
+	}
+	return obj, false
+}
+
+// RunReconciler 周期对比PodCtxSet与informer缓存，结束已经不存在的pod的span，
+// 兜底informer没有投递(或投递前进程重启)的删除事件，只有leader执行对账
+func (p *PodHandler) RunReconciler(stopCh <-chan struct{}, interval time.Duration, gate *LeaderGate, informers ...cache.SharedIndexInformer) {
+	synced := make([]cache.InformerSynced, 0, len(informers))
+	for _, informer := range informers {
+		synced = append(synced, informer.HasSynced)
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		return
+	}
+	if interval <= 0 {
+		interval = DefaultReconcileInterval
+	}
+	missing := sets.New[types.UID]()
+	wait.Until(func() {
+		if !gate.IsLeader() {
+			// 重新成为leader后重新开始计算
+			missing.Clear()
+			return
+		}
+		p.reconcile(informers, missing)
+	}, interval, stopCh)
+}
+
+// reconcile informer缓存先于删除事件的处理移除pod(ex: 删除事件还在队列中等待worker)，
+// 只有连续两次对账都不在informer缓存中(至少一个对账周期)的pod才认为错过了删除事件，
+// missing 记录上一次对账时不在informer缓存中的pod
+func (p *PodHandler) reconcile(informers []cache.SharedIndexInformer, missing sets.Set[types.UID]) {
+	existing := sets.New[types.UID]()
+	for _, informer := range informers {
+		for _, obj := range informer.GetStore().List() {
+			if pod, ok := obj.(*v1.Pod); ok {
+				existing.Insert(pod.UID)
+			}
+		}
+	}
+
+	tracked := PodCtxSet.Keys()
+	// 已经处理了删除事件或重新出现的pod不再等待
+	missing.Delete(missing.Difference(sets.New[types.UID](tracked...)).UnsortedList()...)
+	for _, uid := range tracked {
+		if existing.Has(uid) {
+			missing.Delete(uid)
+			continue
+		}
+		if !missing.Has(uid) {
+			missing.Insert(uid)
+			continue
+		}
+		missing.Delete(uid)
+		spanInfo, ok := PodCtxSet.Peek(uid)
+		if !ok {
+			continue
+		}
+		PodCtxSet.Remove(uid)
+		p.containers.OnPodDelete(uid)
+		p.scheduling.OnPodDelete(uid)
+		if err := p.store.Delete(&metav1.ObjectMeta{UID: uid}); err != nil {
+			log.Println("delete span record err:", spanInfo.Key, err)
+		}
+
+		log.Println("pod vanished without delete event:", spanInfo.Key)
+		p.endPodTrace(spanInfo, fmt.Sprintf("%s(%s)", spanInfo.Key, PodDeletedMissedStatus), codes.Error, PodDeletedMissedStatus,
+			attribute.KeyValue{
+				Key:   "reconciledAt",
+				Value: attribute.StringValue(time.Now().String()),
+			},
+		)
+	}
+}
@@ -0,0 +1,238 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/tracingqueue"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWorkers 默认每个队列的worker数量
+	DefaultWorkers = 2
+	// queueMaxRetries 处理失败(返回错误或panic)时的最大重试次数，超过后丢弃
+	queueMaxRetries = 5
+)
+
+// notificationType informer通知的类型
+type notificationType string
+
+const (
+	notificationAdd    notificationType = "add"
+	notificationUpdate notificationType = "update"
+	notificationDelete notificationType = "delete"
+)
+
+// notification 一次informer通知，保存handler需要的所有参数
+type notification struct {
+	typ             notificationType
+	oldObj, obj     interface{}
+	isInInitialList bool
+}
+
+// ErrorHandler handler可选实现的接口，QueuedHandler优先调用返回错误的方法，
+// 返回错误时通知放回队列限速重试，超过最大重试次数后丢弃
+type ErrorHandler interface {
+	OnAddWithError(obj interface{}, isInInitialList bool) error
+	OnUpdateWithError(oldObj, newObj interface{}) error
+	OnDeleteWithError(obj interface{}) error
+}
+
+// QueuedHandler 把informer通知放入限速队列，由worker异步调用handler，避免阻塞informer的分发。
+// 队列中的key为对象UID，同一对象的通知按顺序保存在pending中，
+// workqueue保证同一key不会被多个worker同时处理，从而保证每个对象的通知顺序。
+// 入队与处理的span由tracingqueue记录，作为对象trace的子span，
+// 对象还没有trace时不记录，避免每个informer通知产生一个独立的trace
+type QueuedHandler struct {
+	name     string
+	handler  cache.ResourceEventHandler
+	provider *trace.TracerProvider
+	queue    *tracingqueue.Queue
+
+	lock sync.Mutex
+	// pending 每个对象待处理的通知
+	pending map[types.UID][]*notification
+}
+
+var _ cache.ResourceEventHandler = &QueuedHandler{}
+
+func NewQueuedHandler(name string, handler cache.ResourceEventHandler, provider *trace.TracerProvider) *QueuedHandler {
+	queue := tracingqueue.New(name, workqueue.DefaultControllerRateLimiter(), provider)
+	queue.DisableRootSpans()
+	return &QueuedHandler{
+		name:     name,
+		handler:  handler,
+		provider: provider,
+		queue:    queue,
+		pending:  map[types.UID][]*notification{},
+	}
+}
+
+func (q *QueuedHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	q.enqueue(&notification{typ: notificationAdd, obj: obj, isInInitialList: isInInitialList})
+}
+
+func (q *QueuedHandler) OnUpdate(oldObj, newObj interface{}) {
+	q.enqueue(&notification{typ: notificationUpdate, oldObj: oldObj, obj: newObj})
+}
+
+func (q *QueuedHandler) OnDelete(obj interface{}) {
+	q.enqueue(&notification{typ: notificationDelete, obj: obj})
+}
+
+// Run 启动workers个worker，stopCh关闭时关闭队列
+func (q *QueuedHandler) Run(stopCh <-chan struct{}, workers int) {
+	defer q.queue.ShutDown()
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	for i := 0; i < workers; i++ {
+		go wait.Until(q.runWorker, time.Second, stopCh)
+	}
+	<-stopCh
+}
+
+// enqueue 对象已有trace时在其中记录一个入队span，reconcile span会作为该span的子span
+func (q *QueuedHandler) enqueue(n *notification) {
+	key, err := notificationKey(n.obj)
+	if err != nil {
+		log.Println("queue", q.name, "skip object:", err)
+		return
+	}
+	ctx := context.Background()
+	if spanInfo, ok := notificationSpanInfo(n.obj); ok {
+		var span oteltrace.Span
+		ctx, span = q.provider.Tracer("workqueue").Start(spanInfo.Ctx, fmt.Sprintf("%s-enqueue(%s)", q.name, n.typ))
+		defer span.End()
+		span.SetAttributes(
+			attribute.KeyValue{
+				Key:   "queue",
+				Value: attribute.StringValue(q.name),
+			},
+			attribute.KeyValue{
+				Key:   "key",
+				Value: attribute.StringValue(string(key)),
+			},
+		)
+	}
+
+	q.lock.Lock()
+	q.pending[key] = append(q.pending[key], n)
+	q.lock.Unlock()
+	q.queue.Add(ctx, key)
+}
+
+func (q *QueuedHandler) runWorker() {
+	for q.processNextItem() {
+	}
+}
+
+func (q *QueuedHandler) processNextItem() bool {
+	ctx, item, shutdown := q.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer q.queue.Done(item)
+	if err := q.queue.Reconcile(ctx, item, q.reconcile); err != nil {
+		log.Println("queue", q.name, "reconcile err:", item, err)
+	}
+	return true
+}
+
+// reconcile 按顺序处理对象所有待处理的通知，处理失败时把剩余通知放回pending并重试，
+// 超过最大重试次数后丢弃失败的通知
+func (q *QueuedHandler) reconcile(ctx context.Context, item interface{}) (tracingqueue.Result, error) {
+	key := item.(types.UID)
+	q.lock.Lock()
+	items := q.pending[key]
+	delete(q.pending, key)
+	q.lock.Unlock()
+
+	span := oteltrace.SpanFromContext(ctx)
+	for i, n := range items {
+		span.AddEvent(string(n.typ))
+		err := q.process(n)
+		if err == nil {
+			continue
+		}
+		if q.queue.NumRequeues(key) >= queueMaxRetries {
+			log.Println("queue", q.name, "drop notification after retries:", key, n.typ, err)
+			span.SetAttributes(attribute.KeyValue{
+				Key:   "dropped",
+				Value: attribute.BoolValue(true),
+			})
+			q.queue.Forget(key)
+			continue
+		}
+		q.lock.Lock()
+		q.pending[key] = append(items[i:], q.pending[key]...)
+		q.lock.Unlock()
+		return tracingqueue.Result{}, err
+	}
+	return tracingqueue.Result{}, nil
+}
+
+// process 调用handler，handler实现ErrorHandler时返回其错误，handler中的panic作为错误返回
+func (q *QueuedHandler) process(n *notification) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic on %s: %v", n.typ, r)
+		}
+	}()
+	if h, ok := q.handler.(ErrorHandler); ok {
+		switch n.typ {
+		case notificationAdd:
+			return h.OnAddWithError(n.obj, n.isInInitialList)
+		case notificationUpdate:
+			return h.OnUpdateWithError(n.oldObj, n.obj)
+		case notificationDelete:
+			return h.OnDeleteWithError(n.obj)
+		}
+		return nil
+	}
+	switch n.typ {
+	case notificationAdd:
+		q.handler.OnAdd(n.obj, n.isInInitialList)
+	case notificationUpdate:
+		q.handler.OnUpdate(n.oldObj, n.obj)
+	case notificationDelete:
+		q.handler.OnDelete(n.obj)
+	}
+	return nil
+}
+
+// notificationSpanInfo 通知对应对象的trace，event使用其关联对象的trace
+func notificationSpanInfo(obj interface{}) (*SpanInfo, bool) {
+	obj, _ = unwrapTombstone(obj)
+	switch o := obj.(type) {
+	case *v1.Pod:
+		return PodCtxSet.Peek(o.UID)
+	case *v1.Event:
+		return ObjectSpanInfo(o.InvolvedObject.Kind, o.InvolvedObject.UID)
+	case *eventsv1.Event:
+		return ObjectSpanInfo(o.Regarding.Kind, o.Regarding.UID)
+	}
+	return nil, false
+}
+
+// notificationKey 使用对象UID作为队列的key，删除时的DeletedFinalStateUnknown取其中的对象
+func notificationKey(obj interface{}) (types.UID, error) {
+	obj, _ = unwrapTombstone(obj)
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return "", err
+	}
+	return m.GetUID(), nil
+}
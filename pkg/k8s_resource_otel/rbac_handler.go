@@ -0,0 +1,296 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/k8shelper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+	"strings"
+)
+
+var _ cache.ResourceEventHandler = &RBACHandler{}
+
+// rbacObject 从Role ClusterRole RoleBinding ClusterRoleBinding中抽取出的通用字段
+type rbacObject struct {
+	Kind string
+	Meta *metav1.ObjectMeta
+	// Rules Role与ClusterRole的规则
+	Rules []rbacv1.PolicyRule
+	// Subjects RoleRef RoleBinding与ClusterRoleBinding的主体与引用的角色
+	Subjects []rbacv1.Subject
+	RoleRef  *rbacv1.RoleRef
+}
+
+// toRBACObject 把informer传入的对象转为rbacObject，不支持的类型返回false
+func toRBACObject(obj interface{}) (*rbacObject, bool) {
+	switch o := obj.(type) {
+	case *rbacv1.Role:
+		return &rbacObject{Kind: "Role", Meta: &o.ObjectMeta, Rules: o.Rules}, true
+	case *rbacv1.ClusterRole:
+		return &rbacObject{Kind: "ClusterRole", Meta: &o.ObjectMeta, Rules: o.Rules}, true
+	case *rbacv1.RoleBinding:
+		return &rbacObject{Kind: "RoleBinding", Meta: &o.ObjectMeta, Subjects: o.Subjects, RoleRef: &o.RoleRef}, true
+	case *rbacv1.ClusterRoleBinding:
+		return &rbacObject{Kind: "ClusterRoleBinding", Meta: &o.ObjectMeta, Subjects: o.Subjects, RoleRef: &o.RoleRef}, true
+	}
+	return nil, false
+}
+
+// RBACHandler 把RBAC对象的每次变更记录为一个独立的trace，包含规则与主体的增减，
+// 授予通配符权限时设置标记，方便按属性查询权限变更的历史
+type RBACHandler struct {
+	provider *trace.TracerProvider
+}
+
+func NewRBACHandler() *RBACHandler {
+	return &RBACHandler{
+		provider: GlobalJaegerProvider,
+	}
+}
+
+// OnAdd 初始列表中的对象已经存在，只记录新创建的对象
+func (r *RBACHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	if isInInitialList {
+		return
+	}
+	if o, ok := toRBACObject(obj); ok {
+		r.record("create", nil, o)
+	}
+}
+
+func (r *RBACHandler) OnUpdate(oldObj, newObj interface{}) {
+	old, ok := toRBACObject(oldObj)
+	if !ok {
+		return
+	}
+	o, ok := toRBACObject(newObj)
+	if !ok || old.Meta.ResourceVersion == o.Meta.ResourceVersion {
+		return
+	}
+	r.record("update", old, o)
+}
+
+func (r *RBACHandler) OnDelete(obj interface{}) {
+	obj, _ = unwrapTombstone(obj)
+	if o, ok := toRBACObject(obj); ok {
+		r.record("delete", o, nil)
+	}
+}
+
+// record 对比变更前后的对象，更新时没有规则、主体与autoupdate的变化则不记录，
+// old为nil时为创建，o为nil时为删除
+func (r *RBACHandler) record(verb string, old, o *rbacObject) {
+	current := o
+	if current == nil {
+		current = old
+	}
+	if old == nil {
+		old = &rbacObject{Kind: current.Kind, Meta: &metav1.ObjectMeta{}}
+	}
+	if o == nil {
+		o = &rbacObject{Kind: current.Kind, Meta: &metav1.ObjectMeta{}}
+	}
+
+	addedRules, removedRules := diffStrings(ruleStrings(old.Rules), ruleStrings(o.Rules))
+	attrs := []attribute.KeyValue{
+		{
+			Key:   "kind",
+			Value: attribute.StringValue(current.Kind),
+		},
+		{
+			Key:   "namespace",
+			Value: attribute.StringValue(current.Meta.Namespace),
+		},
+		{
+			Key:   "name",
+			Value: attribute.StringValue(current.Meta.Name),
+		},
+		{
+			Key:   "verb",
+			Value: attribute.StringValue(verb),
+		},
+		{
+			Key:   "resourceVersion",
+			Value: attribute.StringValue(current.Meta.ResourceVersion),
+		},
+	}
+	changed := len(addedRules) != 0 || len(removedRules) != 0
+	if changed {
+		attrs = append(attrs,
+			attribute.KeyValue{
+				Key:   "rules.added",
+				Value: attribute.StringSliceValue(addedRules),
+			},
+			attribute.KeyValue{
+				Key:   "rules.removed",
+				Value: attribute.StringSliceValue(removedRules),
+			},
+		)
+	}
+
+	// 主体按用户、组、ServiceAccount与其他类型分别对比
+	oldSubjects, subjects := subjectStrings(old.Subjects), subjectStrings(o.Subjects)
+	for i, category := range []string{"users", "groups", "serviceAccounts", "others"} {
+		added, removed := diffStrings(oldSubjects[i], subjects[i])
+		if len(added) == 0 && len(removed) == 0 {
+			continue
+		}
+		changed = true
+		attrs = append(attrs,
+			attribute.KeyValue{
+				Key:   attribute.Key(fmt.Sprintf("subjects.%s.added", category)),
+				Value: attribute.StringSliceValue(added),
+			},
+			attribute.KeyValue{
+				Key:   attribute.Key(fmt.Sprintf("subjects.%s.removed", category)),
+				Value: attribute.StringSliceValue(removed),
+			},
+		)
+	}
+	if current.RoleRef != nil {
+		attrs = append(attrs, attribute.KeyValue{
+			Key:   "roleRef",
+			Value: attribute.StringValue(fmt.Sprintf("%s/%s", current.RoleRef.Kind, current.RoleRef.Name)),
+		})
+	}
+
+	// autoupdate不为false的对象(ex: 系统内置角色)在apiserver启动时会被重新对齐，手动修改会被覆盖
+	autoUpdate := current.Meta.Annotations[k8shelper.AutoUpdateAnnotationKey]
+	oldAutoUpdate := old.Meta.Annotations[k8shelper.AutoUpdateAnnotationKey]
+	autoUpdateChanged := verb == "update" && oldAutoUpdate != autoUpdate
+	if verb == "update" && !changed && !autoUpdateChanged {
+		return
+	}
+	if autoUpdate != "" {
+		attrs = append(attrs, attribute.KeyValue{
+			Key:   "autoUpdate",
+			Value: attribute.BoolValue(autoUpdate != "false"),
+		})
+	}
+
+	// 通配符权限：新增的规则中是否有通配符，以及对象整体是否有通配符
+	addedWildcards := rulesOf(addedRules, o.Rules)
+	attrs = append(attrs, wildcardAttributes("added.", addedWildcards)...)
+	attrs = append(attrs, wildcardAttributes("", current.Rules)...)
+
+	_, span := r.provider.Tracer("rbac").Start(context.Background(), fmt.Sprintf("%s %s/%s", verb, current.Kind, current.Meta.Name))
+	defer span.End()
+	span.SetAttributes(attrs...)
+	if hasWildcard(addedWildcards) {
+		span.AddEvent("wildcard-granted")
+	}
+	if verb == "update" && autoUpdate == "true" {
+		span.AddEvent("autoupdate", oteltrace.WithAttributes(attribute.KeyValue{
+			Key:   "message",
+			Value: attribute.StringValue("object is reconciled by kube-apiserver on restart, manual changes may be reverted"),
+		}))
+	}
+	if autoUpdateChanged {
+		span.AddEvent("autoupdate-changed", oteltrace.WithAttributes(
+			attribute.KeyValue{
+				Key:   "old",
+				Value: attribute.StringValue(oldAutoUpdate),
+			},
+			attribute.KeyValue{
+				Key:   "new",
+				Value: attribute.StringValue(autoUpdate),
+			},
+		))
+	}
+}
+
+// ruleStrings 每条规则的字符串形式，用于对比
+func ruleStrings(rules []rbacv1.PolicyRule) []string {
+	s := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		s = append(s, ruleString(rule))
+	}
+	return s
+}
+
+// ruleString 与kubectl describe类似的规则描述，ex: verbs=get,list apiGroups=apps resources=deployments
+func ruleString(rule rbacv1.PolicyRule) string {
+	parts := []string{"verbs=" + strings.Join(rule.Verbs, ",")}
+	if len(rule.APIGroups) != 0 {
+		parts = append(parts, "apiGroups="+strings.Join(rule.APIGroups, ","))
+	}
+	if len(rule.Resources) != 0 {
+		parts = append(parts, "resources="+strings.Join(rule.Resources, ","))
+	}
+	if len(rule.ResourceNames) != 0 {
+		parts = append(parts, "resourceNames="+strings.Join(rule.ResourceNames, ","))
+	}
+	if len(rule.NonResourceURLs) != 0 {
+		parts = append(parts, "nonResourceURLs="+strings.Join(rule.NonResourceURLs, ","))
+	}
+	return strings.Join(parts, " ")
+}
+
+// rulesOf 找出字符串形式在selected中的规则
+func rulesOf(selected []string, rules []rbacv1.PolicyRule) []rbacv1.PolicyRule {
+	set := sets.New[string](selected...)
+	var result []rbacv1.PolicyRule
+	for _, rule := range rules {
+		if set.Has(ruleString(rule)) {
+			result = append(result, rule)
+		}
+	}
+	return result
+}
+
+// subjectStrings 按用户、组、ServiceAccount与其他类型拆分主体
+func subjectStrings(subjects []rbacv1.Subject) [4][]string {
+	users, groups, sas, others := k8shelper.SubjectsStrings(subjects)
+	return [4][]string{users, groups, sas, others}
+}
+
+// diffStrings 返回new中新增与old中被删除的元素，按字母排序
+func diffStrings(old, new []string) ([]string, []string) {
+	oldSet, newSet := sets.New[string](old...), sets.New[string](new...)
+	return sets.List(newSet.Difference(oldSet)), sets.List(oldSet.Difference(newSet))
+}
+
+// wildcardAttributes 规则中是否包含通配符的动作、资源、API组与非资源URL
+func wildcardAttributes(prefix string, rules []rbacv1.PolicyRule) []attribute.KeyValue {
+	var verbs, resources, groups, urls bool
+	for _, rule := range rules {
+		verbs = verbs || sets.New[string](rule.Verbs...).Has(k8shelper.VerbAll)
+		resources = resources || sets.New[string](rule.Resources...).Has(k8shelper.ResourceAll)
+		groups = groups || sets.New[string](rule.APIGroups...).Has(k8shelper.APIGroupAll)
+		urls = urls || sets.New[string](rule.NonResourceURLs...).Has(k8shelper.NonResourceAll)
+	}
+	return []attribute.KeyValue{
+		{
+			Key:   attribute.Key(prefix + "wildcardVerbs"),
+			Value: attribute.BoolValue(verbs),
+		},
+		{
+			Key:   attribute.Key(prefix + "wildcardResources"),
+			Value: attribute.BoolValue(resources),
+		},
+		{
+			Key:   attribute.Key(prefix + "wildcardAPIGroups"),
+			Value: attribute.BoolValue(groups),
+		},
+		{
+			Key:   attribute.Key(prefix + "wildcardNonResourceURLs"),
+			Value: attribute.BoolValue(urls),
+		},
+	}
+}
+
+// hasWildcard 规则是否授予了通配符的动作或资源
+func hasWildcard(rules []rbacv1.PolicyRule) bool {
+	for _, rule := range rules {
+		if sets.New[string](rule.Verbs...).Has(k8shelper.VerbAll) || sets.New[string](rule.Resources...).Has(k8shelper.ResourceAll) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,360 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sync"
+	"time"
+)
+
+const (
+	// RevisionAnnotation deployment controller在Deployment与ReplicaSet上记录的revision
+	RevisionAnnotation = "deployment.kubernetes.io/revision"
+
+	// deployment controller在Progressing condition上使用的reason
+	newRSAvailableReason     = "NewReplicaSetAvailable"
+	timedOutReason           = "ProgressDeadlineExceeded"
+	defaultProgressDeadline  = 600 * time.Second
+	rolloutDeadlineCheckTime = 10 * time.Second
+)
+
+// GlobalRolloutTracker 全局rollout追踪器，由Deployment与ReplicaSet的handler共同驱动
+var GlobalRolloutTracker *RolloutTracker
+
+// rolloutStep rollout中某个ReplicaSet的一次扩缩容步骤
+type rolloutStep struct {
+	span oteltrace.Span
+	// target 本次步骤的目标副本数
+	target int32
+	// scaleUp 是否为新ReplicaSet的扩容
+	scaleUp bool
+}
+
+// rolloutInfo 一次进行中的rollout
+type rolloutInfo struct {
+	// Revision 触发rollout的revision
+	Revision string
+	Ctx      context.Context
+	// LastProgress 最近一次有进展的时间，用于判断progressDeadlineSeconds
+	LastProgress     time.Time
+	ProgressDeadline time.Duration
+	// Paused Deployment处于暂停状态，与deployment controller一致，暂停期间不判断progressDeadlineSeconds
+	Paused bool
+	// steps 正在进行的扩缩容步骤，key为ReplicaSet UID
+	steps map[types.UID]*rolloutStep
+}
+
+// RolloutTracker 当Deployment的pod template变化时，以revision为key开启rollout span，
+// 新ReplicaSet的扩容与旧ReplicaSet的缩容作为子span，
+// 最后根据Progressing/Available condition与progressDeadlineSeconds结束rollout
+type RolloutTracker struct {
+	provider *trace.TracerProvider
+	lock     sync.Mutex
+	// rollouts 进行中的rollout，key为Deployment UID
+	rollouts map[types.UID]*rolloutInfo
+	// pending 先于Deployment revision变化到达的新ReplicaSet，key为Deployment UID，
+	// deployment controller先创建新ReplicaSet再更新Deployment的revision，两个informer的分发顺序不确定
+	pending map[types.UID]*appsv1.ReplicaSet
+	// now 获取当前时间，方便替换
+	now func() time.Time
+}
+
+func NewRolloutTracker(provider *trace.TracerProvider) *RolloutTracker {
+	return &RolloutTracker{
+		provider: provider,
+		rollouts: map[types.UID]*rolloutInfo{},
+		pending:  map[types.UID]*appsv1.ReplicaSet{},
+		now:      time.Now,
+	}
+}
+
+// OnDeploymentUpdate 处理Deployment更新：开启新的rollout，记录condition变化并判断是否结束
+func (r *RolloutTracker) OnDeploymentUpdate(deploymentCtx context.Context, oldDep, newDep *appsv1.Deployment) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	revision := newDep.Annotations[RevisionAnnotation]
+	ro, ok := r.rollouts[newDep.UID]
+
+	// 1. revision变化，说明pod template改变(或回滚)，开启新的rollout
+	if revision != "" && revision != oldDep.Annotations[RevisionAnnotation] {
+		if ok {
+			r.finish(ro, codes.Error, fmt.Sprintf("superseded by revision %s", revision))
+		}
+		ro = r.start(deploymentCtx, newDep)
+		r.rollouts[newDep.UID] = ro
+		ok = true
+		// 新ReplicaSet的创建已经先到达，补上第一次扩容
+		if rs, found := r.pending[newDep.UID]; found && rs.Annotations[RevisionAnnotation] == revision {
+			r.scale(ro, 0, rs)
+		}
+		delete(r.pending, newDep.UID)
+	}
+	if !ok {
+		return
+	}
+
+	// 恢复暂停的Deployment时重新开始计算progressDeadlineSeconds
+	if ro.Paused && !newDep.Spec.Paused {
+		ro.LastProgress = r.now()
+	}
+	ro.Paused = newDep.Spec.Paused
+
+	span := oteltrace.SpanFromContext(ro.Ctx)
+	// 2. 记录condition变化，方便查看rollout停在哪里
+	for _, c := range newDep.Status.Conditions {
+		oldC := deploymentCondition(oldDep.Status.Conditions, c.Type)
+		if oldC == nil || oldC.Status != c.Status || oldC.Reason != c.Reason {
+			span.AddEvent(fmt.Sprintf("%s=%s", c.Type, c.Status), oteltrace.WithAttributes(
+				attribute.KeyValue{
+					Key:   "reason",
+					Value: attribute.StringValue(c.Reason),
+				},
+				attribute.KeyValue{
+					Key:   "message",
+					Value: attribute.StringValue(c.Message),
+				},
+			))
+		}
+	}
+	if newDep.Status.UpdatedReplicas != oldDep.Status.UpdatedReplicas ||
+		newDep.Status.AvailableReplicas != oldDep.Status.AvailableReplicas {
+		ro.LastProgress = r.now()
+	}
+
+	// 3. 判断rollout是否结束
+	progressing := deploymentCondition(newDep.Status.Conditions, appsv1.DeploymentProgressing)
+	available := deploymentCondition(newDep.Status.Conditions, appsv1.DeploymentAvailable)
+	switch {
+	case progressing != nil && progressing.Status == v1.ConditionFalse && progressing.Reason == timedOutReason:
+		r.finish(ro, codes.Error, progressing.Message)
+		delete(r.rollouts, newDep.UID)
+	case rolloutComplete(newDep) && progressing != nil && progressing.Reason == newRSAvailableReason &&
+		available != nil && available.Status == v1.ConditionTrue:
+		span.SetAttributes(deploymentReplicaAttributes(newDep)...)
+		r.finish(ro, codes.Ok, progressing.Message)
+		delete(r.rollouts, newDep.UID)
+	}
+}
+
+// OnReplicaSetAdd 处理新创建的ReplicaSet：新ReplicaSet创建时带有的副本数就是rollout的第一次扩容，
+// Deployment的revision还没有变化时先暂存，开启rollout时再记录
+func (r *RolloutTracker) OnReplicaSetAdd(rs *appsv1.ReplicaSet) {
+	owner := metav1.GetControllerOfNoCopy(rs)
+	if owner == nil || owner.Kind != "Deployment" {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ro, ok := r.rollouts[owner.UID]
+	if !ok || ro.Revision != rs.Annotations[RevisionAnnotation] {
+		r.pending[owner.UID] = rs
+		return
+	}
+	r.scale(ro, 0, rs)
+}
+
+// OnReplicaSetUpdate 处理ReplicaSet更新：新ReplicaSet扩容与旧ReplicaSet缩容作为rollout的子span
+func (r *RolloutTracker) OnReplicaSetUpdate(oldRS, newRS *appsv1.ReplicaSet) {
+	owner := metav1.GetControllerOfNoCopy(newRS)
+	if owner == nil || owner.Kind != "Deployment" {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ro, ok := r.rollouts[owner.UID]
+	if !ok {
+		// 暂存的新ReplicaSet保持最新状态
+		if _, found := r.pending[owner.UID]; found {
+			r.pending[owner.UID] = newRS
+		}
+		return
+	}
+	r.scale(ro, replicasOf(oldRS.Spec.Replicas), newRS)
+}
+
+// scale 副本数变化时开启新的步骤，ReplicaSet状态达到目标时结束步骤，调用方需持有锁
+func (r *RolloutTracker) scale(ro *rolloutInfo, oldReplicas int32, newRS *appsv1.ReplicaSet) {
+	desired := replicasOf(newRS.Spec.Replicas)
+	// 1. 副本数变化，开启新的步骤
+	if desired != oldReplicas {
+		if step, ok := ro.steps[newRS.UID]; ok {
+			step.span.SetStatus(codes.Unset, fmt.Sprintf("superseded by scale to %d", desired))
+			step.span.End()
+		}
+		scaleUp := newRS.Annotations[RevisionAnnotation] == ro.Revision
+		action := "scale-down old"
+		if scaleUp {
+			action = "scale-up new"
+		}
+		tracer := r.provider.Tracer("deployments")
+		_, span := tracer.Start(ro.Ctx, fmt.Sprintf("%s replicaset %s %d -> %d", action, newRS.Name, oldReplicas, desired))
+		span.SetAttributes(
+			attribute.KeyValue{
+				Key:   "replicaset",
+				Value: attribute.StringValue(newRS.Name),
+			},
+			attribute.KeyValue{
+				Key:   "revision",
+				Value: attribute.StringValue(newRS.Annotations[RevisionAnnotation]),
+			},
+		)
+		ro.steps[newRS.UID] = &rolloutStep{span: span, target: desired, scaleUp: scaleUp}
+		ro.LastProgress = r.now()
+	}
+
+	// 2. ReplicaSet状态达到目标，结束步骤
+	step, ok := ro.steps[newRS.UID]
+	if !ok {
+		return
+	}
+	if (step.scaleUp && newRS.Status.AvailableReplicas >= step.target) ||
+		(!step.scaleUp && newRS.Status.Replicas <= step.target) {
+		step.span.SetAttributes(attribute.KeyValue{
+			Key:   "replicas",
+			Value: attribute.StringValue(fmt.Sprintf("desired: %d current: %d available: %d", desired, newRS.Status.Replicas, newRS.Status.AvailableReplicas)),
+		})
+		step.span.SetStatus(codes.Ok, "")
+		step.span.End()
+		delete(ro.steps, newRS.UID)
+		ro.LastProgress = r.now()
+	}
+}
+
+// OnDeploymentDelete Deployment删除时结束未完成的rollout
+func (r *RolloutTracker) OnDeploymentDelete(dep *appsv1.Deployment) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.pending, dep.UID)
+	if ro, ok := r.rollouts[dep.UID]; ok {
+		r.finish(ro, codes.Error, "deployment deleted during rollout")
+		delete(r.rollouts, dep.UID)
+	}
+}
+
+// Run 周期检查进行中的rollout是否超过progressDeadlineSeconds没有进展，
+// deployment controller只会在下一次同步时设置ProgressDeadlineExceeded，这里可以更早发现卡住的rollout
+func (r *RolloutTracker) Run(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(rolloutDeadlineCheckTime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			r.checkDeadlines()
+		}
+	}
+}
+
+func (r *RolloutTracker) checkDeadlines() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+	for uid, ro := range r.rollouts {
+		if ro.Paused {
+			continue
+		}
+		if now.Sub(ro.LastProgress) > ro.ProgressDeadline {
+			r.finish(ro, codes.Error, fmt.Sprintf("no progress for %s (progressDeadlineSeconds)", ro.ProgressDeadline))
+			delete(r.rollouts, uid)
+		}
+	}
+}
+
+// start 开启rollout span，调用方需持有锁
+func (r *RolloutTracker) start(deploymentCtx context.Context, dep *appsv1.Deployment) *rolloutInfo {
+	deadline := defaultProgressDeadline
+	if dep.Spec.ProgressDeadlineSeconds != nil {
+		deadline = time.Duration(*dep.Spec.ProgressDeadlineSeconds) * time.Second
+	}
+
+	tracer := r.provider.Tracer("deployments")
+	revision := dep.Annotations[RevisionAnnotation]
+	ctx, span := tracer.Start(deploymentCtx, fmt.Sprintf("rollout %s revision %s", dep.Name, revision))
+	span.SetAttributes(
+		attribute.KeyValue{
+			Key:   "revision",
+			Value: attribute.StringValue(revision),
+		},
+		attribute.KeyValue{
+			Key:   "strategy",
+			Value: attribute.StringValue(string(dep.Spec.Strategy.Type)),
+		},
+		attribute.KeyValue{
+			Key:   "progressDeadline",
+			Value: attribute.StringValue(deadline.String()),
+		},
+	)
+	if ru := dep.Spec.Strategy.RollingUpdate; ru != nil {
+		if ru.MaxSurge != nil {
+			span.SetAttributes(attribute.KeyValue{Key: "maxSurge", Value: attribute.StringValue(ru.MaxSurge.String())})
+		}
+		if ru.MaxUnavailable != nil {
+			span.SetAttributes(attribute.KeyValue{Key: "maxUnavailable", Value: attribute.StringValue(ru.MaxUnavailable.String())})
+		}
+	}
+
+	return &rolloutInfo{
+		Revision:         revision,
+		Ctx:              ctx,
+		LastProgress:     r.now(),
+		ProgressDeadline: deadline,
+		Paused:           dep.Spec.Paused,
+		steps:            map[types.UID]*rolloutStep{},
+	}
+}
+
+// finish 结束rollout与未完成的步骤，调用方需持有锁
+func (r *RolloutTracker) finish(ro *rolloutInfo, code codes.Code, msg string) {
+	for uid, step := range ro.steps {
+		// 未完成的步骤就是rollout卡住的地方
+		step.span.SetStatus(code, msg)
+		step.span.End()
+		delete(ro.steps, uid)
+	}
+	span := oteltrace.SpanFromContext(ro.Ctx)
+	span.SetStatus(code, msg)
+	span.End()
+}
+
+func deploymentCondition(conditions []appsv1.DeploymentCondition, t appsv1.DeploymentConditionType) *appsv1.DeploymentCondition {
+	for i := range conditions {
+		if conditions[i].Type == t {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// rolloutComplete 所有副本都已更新且可用，且controller已处理最新的generation
+func rolloutComplete(dep *appsv1.Deployment) bool {
+	replicas := replicasOf(dep.Spec.Replicas)
+	return dep.Status.ObservedGeneration >= dep.Generation &&
+		dep.Status.UpdatedReplicas == replicas &&
+		dep.Status.Replicas == replicas &&
+		dep.Status.AvailableReplicas == replicas
+}
+
+func deploymentReplicaAttributes(dep *appsv1.Deployment) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		{
+			Key:   "replicas",
+			Value: attribute.StringValue(fmt.Sprintf("desired: %d updated: %d available: %d", replicasOf(dep.Spec.Replicas), dep.Status.UpdatedReplicas, dep.Status.AvailableReplicas)),
+		},
+	}
+}
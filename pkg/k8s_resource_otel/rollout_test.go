@@ -0,0 +1,323 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/lru"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// rolloutFixture 使用fake clientset驱动Deployment与ReplicaSet的informer，模拟deployment controller的rollout
+type rolloutFixture struct {
+	t        *testing.T
+	client   *fake.Clientset
+	recorder *tracetest.SpanRecorder
+	tracker  *RolloutTracker
+	version  int
+}
+
+func newRolloutFixture(t *testing.T) *rolloutFixture {
+	recorder := tracetest.NewSpanRecorder()
+	GlobalJaegerProvider = trace.NewTracerProvider(trace.WithSpanProcessor(recorder))
+	GlobalRolloutTracker = NewRolloutTracker(GlobalJaegerProvider)
+	// 每个测试使用新的缓存，已在追踪的对象不会重新开启trace
+	cacheConfig := lru.NewCacheConfig[types.UID, *SpanInfo](0, 128, nil)
+	WorkloadCtxSet = lru.NewCache(cacheConfig.LRUCacheMode(), cacheConfig)
+
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	for kind, inf := range map[string]cache.SharedIndexInformer{
+		"Deployment": factory.Apps().V1().Deployments().Informer(),
+		"ReplicaSet": factory.Apps().V1().ReplicaSets().Informer(),
+	} {
+		if _, err := inf.AddEventHandler(NewWorkloadHandler(kind)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+
+	return &rolloutFixture{t: t, client: client, recorder: recorder, tracker: GlobalRolloutTracker}
+}
+
+// nextVersion fake clientset不会设置resourceVersion，handler依赖它跳过resync
+func (f *rolloutFixture) nextVersion() string {
+	f.version++
+	return strconv.Itoa(f.version)
+}
+
+func (f *rolloutFixture) createDeployment(dep *appsv1.Deployment) {
+	dep.ResourceVersion = f.nextVersion()
+	if _, err := f.client.AppsV1().Deployments(dep.Namespace).Create(context.Background(), dep, metav1.CreateOptions{}); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *rolloutFixture) updateDeployment(dep *appsv1.Deployment) {
+	dep.ResourceVersion = f.nextVersion()
+	if _, err := f.client.AppsV1().Deployments(dep.Namespace).Update(context.Background(), dep, metav1.UpdateOptions{}); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *rolloutFixture) createReplicaSet(rs *appsv1.ReplicaSet) {
+	rs.ResourceVersion = f.nextVersion()
+	if _, err := f.client.AppsV1().ReplicaSets(rs.Namespace).Create(context.Background(), rs, metav1.CreateOptions{}); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *rolloutFixture) updateReplicaSet(rs *appsv1.ReplicaSet) {
+	rs.ResourceVersion = f.nextVersion()
+	if _, err := f.client.AppsV1().ReplicaSets(rs.Namespace).Update(context.Background(), rs, metav1.UpdateOptions{}); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// waitFor 等待informer把事件分发给handler
+func (f *rolloutFixture) waitFor(desc string, condition func() bool) {
+	f.t.Helper()
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return condition(), nil
+	})
+	if err != nil {
+		f.t.Fatalf("timed out waiting for %s", desc)
+	}
+}
+
+// endedSpan 按名称查找已结束的span
+func (f *rolloutFixture) endedSpan(name string) (trace.ReadOnlySpan, bool) {
+	for _, span := range f.recorder.Ended() {
+		if span.Name() == name {
+			return span, true
+		}
+	}
+	return nil, false
+}
+
+func (f *rolloutFixture) waitForSpan(name string, code codes.Code) {
+	f.t.Helper()
+	f.waitFor("span "+name, func() bool {
+		_, ok := f.endedSpan(name)
+		return ok
+	})
+	span, _ := f.endedSpan(name)
+	if span.Status().Code != code {
+		f.t.Fatalf("span %s: expected status %s, got %s(%s)", name, code, span.Status().Code, span.Status().Description)
+	}
+}
+
+func (f *rolloutFixture) hasRollout(uid types.UID) bool {
+	f.tracker.lock.Lock()
+	defer f.tracker.lock.Unlock()
+	_, ok := f.tracker.rollouts[uid]
+	return ok
+}
+
+// pendingReplicaSet 暂存的ReplicaSet名称
+func (f *rolloutFixture) pendingReplicaSet(uid types.UID) string {
+	f.tracker.lock.Lock()
+	defer f.tracker.lock.Unlock()
+	if rs, ok := f.tracker.pending[uid]; ok {
+		return rs.Name
+	}
+	return ""
+}
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func newTestDeployment(replicas int32) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			UID:         "deployment-web",
+			Generation:  1,
+			Annotations: map[string]string{RevisionAnnotation: "1"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: int32Ptr(replicas),
+		},
+		Status: appsv1.DeploymentStatus{
+			ObservedGeneration: 1,
+			Replicas:           replicas,
+			UpdatedReplicas:    replicas,
+			AvailableReplicas:  replicas,
+		},
+	}
+}
+
+func newTestReplicaSet(dep *appsv1.Deployment, revision string, replicas int32) *appsv1.ReplicaSet {
+	return &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        dep.Name + "-" + revision,
+			Namespace:   dep.Namespace,
+			UID:         types.UID("replicaset-" + revision),
+			Annotations: map[string]string{RevisionAnnotation: revision},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(dep, appsv1.SchemeGroupVersion.WithKind("Deployment")),
+			},
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Replicas: int32Ptr(replicas),
+		},
+		Status: appsv1.ReplicaSetStatus{
+			Replicas:          replicas,
+			AvailableReplicas: replicas,
+		},
+	}
+}
+
+// TestRolloutFromReplicaSetSteps 新ReplicaSet的创建先于Deployment的revision变化到达，
+// 第一次扩容也要记录为rollout的步骤
+func TestRolloutFromReplicaSetSteps(t *testing.T) {
+	f := newRolloutFixture(t)
+
+	dep := newTestDeployment(1)
+	f.createDeployment(dep)
+	oldRS := newTestReplicaSet(dep, "1", 1)
+	f.createReplicaSet(oldRS)
+	f.waitFor("workloads to be tracked", func() bool {
+		_, depOk := WorkloadCtxSet.Get(dep.UID)
+		_, rsOk := WorkloadCtxSet.Get(oldRS.UID)
+		return depOk && rsOk
+	})
+
+	// 1. deployment controller先创建新ReplicaSet，此时rollout还没有开始
+	newRS := newTestReplicaSet(dep, "2", 1)
+	newRS.Status = appsv1.ReplicaSetStatus{}
+	f.createReplicaSet(newRS)
+	f.waitFor("new replicaset to be pending", func() bool { return f.pendingReplicaSet(dep.UID) == newRS.Name })
+
+	// 2. 再更新Deployment的revision，开启rollout并补上第一次扩容
+	dep.Annotations[RevisionAnnotation] = "2"
+	dep.Generation = 2
+	f.updateDeployment(dep)
+	f.waitFor("rollout to start", func() bool { return f.hasRollout(dep.UID) })
+	if f.pendingReplicaSet(dep.UID) != "" {
+		t.Fatal("pending replicaset should be consumed by the rollout")
+	}
+
+	// 3. 新ReplicaSet可用，结束扩容步骤
+	newRS.Status = appsv1.ReplicaSetStatus{Replicas: 1, AvailableReplicas: 1}
+	f.updateReplicaSet(newRS)
+	f.waitForSpan("scale-up new replicaset web-2 0 -> 1", codes.Ok)
+
+	// 4. 旧ReplicaSet缩容
+	oldRS.Spec.Replicas = int32Ptr(0)
+	f.updateReplicaSet(oldRS)
+	f.waitFor("scale-down step", func() bool {
+		f.tracker.lock.Lock()
+		defer f.tracker.lock.Unlock()
+		_, ok := f.tracker.rollouts[dep.UID].steps[oldRS.UID]
+		return ok
+	})
+	oldRS.Status = appsv1.ReplicaSetStatus{}
+	f.updateReplicaSet(oldRS)
+	f.waitForSpan("scale-down old replicaset web-1 1 -> 0", codes.Ok)
+
+	// 5. Deployment完成rollout
+	dep.Status.ObservedGeneration = 2
+	dep.Status.Conditions = []appsv1.DeploymentCondition{
+		{Type: appsv1.DeploymentProgressing, Status: v1.ConditionTrue, Reason: newRSAvailableReason},
+		{Type: appsv1.DeploymentAvailable, Status: v1.ConditionTrue},
+	}
+	f.updateDeployment(dep)
+	f.waitForSpan("rollout web revision 2", codes.Ok)
+	if f.hasRollout(dep.UID) {
+		t.Fatal("finished rollout should be removed")
+	}
+}
+
+// TestRolloutProgressDeadlineExceeded controller设置ProgressDeadlineExceeded时rollout失败，未完成的步骤就是卡住的地方
+func TestRolloutProgressDeadlineExceeded(t *testing.T) {
+	f := newRolloutFixture(t)
+
+	dep := newTestDeployment(1)
+	f.createDeployment(dep)
+	f.waitFor("deployment to be tracked", func() bool {
+		_, ok := WorkloadCtxSet.Get(dep.UID)
+		return ok
+	})
+
+	dep.Annotations[RevisionAnnotation] = "2"
+	f.updateDeployment(dep)
+	f.waitFor("rollout to start", func() bool { return f.hasRollout(dep.UID) })
+
+	newRS := newTestReplicaSet(dep, "2", 1)
+	newRS.Status = appsv1.ReplicaSetStatus{}
+	f.createReplicaSet(newRS)
+	f.waitFor("scale-up step", func() bool {
+		f.tracker.lock.Lock()
+		defer f.tracker.lock.Unlock()
+		_, ok := f.tracker.rollouts[dep.UID].steps[newRS.UID]
+		return ok
+	})
+
+	dep.Status.Conditions = []appsv1.DeploymentCondition{
+		{Type: appsv1.DeploymentProgressing, Status: v1.ConditionFalse, Reason: timedOutReason, Message: "progress deadline exceeded"},
+	}
+	f.updateDeployment(dep)
+	f.waitForSpan("rollout web revision 2", codes.Error)
+	f.waitForSpan("scale-up new replicaset web-2 0 -> 1", codes.Error)
+}
+
+// TestRolloutPausedSkipsDeadline 与deployment controller一致，暂停的Deployment不判断progressDeadlineSeconds，
+// 恢复后重新计时
+func TestRolloutPausedSkipsDeadline(t *testing.T) {
+	f := newRolloutFixture(t)
+	now := time.Now()
+	f.tracker.now = func() time.Time { return now }
+
+	dep := newTestDeployment(1)
+	dep.Spec.ProgressDeadlineSeconds = int32Ptr(60)
+	f.createDeployment(dep)
+	f.waitFor("deployment to be tracked", func() bool {
+		_, ok := WorkloadCtxSet.Get(dep.UID)
+		return ok
+	})
+
+	dep.Annotations[RevisionAnnotation] = "2"
+	dep.Spec.Paused = true
+	f.updateDeployment(dep)
+	f.waitFor("rollout to start", func() bool { return f.hasRollout(dep.UID) })
+
+	now = now.Add(time.Hour)
+	f.tracker.checkDeadlines()
+	if !f.hasRollout(dep.UID) {
+		t.Fatal("paused rollout should not exceed its progress deadline")
+	}
+
+	// 恢复后从恢复时间开始计时
+	dep.Spec.Paused = false
+	f.updateDeployment(dep)
+	f.waitFor("rollout to resume", func() bool {
+		f.tracker.lock.Lock()
+		defer f.tracker.lock.Unlock()
+		return !f.tracker.rollouts[dep.UID].Paused
+	})
+	f.tracker.checkDeadlines()
+	if !f.hasRollout(dep.UID) {
+		t.Fatal("resumed rollout should restart its progress deadline")
+	}
+
+	now = now.Add(2 * time.Minute)
+	f.tracker.checkDeadlines()
+	f.waitForSpan("rollout web revision 2", codes.Error)
+}
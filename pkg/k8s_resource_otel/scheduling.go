@@ -0,0 +1,316 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// FailedSchedulingReason PreemptedReason 调度器产生的event reason
+	FailedSchedulingReason = "FailedScheduling"
+	PreemptedReason        = "Preempted"
+
+	// 调度失败原因的分类，记录为event的categories属性
+	SchedulingReasonInsufficientResources = "InsufficientResources"
+	SchedulingReasonTaint                 = "Taint"
+	SchedulingReasonAffinity              = "Affinity"
+	SchedulingReasonVolume                = "Volume"
+	SchedulingReasonPorts                 = "Ports"
+	SchedulingReasonUnschedulable         = "Unschedulable"
+	SchedulingReasonOther                 = "Other"
+)
+
+// GlobalSchedulingTracker 全局调度追踪器，由pod handler与event recorder共同驱动
+var GlobalSchedulingTracker *SchedulingTracker
+
+var (
+	// availableNodesRegexp FailedScheduling的message，ex:
+	// 0/5 nodes are available: 1 Insufficient cpu, 4 node(s) didn't match Pod's node affinity/selector. preemption: ...
+	availableNodesRegexp = regexp.MustCompile(`^(\d+/\d+) nodes are available: (.*?)\.?(?: preemption: .*)?$`)
+	// failedReasonRegexp 每个原因以节点数开头
+	failedReasonRegexp = regexp.MustCompile(`^(\d+) (.+)$`)
+	// preemptorRegexp Preempted event中抢占者的UID，related为空时使用，ex: Preempted by pod 6e2f... on node node1
+	preemptorRegexp = regexp.MustCompile(`^Preempted by pod ([0-9a-f-]+) on node (\S+)`)
+)
+
+// schedulingSpan 一个还未调度完成的pod的调度span
+type schedulingSpan struct {
+	ctx  context.Context
+	span oteltrace.Span
+	// nominatedNode 抢占成功后调度器提名的节点
+	nominatedNode string
+	// failures FailedScheduling的次数
+	failures int32
+}
+
+// SchedulingTracker 在pod生命周期span下记录调度span，从pod创建开始，到PodScheduled变为True结束，
+// FailedScheduling event解析出原因后记录为span event，抢占的受害pod通过link关联
+type SchedulingTracker struct {
+	provider *trace.TracerProvider
+	lock     sync.Mutex
+	// spans 进行中的调度span，key为pod UID
+	spans map[types.UID]*schedulingSpan
+}
+
+func NewSchedulingTracker(provider *trace.TracerProvider) *SchedulingTracker {
+	return &SchedulingTracker{
+		provider: provider,
+		spans:    map[types.UID]*schedulingSpan{},
+	}
+}
+
+// OnPodUpdate 还没有调度的pod开启调度span，已开启时记录提名节点的变化
+func (s *SchedulingTracker) OnPodUpdate(podCtx context.Context, pod *v1.Pod) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ss, ok := s.spans[pod.UID]
+	if !ok {
+		if cond := podCondition(pod, v1.PodScheduled); (cond != nil && cond.Status == v1.ConditionTrue) || pod.Spec.NodeName != "" {
+			return
+		}
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			return
+		}
+		ctx, span := s.provider.Tracer("pods").Start(podCtx, fmt.Sprintf("%s(scheduling)", pod.Name), oteltrace.WithTimestamp(pod.CreationTimestamp.Time))
+		span.SetAttributes(
+			attribute.KeyValue{
+				Key:   "phase",
+				Value: attribute.StringValue("scheduling"),
+			},
+			attribute.KeyValue{
+				Key:   "schedulerName",
+				Value: attribute.StringValue(pod.Spec.SchedulerName),
+			},
+			attribute.KeyValue{
+				Key:   "priorityClassName",
+				Value: attribute.StringValue(pod.Spec.PriorityClassName),
+			},
+		)
+		ss = &schedulingSpan{ctx: ctx, span: span}
+		s.spans[pod.UID] = ss
+	}
+
+	if nominated := pod.Status.NominatedNodeName; nominated != ss.nominatedNode {
+		ss.nominatedNode = nominated
+		ss.span.SetAttributes(attribute.KeyValue{
+			Key:   "nominatedNode",
+			Value: attribute.StringValue(nominated),
+		})
+		ss.span.AddEvent("nominated", oteltrace.WithAttributes(attribute.KeyValue{
+			Key:   "node",
+			Value: attribute.StringValue(nominated),
+		}))
+	}
+}
+
+// OnScheduled PodScheduled变为True时结束调度span并记录调度耗时，
+// 没有进行中的调度span(ex: 初始列表中已调度的pod)时返回false，由调用方补记阶段span
+func (s *SchedulingTracker) OnScheduled(pod *v1.Pod, start, end time.Time) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ss, ok := s.spans[pod.UID]
+	if !ok {
+		return false
+	}
+	delete(s.spans, pod.UID)
+	// 只记录观察到调度过程的pod
+	InformerMetrics.SchedulingLatencyHistogramVec.WithLabelValues(pod.Namespace, pod.Spec.PriorityClassName).Observe(end.Sub(start).Seconds())
+	ss.span.SetAttributes(
+		attribute.KeyValue{
+			Key:   "node",
+			Value: attribute.StringValue(pod.Spec.NodeName),
+		},
+		attribute.KeyValue{
+			Key:   "failedSchedulingCount",
+			Value: attribute.IntValue(int(ss.failures)),
+		},
+	)
+	ss.span.End(oteltrace.WithTimestamp(end))
+	return true
+}
+
+// OnPodDelete pod在调度完成前被删除
+func (s *SchedulingTracker) OnPodDelete(uid types.UID) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ss, ok := s.spans[uid]
+	if !ok {
+		return
+	}
+	delete(s.spans, uid)
+	ss.span.SetStatus(codes.Error, "pod deleted before it was scheduled")
+	ss.span.End()
+}
+
+// RecordEvent 记录与调度相关的event，返回false时由调用方按普通event记录：
+// 1. FailedScheduling 解析原因后记录为调度span上的event
+// 2. Preempted 在抢占者的调度span下记录一个span，link到受害pod的trace
+func (s *SchedulingTracker) RecordEvent(e *k8sEvent) bool {
+	if s == nil {
+		return false
+	}
+	switch e.Reason {
+	case FailedSchedulingReason:
+		return s.recordFailedScheduling(e)
+	case PreemptedReason:
+		s.recordPreemption(e)
+	}
+	return false
+}
+
+func (s *SchedulingTracker) recordFailedScheduling(e *k8sEvent) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ss, ok := s.spans[e.Regarding.UID]
+	if !ok {
+		return false
+	}
+	ss.failures++
+	available, reasons, categories := ParseFailedScheduling(e.Message)
+	ss.span.AddEvent(FailedSchedulingReason, oteltrace.WithTimestamp(e.LastTime), oteltrace.WithAttributes(
+		attribute.KeyValue{
+			Key:   "message",
+			Value: attribute.StringValue(e.Message),
+		},
+		attribute.KeyValue{
+			Key:   "nodesAvailable",
+			Value: attribute.StringValue(available),
+		},
+		attribute.KeyValue{
+			Key:   "reasons",
+			Value: attribute.StringSliceValue(reasons),
+		},
+		attribute.KeyValue{
+			Key:   "categories",
+			Value: attribute.StringSliceValue(categories),
+		},
+		attribute.KeyValue{
+			Key:   "count",
+			Value: attribute.IntValue(int(e.Count)),
+		},
+	))
+	return true
+}
+
+// recordPreemption e为受害pod上的Preempted event，related(或message)中为抢占者
+func (s *SchedulingTracker) recordPreemption(e *k8sEvent) {
+	preemptor, node := types.UID(""), ""
+	if e.Related != nil {
+		preemptor = e.Related.UID
+	}
+	if m := preemptorRegexp.FindStringSubmatch(e.Message); m != nil {
+		if preemptor == "" {
+			preemptor = types.UID(m[1])
+		}
+		node = m[2]
+	}
+	victim, ok := PodCtxSet.Peek(e.Regarding.UID)
+	if !ok || preemptor == "" {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ss, ok := s.spans[preemptor]
+	if !ok {
+		return
+	}
+	_, span := s.provider.Tracer("pods").Start(ss.ctx, fmt.Sprintf("preempt %s/%s", e.Regarding.Namespace, e.Regarding.Name),
+		oteltrace.WithTimestamp(e.LastTime),
+		oteltrace.WithLinks(oteltrace.Link{
+			SpanContext: oteltrace.SpanContextFromContext(victim.Ctx),
+			Attributes: []attribute.KeyValue{
+				{
+					Key:   "victim",
+					Value: attribute.StringValue(victim.Key),
+				},
+			},
+		}),
+	)
+	defer span.End(oteltrace.WithTimestamp(e.LastTime))
+	span.SetAttributes(
+		attribute.KeyValue{
+			Key:   "victim",
+			Value: attribute.StringValue(victim.Key),
+		},
+		attribute.KeyValue{
+			Key:   "victimUID",
+			Value: attribute.StringValue(string(e.Regarding.UID)),
+		},
+		attribute.KeyValue{
+			Key:   "node",
+			Value: attribute.StringValue(node),
+		},
+	)
+}
+
+// ParseFailedScheduling 解析FailedScheduling的message，返回可用节点数(ex: 0/5)、
+// 每个原因(ex: 1 Insufficient cpu)与原因的分类，无法解析时原因为整个message
+func ParseFailedScheduling(message string) (string, []string, []string) {
+	m := availableNodesRegexp.FindStringSubmatch(strings.TrimSpace(message))
+	if m == nil {
+		return "", []string{message}, []string{schedulingReasonCategory(message)}
+	}
+	var reasons, categories []string
+	seen := map[string]bool{}
+	for _, item := range strings.Split(m[2], ", ") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		reasons = append(reasons, item)
+		reason := item
+		if r := failedReasonRegexp.FindStringSubmatch(item); r != nil {
+			if _, err := strconv.Atoi(r[1]); err == nil {
+				reason = r[2]
+			}
+		}
+		if category := schedulingReasonCategory(reason); !seen[category] {
+			seen[category] = true
+			categories = append(categories, category)
+		}
+	}
+	return m[1], reasons, categories
+}
+
+// schedulingReasonCategory 调度插件返回的原因的分类，
+// 卷的原因可能包含affinity(ex: volume node affinity conflict)，需要先于affinity判断
+func schedulingReasonCategory(reason string) string {
+	r := strings.ToLower(reason)
+	switch {
+	case strings.Contains(r, "insufficient") || strings.Contains(r, "too many pods"):
+		return SchedulingReasonInsufficientResources
+	case strings.Contains(r, "taint"):
+		return SchedulingReasonTaint
+	case strings.Contains(r, "volume") || strings.Contains(r, "persistentvolumeclaim"):
+		return SchedulingReasonVolume
+	case strings.Contains(r, "affinity") || strings.Contains(r, "selector") || strings.Contains(r, "topology spread"):
+		return SchedulingReasonAffinity
+	case strings.Contains(r, "ports"):
+		return SchedulingReasonPorts
+	case strings.Contains(r, "unschedulable"):
+		return SchedulingReasonUnschedulable
+	}
+	return SchedulingReasonOther
+}
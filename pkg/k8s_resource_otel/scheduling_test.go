@@ -0,0 +1,105 @@
+package k8s_resource_otel
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseFailedScheduling(t *testing.T) {
+	tests := []struct {
+		message    string
+		available  string
+		reasons    []string
+		categories []string
+	}{
+		{
+			message:    "0/5 nodes are available: 1 Insufficient cpu, 4 node(s) didn't match Pod's node affinity/selector. preemption: 0/5 nodes are available: 1 No preemption victims found for incoming pod, 4 Preemption is not helpful for scheduling..",
+			available:  "0/5",
+			reasons:    []string{"1 Insufficient cpu", "4 node(s) didn't match Pod's node affinity/selector"},
+			categories: []string{SchedulingReasonInsufficientResources, SchedulingReasonAffinity},
+		},
+		{
+			message:    "0/3 nodes are available: 1 Insufficient memory, 2 Insufficient cpu.",
+			available:  "0/3",
+			reasons:    []string{"1 Insufficient memory", "2 Insufficient cpu"},
+			categories: []string{SchedulingReasonInsufficientResources},
+		},
+		{
+			message:    "0/3 nodes are available: 3 node(s) had untolerated taint {node-role.kubernetes.io/control-plane: }. preemption: 0/3 nodes are available: 3 Preemption is not helpful for scheduling..",
+			available:  "0/3",
+			reasons:    []string{"3 node(s) had untolerated taint {node-role.kubernetes.io/control-plane: }"},
+			categories: []string{SchedulingReasonTaint},
+		},
+		{
+			message:    "0/1 nodes are available: 1 pod has unbound immediate PersistentVolumeClaims. preemption: 0/1 nodes are available: 1 Preemption is not helpful for scheduling..",
+			available:  "0/1",
+			reasons:    []string{"1 pod has unbound immediate PersistentVolumeClaims"},
+			categories: []string{SchedulingReasonVolume},
+		},
+		{
+			message:    "0/2 nodes are available: 1 node(s) had volume node affinity conflict, 1 node(s) were unschedulable.",
+			available:  "0/2",
+			reasons:    []string{"1 node(s) had volume node affinity conflict", "1 node(s) were unschedulable"},
+			categories: []string{SchedulingReasonVolume, SchedulingReasonUnschedulable},
+		},
+		{
+			message:    "0/4 nodes are available: 1 Too many pods, 1 node(s) didn't have free ports for the requested pod ports, 2 node(s) didn't match pod topology spread constraints.",
+			available:  "0/4",
+			reasons:    []string{"1 Too many pods", "1 node(s) didn't have free ports for the requested pod ports", "2 node(s) didn't match pod topology spread constraints"},
+			categories: []string{SchedulingReasonInsufficientResources, SchedulingReasonPorts, SchedulingReasonAffinity},
+		},
+		{
+			message:    "running PreBind plugin \"VolumeBinding\": binding volumes: timed out waiting for the condition",
+			reasons:    []string{"running PreBind plugin \"VolumeBinding\": binding volumes: timed out waiting for the condition"},
+			categories: []string{SchedulingReasonVolume},
+		},
+		{
+			message:    "skip schedule deleting pod: default/foo",
+			reasons:    []string{"skip schedule deleting pod: default/foo"},
+			categories: []string{SchedulingReasonOther},
+		},
+	}
+	for _, tt := range tests {
+		available, reasons, categories := ParseFailedScheduling(tt.message)
+		if available != tt.available || !reflect.DeepEqual(reasons, tt.reasons) || !reflect.DeepEqual(categories, tt.categories) {
+			t.Errorf("ParseFailedScheduling(%q) = %q %q %q, expected %q %q %q",
+				tt.message, available, reasons, categories, tt.available, tt.reasons, tt.categories)
+		}
+	}
+}
+
+func TestSchedulingReasonCategory(t *testing.T) {
+	tests := map[string]string{
+		"Insufficient nvidia.com/gpu": SchedulingReasonInsufficientResources,
+		"Too many pods":               SchedulingReasonInsufficientResources,
+		"node(s) had taint {node-role.kubernetes.io/master: }, that the pod didn't tolerate": SchedulingReasonTaint,
+		"node(s) didn't match pod affinity rules":                                            SchedulingReasonAffinity,
+		"node(s) didn't match pod anti-affinity rules":                                       SchedulingReasonAffinity,
+		"node(s) didn't match Pod's node affinity/selector":                                  SchedulingReasonAffinity,
+		"node(s) didn't match pod topology spread constraints (missing required label)":      SchedulingReasonAffinity,
+		"node(s) had volume node affinity conflict":                                          SchedulingReasonVolume,
+		"node(s) didn't find available persistent volumes to bind":                           SchedulingReasonVolume,
+		"node(s) exceed max volume count":                                                    SchedulingReasonVolume,
+		"persistentvolumeclaim \"data\" not found":                                           SchedulingReasonVolume,
+		"node(s) didn't have free ports for the requested pod ports":                         SchedulingReasonPorts,
+		"node(s) were unschedulable":                                                         SchedulingReasonUnschedulable,
+		"node(s) had untolerated taint {node.kubernetes.io/unschedulable: }":                 SchedulingReasonTaint,
+		"node(s) didn't satisfy plugin(s) [CustomFilter]":                                    SchedulingReasonOther,
+	}
+	for reason, expected := range tests {
+		if category := schedulingReasonCategory(reason); category != expected {
+			t.Errorf("schedulingReasonCategory(%q) = %s, expected %s", reason, category, expected)
+		}
+	}
+}
+
+// TestSchedulingTrackerNil 没有监听调度时tracker为nil，pod handler的调用不能panic
+func TestSchedulingTrackerNil(t *testing.T) {
+	var s *SchedulingTracker
+	s.OnPodUpdate(nil, nil)
+	s.OnPodDelete("uid")
+	if s.OnScheduled(nil, time.Time{}, time.Time{}) || s.RecordEvent(&k8sEvent{}) {
+		t.Error("nil tracker should not handle pods or events")
+	}
+}
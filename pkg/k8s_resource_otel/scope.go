@@ -0,0 +1,105 @@
+package k8s_resource_otel
+
+import (
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/common"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+// informerScope 一个namespace的informer工厂，
+// 多个namespace时每个namespace一个scope，共享同一个TracerProvider与缓存
+type informerScope struct {
+	namespace string
+	// workloadFact 工作负载使用的工厂，只使用label selector
+	workloadFact informers.SharedInformerFactory
+	// podFact pod使用的工厂，使用label selector与field selector
+	podFact informers.SharedInformerFactory
+	// eventFact event PVC RBAC对象与EndpointSlice使用的工厂，没有业务label，只按namespace过滤
+	eventFact informers.SharedInformerFactory
+	// dynamicFact 规则中配置的任意资源使用的工厂，只使用label selector
+	dynamicFact dynamicinformer.DynamicSharedInformerFactory
+}
+
+// newInformerScopes 根据配置创建scope：
+// 1. 没有指定namespace时，使用一个监听所有namespace的scope，通过field selector排除ExcludeNamespaces
+// 2. 指定namespace时，每个namespace一个scope，并去掉ExcludeNamespaces中的namespace
+func newInformerScopes(client kubernetes.Interface, dynamicClient dynamic.Interface, c *common.InformerConfig) ([]*informerScope, error) {
+	if _, err := labels.Parse(c.LabelSelector); err != nil {
+		return nil, fmt.Errorf("invalid label selector %q: %w", c.LabelSelector, err)
+	}
+	if _, err := fields.ParseSelector(c.FieldSelector); err != nil {
+		return nil, fmt.Errorf("invalid field selector %q: %w", c.FieldSelector, err)
+	}
+	excluded := sets.New[string](c.ExcludeNamespaces...)
+
+	if len(c.Namespaces) == 0 || sets.New[string](c.Namespaces...).Has(metav1.NamespaceAll) {
+		return []*informerScope{newInformerScope(client, dynamicClient, metav1.NamespaceAll, excluded.UnsortedList(), c)}, nil
+	}
+
+	scopes := make([]*informerScope, 0, len(c.Namespaces))
+	for _, ns := range sets.List(sets.New[string](c.Namespaces...)) {
+		if excluded.Has(ns) {
+			continue
+		}
+		scopes = append(scopes, newInformerScope(client, dynamicClient, ns, nil, c))
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("all namespaces %v are excluded", c.Namespaces)
+	}
+	return scopes, nil
+}
+
+func newInformerScope(client kubernetes.Interface, dynamicClient dynamic.Interface, namespace string, excluded []string, c *common.InformerConfig) *informerScope {
+	// 排除的namespace使用 metadata.namespace!=xxx 过滤，所有资源都支持该字段
+	excludeSelectors := make([]fields.Selector, 0, len(excluded))
+	for _, ns := range excluded {
+		excludeSelectors = append(excludeSelectors, fields.OneTermNotEqualSelector("metadata.namespace", ns))
+	}
+
+	tweak := func(labelSelector, fieldSelector string) func(options *metav1.ListOptions) {
+		selectors := excludeSelectors
+		if fieldSelector != "" {
+			selectors = append(append([]fields.Selector{}, excludeSelectors...), fields.ParseSelectorOrDie(fieldSelector))
+		}
+		return func(options *metav1.ListOptions) {
+			options.LabelSelector = labelSelector
+			if len(selectors) != 0 {
+				options.FieldSelector = fields.AndSelectors(selectors...).String()
+			}
+		}
+	}
+	newFactory := func(labelSelector, fieldSelector string) informers.SharedInformerFactory {
+		return informers.NewSharedInformerFactoryWithOptions(client, 0,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(tweak(labelSelector, fieldSelector)),
+		)
+	}
+
+	scope := &informerScope{
+		namespace:    namespace,
+		workloadFact: newFactory(c.LabelSelector, ""),
+		podFact:      newFactory(c.LabelSelector, c.FieldSelector),
+		eventFact:    newFactory("", ""),
+	}
+	if dynamicClient != nil {
+		scope.dynamicFact = dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, 0, namespace, tweak(c.LabelSelector, ""))
+	}
+	return scope
+}
+
+// start 启动scope内所有已注册的informer
+func (s *informerScope) start(stopCh <-chan struct{}) {
+	s.workloadFact.Start(stopCh)
+	s.podFact.Start(stopCh)
+	s.eventFact.Start(stopCh)
+	if s.dynamicFact != nil {
+		s.dynamicFact.Start(stopCh)
+	}
+}
@@ -0,0 +1,312 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/kvstore"
+	"go.opentelemetry.io/otel/propagation"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/workqueue"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TraceparentAnnotation 记录pod生命周期span的traceparent
+	TraceparentAnnotation = "opentelemetry-practice.io/traceparent"
+	// RootTraceparentAnnotation 记录pod根span的traceparent
+	RootTraceparentAnnotation = "opentelemetry-practice.io/root-traceparent"
+
+	// SpanStoreMemory SpanStoreFile SpanStoreAnnotation 支持的存储方式
+	SpanStoreMemory     = "memory"
+	SpanStoreFile       = "file"
+	SpanStoreAnnotation = "annotation"
+
+	spanStoreFlushInterval = 5 * time.Second
+	// annotationPatchRetries patch annotation失败时的最大重试次数
+	annotationPatchRetries = 5
+)
+
+// GlobalSpanStore 全局的SpanInfo存储，默认只保存在内存中(不持久化)
+var GlobalSpanStore SpanStore = nopSpanStore{}
+
+// SpanRecord SpanInfo的可序列化形式，只保存trace/span id与carrier，不保存context
+type SpanRecord struct {
+	// RootTraceparent 根span的traceparent
+	RootTraceparent string `json:"rootTraceparent"`
+	// Carrier 生命周期span注入的carrier，包含traceparent
+	Carrier map[string]string `json:"carrier"`
+	// UpdatedAt 写入时间
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// SpanStore SpanInfo的存储接口，informer重启后可以从存储中恢复pod的trace，
+// 实现有：不持久化(nopSpanStore)、本地文件(FileSpanStore)、pod annotation(AnnotationSpanStore)
+type SpanStore interface {
+	// Load 读取对象对应的记录
+	Load(obj metav1.Object) (*SpanRecord, bool, error)
+	// Save 保存对象对应的记录
+	Save(obj metav1.Object, r *SpanRecord) error
+	// Delete 删除对象对应的记录
+	Delete(obj metav1.Object) error
+}
+
+// NewSpanRecord 把SpanInfo转为可序列化的记录
+func NewSpanRecord(info *SpanInfo) *SpanRecord {
+	root := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(info.RootCtx, root)
+
+	carrier := map[string]string{}
+	for _, k := range info.Carrier.Keys() {
+		carrier[k] = info.Carrier.Get(k)
+	}
+	return &SpanRecord{
+		RootTraceparent: root.Get("traceparent"),
+		Carrier:         carrier,
+		UpdatedAt:       time.Now(),
+	}
+}
+
+// SpanInfo 从记录恢复SpanInfo，恢复的span属于上一个进程，
+// 在当前进程中是remote且不可记录的，且上一个进程退出时没有结束，不会被导出，
+// 只能作为link指向上一个trace，不能作为父span
+func (r *SpanRecord) SpanInfo() (*SpanInfo, error) {
+	carrier := propagation.MapCarrier(r.Carrier)
+	ctx := propagation.TraceContext{}.Extract(context.Background(), carrier)
+	if !oteltrace.SpanContextFromContext(ctx).IsValid() {
+		return nil, fmt.Errorf("invalid traceparent in carrier: %v", r.Carrier)
+	}
+	rootCtx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{"traceparent": r.RootTraceparent})
+	if !oteltrace.SpanContextFromContext(rootCtx).IsValid() {
+		// 没有根span时使用生命周期span代替
+		rootCtx = ctx
+	}
+	return &SpanInfo{
+		RootCtx: rootCtx,
+		Ctx:     ctx,
+		Carrier: carrier,
+	}, nil
+}
+
+// nopSpanStore 不持久化
+type nopSpanStore struct{}
+
+func (nopSpanStore) Load(metav1.Object) (*SpanRecord, bool, error) { return nil, false, nil }
+func (nopSpanStore) Save(metav1.Object, *SpanRecord) error         { return nil }
+func (nopSpanStore) Delete(metav1.Object) error                    { return nil }
+
+// FileSpanStore 使用本地文件(嵌入式kv)持久化记录，key为对象UID
+type FileSpanStore struct {
+	kv *kvstore.Store
+}
+
+func NewFileSpanStore(path string, flushInterval time.Duration) (*FileSpanStore, error) {
+	kv, err := kvstore.Open(path, flushInterval)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSpanStore{kv: kv}, nil
+}
+
+func (f *FileSpanStore) Load(obj metav1.Object) (*SpanRecord, bool, error) {
+	r := &SpanRecord{}
+	ok, err := f.kv.Get(string(obj.GetUID()), r)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return r, true, nil
+}
+
+func (f *FileSpanStore) Save(obj metav1.Object, r *SpanRecord) error {
+	return f.kv.Put(string(obj.GetUID()), r)
+}
+
+func (f *FileSpanStore) Delete(obj metav1.Object) error {
+	return f.kv.Delete(string(obj.GetUID()))
+}
+
+// Prune 删除updatedBefore之前写入且对象已经不存在的记录，返回删除的数量，
+// 进程停止期间删除的对象不会收到删除事件，其记录需要在初始列表同步后清理
+func (f *FileSpanStore) Prune(live sets.Set[types.UID], updatedBefore time.Time) int {
+	pruned := 0
+	for _, key := range f.kv.Keys() {
+		if live.Has(types.UID(key)) {
+			continue
+		}
+		// 无法解码的记录同样删除
+		r := &SpanRecord{}
+		if ok, err := f.kv.Get(key, r); err == nil && (!ok || !r.UpdatedAt.Before(updatedBefore)) {
+			continue
+		}
+		if err := f.kv.Delete(key); err != nil {
+			log.Println("prune span record err:", key, err)
+			continue
+		}
+		pruned++
+	}
+	return pruned
+}
+
+// Close 落盘并关闭存储
+func (f *FileSpanStore) Close() error {
+	return f.kv.Close()
+}
+
+// AnnotationSpanStore 把traceparent保存为pod的annotation，
+// 记录随pod一起存在，不需要额外的存储，但需要patch pod的权限。
+// patch由后台goroutine异步执行，不阻塞informer的回调
+type AnnotationSpanStore struct {
+	client kubernetes.Interface
+	queue  workqueue.RateLimitingInterface
+	lock   sync.Mutex
+	// pending 等待patch的记录，key为pod的namespace/name，同一个pod只patch最新的记录
+	pending map[string]*SpanRecord
+	doneCh  chan struct{}
+}
+
+func NewAnnotationSpanStore(client kubernetes.Interface) *AnnotationSpanStore {
+	a := &AnnotationSpanStore{
+		client:  client,
+		queue:   workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "span-store-annotation"),
+		pending: map[string]*SpanRecord{},
+		doneCh:  make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+func (a *AnnotationSpanStore) Load(obj metav1.Object) (*SpanRecord, bool, error) {
+	traceparent, ok := obj.GetAnnotations()[TraceparentAnnotation]
+	if !ok {
+		return nil, false, nil
+	}
+	return &SpanRecord{
+		RootTraceparent: obj.GetAnnotations()[RootTraceparentAnnotation],
+		Carrier:         map[string]string{"traceparent": traceparent},
+	}, true, nil
+}
+
+// Save 记录放入队列，由后台goroutine patch
+func (a *AnnotationSpanStore) Save(obj metav1.Object, r *SpanRecord) error {
+	key := obj.GetNamespace() + "/" + obj.GetName()
+	a.lock.Lock()
+	a.pending[key] = r
+	a.lock.Unlock()
+	a.queue.Add(key)
+	return nil
+}
+
+// Close 停止后台goroutine，队列中未patch的记录会被丢弃
+func (a *AnnotationSpanStore) Close() error {
+	a.queue.ShutDown()
+	<-a.doneCh
+	return nil
+}
+
+func (a *AnnotationSpanStore) run() {
+	defer close(a.doneCh)
+	for a.processNext() {
+	}
+}
+
+func (a *AnnotationSpanStore) processNext() bool {
+	item, shutdown := a.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer a.queue.Done(item)
+	key := item.(string)
+
+	a.lock.Lock()
+	r, ok := a.pending[key]
+	delete(a.pending, key)
+	a.lock.Unlock()
+	if !ok {
+		a.queue.Forget(item)
+		return true
+	}
+
+	err := a.patch(key, r)
+	switch {
+	case err == nil, apierrors.IsNotFound(err):
+		a.queue.Forget(item)
+	case a.queue.NumRequeues(item) < annotationPatchRetries:
+		log.Println("patch span record err, retry:", key, err)
+		// 重试期间没有更新的记录时，重新放回
+		a.lock.Lock()
+		if _, ok := a.pending[key]; !ok {
+			a.pending[key] = r
+		}
+		a.lock.Unlock()
+		a.queue.AddRateLimited(item)
+	default:
+		log.Println("patch span record err, give up:", key, err)
+		a.queue.Forget(item)
+	}
+	return true
+}
+
+func (a *AnnotationSpanStore) patch(key string, r *SpanRecord) error {
+	namespace, name, _ := strings.Cut(key, "/")
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				TraceparentAnnotation:     r.Carrier["traceparent"],
+				RootTraceparentAnnotation: r.RootTraceparent,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = a.client.CoreV1().Pods(namespace).
+		Patch(context.Background(), name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// Delete pod删除后annotation也随之删除
+func (a *AnnotationSpanStore) Delete(metav1.Object) error {
+	return nil
+}
+
+// isTraceAnnotationOnlyUpdate 判断pod更新是否只是写入了trace annotation，
+// AnnotationSpanStore的patch会触发一次update，不需要记录
+func isTraceAnnotationOnlyUpdate(oldPod, newPod *v1.Pod) bool {
+	oldAnno, newAnno := oldPod.GetAnnotations(), newPod.GetAnnotations()
+	if oldAnno[TraceparentAnnotation] == newAnno[TraceparentAnnotation] &&
+		oldAnno[RootTraceparentAnnotation] == newAnno[RootTraceparentAnnotation] {
+		return false
+	}
+	return annotationsEqualExcept(oldAnno, newAnno, TraceparentAnnotation, RootTraceparentAnnotation) &&
+		equality.Semantic.DeepEqual(oldPod.Labels, newPod.Labels) &&
+		equality.Semantic.DeepEqual(oldPod.Spec, newPod.Spec) &&
+		equality.Semantic.DeepEqual(oldPod.Status, newPod.Status)
+}
+
+func annotationsEqualExcept(a, b map[string]string, except ...string) bool {
+	skip := map[string]bool{}
+	for _, k := range except {
+		skip[k] = true
+	}
+	for k, v := range a {
+		if !skip[k] && b[k] != v {
+			return false
+		}
+	}
+	for k, v := range b {
+		if !skip[k] && a[k] != v {
+			return false
+		}
+	}
+	return true
+}
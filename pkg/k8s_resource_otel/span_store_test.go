@@ -0,0 +1,46 @@
+package k8s_resource_otel
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileSpanStorePrune(t *testing.T) {
+	store, err := NewFileSpanStore(filepath.Join(t.TempDir(), "spans.json"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	startedAt := time.Now()
+	records := map[types.UID]time.Time{
+		// 仍然存在的pod
+		"live": startedAt.Add(-time.Hour),
+		// 进程停止期间删除的pod
+		"deleted": startedAt.Add(-time.Hour),
+		// 进程启动后写入，informer列表中可能还没有
+		"new": startedAt.Add(time.Second),
+	}
+	for uid, updatedAt := range records {
+		if err := store.Save(&metav1.ObjectMeta{UID: uid}, &SpanRecord{UpdatedAt: updatedAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if pruned := store.Prune(sets.New[types.UID]("live"), startedAt); pruned != 1 {
+		t.Fatalf("expected 1 pruned record, got %d", pruned)
+	}
+	for uid := range records {
+		_, ok, err := store.Load(&metav1.ObjectMeta{UID: uid})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok == (uid == "deleted") {
+			t.Errorf("record %s: unexpected presence %t after prune", uid, ok)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Package tracingqueue 为client-go的限速队列加入trace：
+// Add时记录调用方的span context，Get时返回给worker，
+// 每次reconcile作为一个span，记录重试次数与重新入队的原因，reconcile出错时设置span状态。
+//
+// ex:
+//
+//	q := tracingqueue.New("foo", workqueue.DefaultControllerRateLimiter(), provider)
+//	q.Add(ctx, key)
+//	...
+//	ctx, key, shutdown := q.Get()
+//	if shutdown {
+//		return
+//	}
+//	defer q.Done(key)
+//	q.Reconcile(ctx, key, reconcile)
+package tracingqueue
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/util/workqueue"
+	"sync"
+	"time"
+)
+
+// 重新入队的原因
+const (
+	RequeueReasonError     = "error"
+	RequeueReasonRequested = "requested"
+	RequeueReasonAfter     = "requeue-after"
+)
+
+// Result reconcile的结果，与controller-runtime的reconcile.Result一致
+type Result struct {
+	// Requeue 是否限速后重新入队
+	Requeue bool
+	// RequeueAfter 大于0时在指定时间后重新入队
+	RequeueAfter time.Duration
+}
+
+// ReconcileFunc 处理队列中的一个item，ctx中带有reconcile span
+type ReconcileFunc func(ctx context.Context, item interface{}) (Result, error)
+
+// pendingItem 还没有被Get的item的trace信息，
+// workqueue会合并还在队列中的相同item，合并的每次Add都作为link记录
+type pendingItem struct {
+	parent  oteltrace.SpanContext
+	links   []oteltrace.Link
+	reason  string
+	addedAt time.Time
+}
+
+type pendingKey struct{}
+
+// Queue 带trace的限速队列
+type Queue struct {
+	name   string
+	queue  workqueue.RateLimitingInterface
+	tracer oteltrace.Tracer
+
+	// noRootSpans Add时ctx中没有span的item不记录reconcile span
+	noRootSpans bool
+
+	lock    sync.Mutex
+	pending map[interface{}]*pendingItem
+}
+
+// New 创建带名称(用于指标与span名称)的限速队列
+func New(name string, rateLimiter workqueue.RateLimiter, provider oteltrace.TracerProvider) *Queue {
+	return Wrap(name, workqueue.NewRateLimitingQueueWithConfig(rateLimiter, workqueue.RateLimitingQueueConfig{Name: name}), provider)
+}
+
+// Wrap 包装已有的限速队列，不能再直接向原队列Add，否则item没有trace信息
+func Wrap(name string, queue workqueue.RateLimitingInterface, provider oteltrace.TracerProvider) *Queue {
+	return &Queue{
+		name:    name,
+		queue:   queue,
+		tracer:  provider.Tracer("workqueue/" + name),
+		pending: map[interface{}]*pendingItem{},
+	}
+}
+
+// DisableRootSpans Add时ctx中没有span的item不再记录reconcile span，
+// 只在调用方的trace中记录，避免每个item产生一个独立的trace，需要在使用队列前调用
+func (q *Queue) DisableRootSpans() {
+	q.noRootSpans = true
+}
+
+// Add 放入item，记录ctx中的span
+func (q *Queue) Add(ctx context.Context, item interface{}) {
+	q.record(ctx, item, "")
+	q.queue.Add(item)
+}
+
+// AddRateLimited 限速后放入item，reason记录为下一次reconcile的重新入队原因
+func (q *Queue) AddRateLimited(ctx context.Context, item interface{}, reason string) {
+	q.record(ctx, item, reason)
+	q.queue.AddRateLimited(item)
+}
+
+// AddAfter 在duration后放入item
+func (q *Queue) AddAfter(ctx context.Context, item interface{}, duration time.Duration, reason string) {
+	q.record(ctx, item, reason)
+	q.queue.AddAfter(item, duration)
+}
+
+// Get 获取item，返回的ctx带有(第一个)调用Add时的span context
+func (q *Queue) Get() (context.Context, interface{}, bool) {
+	item, shutdown := q.queue.Get()
+	if shutdown {
+		return context.Background(), nil, true
+	}
+	q.lock.Lock()
+	p, ok := q.pending[item]
+	delete(q.pending, item)
+	q.lock.Unlock()
+
+	ctx := context.Background()
+	if ok {
+		ctx = oteltrace.ContextWithRemoteSpanContext(ctx, p.parent)
+		ctx = context.WithValue(ctx, pendingKey{}, p)
+	}
+	return ctx, item, false
+}
+
+func (q *Queue) Done(item interface{})            { q.queue.Done(item) }
+func (q *Queue) Forget(item interface{})          { q.queue.Forget(item) }
+func (q *Queue) NumRequeues(item interface{}) int { return q.queue.NumRequeues(item) }
+func (q *Queue) Len() int                         { return q.queue.Len() }
+func (q *Queue) ShutDown()                        { q.queue.ShutDown() }
+func (q *Queue) ShuttingDown() bool               { return q.queue.ShuttingDown() }
+
+// Reconcile 以span记录一次reconcile：重试次数、重新入队原因、排队时间，
+// 出错时设置span状态并限速重新入队，按Result重新入队，成功时Forget
+func (q *Queue) Reconcile(ctx context.Context, item interface{}, fn ReconcileFunc) error {
+	var opts []oteltrace.SpanStartOption
+	p, _ := ctx.Value(pendingKey{}).(*pendingItem)
+	if p != nil {
+		opts = append(opts, oteltrace.WithLinks(p.links...))
+	}
+	var span oteltrace.Span
+	if q.noRootSpans && !oteltrace.SpanContextFromContext(ctx).IsValid() {
+		// 不可记录的span，只用于统一下面的处理
+		span = oteltrace.SpanFromContext(ctx)
+	} else {
+		ctx, span = q.tracer.Start(ctx, fmt.Sprintf("%s-reconcile", q.name), opts...)
+		defer span.End()
+	}
+
+	retries := q.queue.NumRequeues(item)
+	span.SetAttributes(
+		attribute.KeyValue{
+			Key:   "queue",
+			Value: attribute.StringValue(q.name),
+		},
+		attribute.KeyValue{
+			Key:   "item",
+			Value: attribute.StringValue(fmt.Sprint(item)),
+		},
+		attribute.KeyValue{
+			Key:   "retries",
+			Value: attribute.IntValue(retries),
+		},
+	)
+	if p != nil {
+		span.SetAttributes(
+			attribute.KeyValue{
+				Key:   "requeueReason",
+				Value: attribute.StringValue(p.reason),
+			},
+			attribute.KeyValue{
+				Key:   "queueLatency",
+				Value: attribute.StringValue(time.Since(p.addedAt).String()),
+			},
+		)
+	}
+
+	result, err := fn(ctx, item)
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		q.AddRateLimited(ctx, item, RequeueReasonError+": "+err.Error())
+	case result.RequeueAfter > 0:
+		q.Forget(item)
+		q.AddAfter(ctx, item, result.RequeueAfter, RequeueReasonAfter)
+	case result.Requeue:
+		q.AddRateLimited(ctx, item, RequeueReasonRequested)
+	default:
+		q.Forget(item)
+	}
+	return err
+}
+
+// record 记录调用方的span，item已经在队列中时只追加link
+func (q *Queue) record(ctx context.Context, item interface{}, reason string) {
+	sc := oteltrace.SpanContextFromContext(ctx)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	p, ok := q.pending[item]
+	if !ok {
+		p = &pendingItem{parent: sc, addedAt: time.Now()}
+		q.pending[item] = p
+	}
+	if reason != "" {
+		p.reason = reason
+	}
+	if sc.IsValid() {
+		p.links = append(p.links, oteltrace.Link{SpanContext: sc})
+	}
+}
@@ -0,0 +1,214 @@
+package tracingqueue
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"k8s.io/client-go/util/workqueue"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T) (*Queue, *trace.TracerProvider, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := trace.NewTracerProvider(trace.WithSpanProcessor(recorder))
+	q := New("test", workqueue.NewItemExponentialFailureRateLimiter(time.Millisecond, 10*time.Millisecond), provider)
+	t.Cleanup(q.ShutDown)
+	return q, provider, recorder
+}
+
+// reconcileOnce 取出一个item并reconcile
+func reconcileOnce(t *testing.T, q *Queue, fn ReconcileFunc) (interface{}, error) {
+	t.Helper()
+	ctx, item, shutdown := q.Get()
+	if shutdown {
+		t.Fatal("queue shut down")
+	}
+	defer q.Done(item)
+	return item, q.Reconcile(ctx, item, fn)
+}
+
+func spanAttribute(span trace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func reconcileSpans(recorder *tracetest.SpanRecorder) []trace.ReadOnlySpan {
+	var spans []trace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "test-reconcile" {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+func TestReconcileLinksMergedAdds(t *testing.T) {
+	q, provider, recorder := newTestQueue(t)
+	tracer := provider.Tracer("test")
+	ctx1, span1 := tracer.Start(context.Background(), "add-1")
+	ctx2, span2 := tracer.Start(context.Background(), "add-2")
+	// 还在队列中的相同item会被合并
+	q.Add(ctx1, "foo")
+	q.Add(ctx2, "foo")
+	span1.End()
+	span2.End()
+	if q.Len() != 1 {
+		t.Fatalf("expected merged item, got len %d", q.Len())
+	}
+
+	var reconcileCtx context.Context
+	if _, err := reconcileOnce(t, q, func(ctx context.Context, item interface{}) (Result, error) {
+		reconcileCtx = ctx
+		return Result{}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := reconcileSpans(recorder)
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 reconcile span, got %d", len(spans))
+	}
+	span := spans[0]
+	if span.Parent().SpanID() != span1.SpanContext().SpanID() {
+		t.Errorf("reconcile span should be a child of the first add")
+	}
+	if oteltrace.SpanContextFromContext(reconcileCtx).SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("reconcile ctx should carry the reconcile span")
+	}
+	links := span.Links()
+	if len(links) != 2 || links[0].SpanContext.SpanID() != span1.SpanContext().SpanID() || links[1].SpanContext.SpanID() != span2.SpanContext().SpanID() {
+		t.Errorf("expected links to both adds, got %v", links)
+	}
+	if q.NumRequeues("foo") != 0 {
+		t.Errorf("expected item forgotten")
+	}
+}
+
+func TestReconcileErrorRetries(t *testing.T) {
+	q, _, recorder := newTestQueue(t)
+	q.Add(context.Background(), "foo")
+
+	errFailed := errors.New("failed")
+	for i := 0; i < 3; i++ {
+		_, err := reconcileOnce(t, q, func(ctx context.Context, item interface{}) (Result, error) {
+			if i < 2 {
+				return Result{}, errFailed
+			}
+			return Result{}, nil
+		})
+		if i < 2 && !errors.Is(err, errFailed) {
+			t.Fatalf("reconcile %d: expected error, got %v", i, err)
+		}
+	}
+
+	spans := reconcileSpans(recorder)
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 reconcile spans, got %d", len(spans))
+	}
+	for i, span := range spans {
+		if retries, _ := spanAttribute(span, "retries"); retries.AsInt64() != int64(i) {
+			t.Errorf("span %d: expected retries %d, got %d", i, i, retries.AsInt64())
+		}
+		wantStatus := codes.Error
+		if i == 2 {
+			wantStatus = codes.Unset
+		}
+		if span.Status().Code != wantStatus {
+			t.Errorf("span %d: expected status %v, got %v", i, wantStatus, span.Status().Code)
+		}
+		if i == 0 {
+			continue
+		}
+		// 重试的reconcile是上一次reconcile的子span
+		if span.Parent().SpanID() != spans[i-1].SpanContext().SpanID() {
+			t.Errorf("span %d: expected parent to be the previous reconcile", i)
+		}
+		if reason, _ := spanAttribute(span, "requeueReason"); reason.AsString() != RequeueReasonError+": failed" {
+			t.Errorf("span %d: unexpected requeue reason %q", i, reason.AsString())
+		}
+	}
+	if q.NumRequeues("foo") != 0 {
+		t.Errorf("expected retries to be reset after success, got %d", q.NumRequeues("foo"))
+	}
+}
+
+func TestReconcileRequeueResult(t *testing.T) {
+	q, _, recorder := newTestQueue(t)
+	q.Add(context.Background(), "foo")
+
+	results := []Result{{Requeue: true}, {RequeueAfter: time.Millisecond}, {}}
+	for _, result := range results {
+		result := result
+		if _, err := reconcileOnce(t, q, func(ctx context.Context, item interface{}) (Result, error) {
+			return result, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spans := reconcileSpans(recorder)
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 reconcile spans, got %d", len(spans))
+	}
+	expected := []struct {
+		retries int64
+		reason  string
+	}{
+		{0, ""},
+		// Requeue 限速重新入队，计入重试次数
+		{1, RequeueReasonRequested},
+		// RequeueAfter 重新入队前Forget，重试次数清零
+		{0, RequeueReasonAfter},
+	}
+	for i, e := range expected {
+		if retries, _ := spanAttribute(spans[i], "retries"); retries.AsInt64() != e.retries {
+			t.Errorf("span %d: expected retries %d, got %d", i, e.retries, retries.AsInt64())
+		}
+		if reason, _ := spanAttribute(spans[i], "requeueReason"); reason.AsString() != e.reason {
+			t.Errorf("span %d: expected requeue reason %q, got %q", i, e.reason, reason.AsString())
+		}
+	}
+}
+
+func TestDisableRootSpans(t *testing.T) {
+	q, provider, recorder := newTestQueue(t)
+	q.DisableRootSpans()
+	q.Add(context.Background(), "foo")
+
+	called := false
+	if _, err := reconcileOnce(t, q, func(ctx context.Context, item interface{}) (Result, error) {
+		called = true
+		return Result{}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Fatal("expected reconcile to be called")
+	}
+	if spans := reconcileSpans(recorder); len(spans) != 0 {
+		t.Fatalf("expected no root reconcile span, got %d", len(spans))
+	}
+
+	// 调用方有span时仍然记录
+	ctx, span := provider.Tracer("test").Start(context.Background(), "add")
+	q.Add(ctx, "bar")
+	span.End()
+	if _, err := reconcileOnce(t, q, func(ctx context.Context, item interface{}) (Result, error) {
+		return Result{}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	spans := reconcileSpans(recorder)
+	if len(spans) != 1 || spans[0].Parent().SpanID() != span.SpanContext().SpanID() {
+		t.Fatalf("expected reconcile span under the caller span, got %d spans", len(spans))
+	}
+}
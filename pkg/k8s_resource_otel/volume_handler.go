@@ -0,0 +1,459 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/k8shelper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// GlobalVolumeHandler 全局PVC/PV handler，pod handler与event recorder从中查找PVC的trace
+var GlobalVolumeHandler *VolumeHandler
+
+var _ cache.ResourceEventHandler = &VolumeHandler{}
+
+// volumeEventReasons kubelet与attach-detach controller产生的挂载相关的pod event，
+// 同时记录到卷所属PVC的trace中
+var volumeEventReasons = map[string]bool{
+	"SuccessfulAttachVolume": true,
+	"FailedAttachVolume":     true,
+	"SuccessfulMountVolume":  true,
+	"FailedMount":            true,
+	"FailedMapVolume":        true,
+}
+
+// volumeWaitingReason 等待挂载卷时pod的reason
+const volumeWaitingReason = "ContainerCreating"
+
+// volumeNameRegexp 挂载event message中的卷名，ex: AttachVolume.Attach succeeded for volume "pvc-0a1b..."
+var volumeNameRegexp = regexp.MustCompile(`volume "([^"]+)"`)
+
+// claimTrace 一个PVC的生命周期trace
+type claimTrace struct {
+	info *SpanInfo
+	uid  types.UID
+	// binding 从创建到Bound的span，包含供应(provisioning)的耗时
+	binding oteltrace.Span
+	// phase 最近一次记录的phase
+	phase v1.PersistentVolumeClaimPhase
+}
+
+// volumeTrace 一个PV在其PVC trace中的span
+type volumeTrace struct {
+	span oteltrace.Span
+	// claim 绑定的PVC，namespace/name
+	claim string
+	phase v1.PersistentVolumePhase
+	// volume 最近一次同步的PV，PV先于PVC同步时，开启span时使用其属性与phase
+	volume *v1.PersistentVolume
+}
+
+// VolumeHandler 追踪PVC的创建、供应与绑定，PV作为PVC trace中的span，
+// 挂载相关的pod event同时记录到PVC的trace，等待挂载卷的pod通过link指向PVC的trace
+type VolumeHandler struct {
+	provider *trace.TracerProvider
+	// classes 查找StorageClass的绑定模式与是否为默认class
+	classes storagelisters.StorageClassLister
+	lock    sync.RWMutex
+	// claims key为PVC的namespace/name，pod通过卷中的claimName关联PVC
+	claims map[string]*claimTrace
+	// volumes key为PV名
+	volumes map[string]*volumeTrace
+}
+
+func NewVolumeHandler(provider *trace.TracerProvider, classes storagelisters.StorageClassLister) *VolumeHandler {
+	return &VolumeHandler{
+		provider: provider,
+		classes:  classes,
+		claims:   map[string]*claimTrace{},
+		volumes:  map[string]*volumeTrace{},
+	}
+}
+
+func (h *VolumeHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	switch o := obj.(type) {
+	case *v1.PersistentVolumeClaim:
+		h.addClaim(o, isInInitialList)
+	case *v1.PersistentVolume:
+		h.updateVolume(nil, o)
+	}
+}
+
+func (h *VolumeHandler) OnUpdate(oldObj, newObj interface{}) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	switch o := newObj.(type) {
+	case *v1.PersistentVolumeClaim:
+		h.updateClaim(o)
+	case *v1.PersistentVolume:
+		old, _ := oldObj.(*v1.PersistentVolume)
+		h.updateVolume(old, o)
+	}
+}
+
+func (h *VolumeHandler) OnDelete(obj interface{}) {
+	obj, finalStateUnknown := unwrapTombstone(obj)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	switch o := obj.(type) {
+	case *v1.PersistentVolumeClaim:
+		h.deleteClaim(o, finalStateUnknown)
+	case *v1.PersistentVolume:
+		vt, ok := h.volumes[o.Name]
+		if !ok {
+			return
+		}
+		delete(h.volumes, o.Name)
+		if vt.span != nil {
+			vt.span.SetName(fmt.Sprintf("pv-%s(deleted)", o.Name))
+			vt.span.End()
+		}
+	}
+}
+
+func (h *VolumeHandler) addClaim(claim *v1.PersistentVolumeClaim, isInInitialList bool) {
+	key := claim.Namespace + "/" + claim.Name
+	parentCtx := context.Background()
+	if owner, ok := ownerSpanInfo(claim.OwnerReferences); ok {
+		parentCtx = owner.Ctx
+	}
+	// 接管leader时重放的PVC已经在追踪
+	if _, ok := h.claims[key]; ok {
+		return
+	}
+	info := startLifecycle(h.provider.Tracer("volumes"), parentCtx, claim,
+		fmt.Sprintf("pvc-%s/%s", claim.Name, claim.Namespace), "pvc-lifecycle", isInInitialList, h.claimAttributes(claim)...)
+	ct := &claimTrace{
+		info:  info,
+		uid:   claim.UID,
+		phase: claim.Status.Phase,
+	}
+	h.claims[key] = ct
+
+	// 还没有绑定的PVC从创建时间开始记录绑定span
+	if claim.Status.Phase == v1.ClaimPending {
+		_, ct.binding = h.provider.Tracer("volumes").Start(ct.info.Ctx, fmt.Sprintf("%s(binding)", claim.Name), oteltrace.WithTimestamp(claim.CreationTimestamp.Time))
+		ct.binding.SetAttributes(h.claimAttributes(claim)...)
+	}
+	// PV可能先于PVC同步
+	for _, vt := range h.volumes {
+		if vt.claim == key && vt.span == nil {
+			h.startVolume(ct, vt, time.Time{})
+		}
+	}
+}
+
+// updateClaim phase变化时记录，变为Bound时结束绑定span
+func (h *VolumeHandler) updateClaim(claim *v1.PersistentVolumeClaim) {
+	ct, ok := h.claims[claim.Namespace+"/"+claim.Name]
+	if !ok {
+		log.Println("not found carrier:", claim.Name)
+		return
+	}
+	if ct.phase == claim.Status.Phase {
+		return
+	}
+	oldPhase := ct.phase
+	ct.phase = claim.Status.Phase
+
+	_, span := h.provider.Tracer("volumes").Start(ct.info.Ctx, fmt.Sprintf("%s %s -> %s", claim.Name, oldPhase, claim.Status.Phase))
+	span.SetAttributes(h.claimAttributes(claim)...)
+	if claim.Status.Phase == v1.ClaimLost {
+		span.SetStatus(codes.Error, "claim lost its underlying volume")
+	}
+	span.End()
+
+	if ct.binding != nil && claim.Status.Phase != v1.ClaimPending {
+		ct.binding.SetAttributes(h.claimAttributes(claim)...)
+		if claim.Status.Phase != v1.ClaimBound {
+			ct.binding.SetStatus(codes.Error, fmt.Sprintf("claim is %s", claim.Status.Phase))
+		}
+		ct.binding.End()
+		ct.binding = nil
+	}
+}
+
+func (h *VolumeHandler) deleteClaim(claim *v1.PersistentVolumeClaim, finalStateUnknown bool) {
+	key := claim.Namespace + "/" + claim.Name
+	ct, ok := h.claims[key]
+	if !ok {
+		log.Println("not found carrier:", claim.Name)
+		return
+	}
+	delete(h.claims, key)
+	if ct.binding != nil {
+		ct.binding.SetStatus(codes.Error, "claim deleted before it was bound")
+		ct.binding.End()
+	}
+
+	endLifecycle(h.provider.Tracer("volumes"), ct.info, claim, "pvc", fmt.Sprintf("pvc-%s/%s", claim.Name, claim.Namespace), finalStateUnknown)
+}
+
+// updateVolume PV绑定到PVC后，在PVC的trace中开启PV的span，phase变化记录为span event
+func (h *VolumeHandler) updateVolume(oldVolume, volume *v1.PersistentVolume) {
+	vt, ok := h.volumes[volume.Name]
+	if !ok {
+		vt = &volumeTrace{}
+		h.volumes[volume.Name] = vt
+	}
+	vt.volume = volume
+	if ref := volume.Spec.ClaimRef; ref != nil {
+		vt.claim = ref.Namespace + "/" + ref.Name
+	}
+	if vt.span == nil {
+		ct, ok := h.claims[vt.claim]
+		if !ok {
+			return
+		}
+		// 新增的PV从创建时间开始，动态供应的PV创建时即为供应完成
+		h.startVolume(ct, vt, volume.CreationTimestamp.Time)
+		return
+	}
+	if h.recordVolumePhase(vt) && oldVolume != nil {
+		vt.span.SetAttributes(volumeAttributes(volume)...)
+	}
+}
+
+// startVolume 在PVC的trace中开启PV的span，记录PV的属性与当前phase
+func (h *VolumeHandler) startVolume(ct *claimTrace, vt *volumeTrace, start time.Time) {
+	var startOpts []oteltrace.SpanStartOption
+	if !start.IsZero() {
+		startOpts = append(startOpts, oteltrace.WithTimestamp(start))
+	}
+	_, vt.span = h.provider.Tracer("volumes").Start(ct.info.Ctx, fmt.Sprintf("pv-%s", vt.volume.Name), startOpts...)
+	vt.span.SetAttributes(volumeAttributes(vt.volume)...)
+	h.recordVolumePhase(vt)
+}
+
+// recordVolumePhase PV的phase变化时记录为span event，Failed时设置span状态，返回phase是否变化
+func (h *VolumeHandler) recordVolumePhase(vt *volumeTrace) bool {
+	volume := vt.volume
+	if vt.phase == volume.Status.Phase {
+		return false
+	}
+	vt.phase = volume.Status.Phase
+	vt.span.AddEvent(string(volume.Status.Phase), oteltrace.WithAttributes(
+		attribute.KeyValue{
+			Key:   "reason",
+			Value: attribute.StringValue(volume.Status.Reason),
+		},
+		attribute.KeyValue{
+			Key:   "message",
+			Value: attribute.StringValue(volume.Status.Message),
+		},
+	))
+	if volume.Status.Phase == v1.VolumeFailed {
+		vt.span.SetStatus(codes.Error, volume.Status.Message)
+	}
+	return true
+}
+
+// RecordEvent 挂载相关的pod event中的卷为PV时，把event记录到PVC的trace
+func (h *VolumeHandler) RecordEvent(e *k8sEvent) {
+	if h == nil || !volumeEventReasons[e.Reason] {
+		return
+	}
+	m := volumeNameRegexp.FindStringSubmatch(e.Message)
+	if m == nil {
+		return
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	vt, ok := h.volumes[m[1]]
+	if !ok {
+		return
+	}
+	ct, ok := h.claims[vt.claim]
+	if !ok {
+		return
+	}
+	attrs := append(e.attributes(), attribute.KeyValue{
+		Key:   "pod",
+		Value: attribute.StringValue(e.Regarding.Namespace + "/" + e.Regarding.Name),
+	})
+	oteltrace.SpanFromContext(ct.info.Ctx).AddEvent(e.Reason, oteltrace.WithTimestamp(e.LastTime), oteltrace.WithAttributes(attrs...))
+}
+
+// ClaimLinks pod等待挂载卷(ContainerCreating)时，指向其PVC trace的link
+func (h *VolumeHandler) ClaimLinks(pod *v1.Pod, reason string) []oteltrace.Link {
+	if h == nil || reason != volumeWaitingReason {
+		return nil
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	var links []oteltrace.Link
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			continue
+		}
+		key := pod.Namespace + "/" + volume.PersistentVolumeClaim.ClaimName
+		ct, ok := h.claims[key]
+		if !ok {
+			continue
+		}
+		links = append(links, oteltrace.Link{
+			SpanContext: oteltrace.SpanContextFromContext(ct.info.Ctx),
+			Attributes: []attribute.KeyValue{
+				{
+					Key:   "claim",
+					Value: attribute.StringValue(key),
+				},
+				{
+					Key:   "volume",
+					Value: attribute.StringValue(volume.Name),
+				},
+				{
+					Key:   "phase",
+					Value: attribute.StringValue(string(ct.phase)),
+				},
+			},
+		})
+	}
+	return links
+}
+
+// spanInfo 根据UID查找PVC的SpanInfo
+func (h *VolumeHandler) spanInfo(uid types.UID) (*SpanInfo, bool) {
+	if h == nil {
+		return nil, false
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, ct := range h.claims {
+		if ct.uid == uid {
+			return ct.info, true
+		}
+	}
+	return nil, false
+}
+
+// claimAttributes PVC的storage class、访问模式、容量等属性，
+// 没有指定storage class时使用集群的默认class
+func (h *VolumeHandler) claimAttributes(claim *v1.PersistentVolumeClaim) []attribute.KeyValue {
+	class := k8shelper.GetPersistentVolumeClaimClass(claim)
+	attrs := []attribute.KeyValue{
+		{
+			Key:   "storageClass",
+			Value: attribute.StringValue(class),
+		},
+		{
+			Key:   "accessModes",
+			Value: attribute.StringValue(k8shelper.GetAccessModesAsString(claim.Spec.AccessModes)),
+		},
+		{
+			Key:   "phase",
+			Value: attribute.StringValue(string(claim.Status.Phase)),
+		},
+		{
+			Key:   "volumeName",
+			Value: attribute.StringValue(claim.Spec.VolumeName),
+		},
+	}
+	if request, ok := claim.Spec.Resources.Requests[v1.ResourceStorage]; ok {
+		attrs = append(attrs, attribute.KeyValue{
+			Key:   "requestedStorage",
+			Value: attribute.StringValue(request.String()),
+		})
+	}
+	if capacity, ok := claim.Status.Capacity[v1.ResourceStorage]; ok {
+		attrs = append(attrs, attribute.KeyValue{
+			Key:   "capacity",
+			Value: attribute.StringValue(capacity.String()),
+		})
+	}
+	if len(claim.Status.AccessModes) != 0 {
+		attrs = append(attrs, attribute.KeyValue{
+			Key:   "boundAccessModes",
+			Value: attribute.StringValue(k8shelper.GetAccessModesAsString(claim.Status.AccessModes)),
+		})
+	}
+	return append(attrs, h.classAttributes(class, claim.Spec.StorageClassName == nil)...)
+}
+
+// classAttributes storage class的绑定模式(WaitForFirstConsumer时PVC在pod调度后才会绑定)与是否为默认class
+func (h *VolumeHandler) classAttributes(class string, unset bool) []attribute.KeyValue {
+	if h.classes == nil {
+		return nil
+	}
+	classes, err := h.classes.List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	for _, sc := range classes {
+		// 没有指定storage class的PVC使用默认class
+		if sc.Name != class && !(unset && class == "" && k8shelper.IsDefaultAnnotation(sc.ObjectMeta)) {
+			continue
+		}
+		attrs := []attribute.KeyValue{
+			{
+				Key:   "storageClassDefault",
+				Value: attribute.BoolValue(k8shelper.IsDefaultAnnotation(sc.ObjectMeta)),
+			},
+			{
+				Key:   "provisioner",
+				Value: attribute.StringValue(sc.Provisioner),
+			},
+		}
+		if sc.VolumeBindingMode != nil {
+			attrs = append(attrs, attribute.KeyValue{
+				Key:   "volumeBindingMode",
+				Value: attribute.StringValue(string(*sc.VolumeBindingMode)),
+			})
+		}
+		return attrs
+	}
+	return nil
+}
+
+// volumeAttributes PV的storage class、访问模式、容量与回收策略
+func volumeAttributes(volume *v1.PersistentVolume) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		{
+			Key:   "volume",
+			Value: attribute.StringValue(volume.Name),
+		},
+		{
+			Key:   "storageClass",
+			Value: attribute.StringValue(k8shelper.GetPersistentVolumeClass(volume)),
+		},
+		{
+			Key:   "accessModes",
+			Value: attribute.StringValue(k8shelper.GetAccessModesAsString(volume.Spec.AccessModes)),
+		},
+		{
+			Key:   "reclaimPolicy",
+			Value: attribute.StringValue(string(volume.Spec.PersistentVolumeReclaimPolicy)),
+		},
+		{
+			Key:   "phase",
+			Value: attribute.StringValue(string(volume.Status.Phase)),
+		},
+	}
+	if capacity, ok := volume.Spec.Capacity[v1.ResourceStorage]; ok {
+		attrs = append(attrs, attribute.KeyValue{
+			Key:   "capacity",
+			Value: attribute.StringValue(capacity.String()),
+		})
+	}
+	if volume.Spec.CSI != nil {
+		attrs = append(attrs, attribute.KeyValue{
+			Key:   "driver",
+			Value: attribute.StringValue(volume.Spec.CSI.Driver),
+		})
+	}
+	return attrs
+}
@@ -0,0 +1,360 @@
+package k8s_resource_otel
+
+import (
+	"context"
+	"fmt"
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/lru"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"log"
+	"strings"
+)
+
+// WorkloadCtxSet 使用lru缓存存入各类工作负载(Deployment ReplicaSet等)的SpanInfo，
+// key为对象的UID，pod或子资源可通过OwnerReferences找到owner的trace并加入
+var WorkloadCtxSet *lru.Cache[types.UID, *SpanInfo]
+
+const (
+	// WorkloadEvictedStatus 工作负载被WorkloadCtxSet淘汰时span的状态描述
+	WorkloadEvictedStatus   = "evicted from tracking cache"
+	workloadCacheMaxEntries = 12800
+)
+
+func init() {
+	cacheConfig := lru.NewCacheConfig[types.UID, *SpanInfo](0, workloadCacheMaxEntries, lru.ChangeCallbacks[types.UID, *SpanInfo]{EvictFunc: onWorkloadEvicted})
+	WorkloadCtxSet = lru.NewCache(cacheConfig.LRUCacheMode(), cacheConfig)
+}
+
+// onWorkloadEvicted 缓存满时工作负载被淘汰，结束其span，否则span永远不会导出，
+// 主动Remove(对象删除)时span已由调用方处理
+func onWorkloadEvicted(uid types.UID, spanInfo *SpanInfo, reason lru.EvictReason) {
+	if reason != lru.EvictReasonCapacity && reason != lru.EvictReasonExpired {
+		return
+	}
+	log.Println("workload evicted from tracking cache:", spanInfo.Key)
+	parentSpan := oteltrace.SpanFromContext(spanInfo.RootCtx)
+	childSpan := oteltrace.SpanFromContext(spanInfo.Ctx)
+
+	parentSpan.SetStatus(codes.Error, WorkloadEvictedStatus)
+	defer childSpan.End()
+	defer parentSpan.End()
+
+	childSpan.SetStatus(codes.Error, WorkloadEvictedStatus)
+	childSpan.SetAttributes(attribute.KeyValue{
+		Key:   "cacheMaxEntries",
+		Value: attribute.IntValue(workloadCacheMaxEntries),
+	})
+}
+
+// workloadStatus 从各类工作负载中抽取出的通用字段，
+// 用于统一判断扩缩容、spec变更与rollout进度
+type workloadStatus struct {
+	Kind string
+	Meta *metav1.ObjectMeta
+	// Desired 期望副本数，job为parallelism，cronjob为0
+	Desired int32
+	// Ready Updated Available 各类副本数
+	Ready     int32
+	Updated   int32
+	Available int32
+	// ObservedGeneration controller已处理的generation
+	ObservedGeneration int64
+	// Progress 非副本类型资源的进度描述，如job的 succeeded/failed
+	Progress string
+	// Finished 资源是否已经结束(目前只有job会结束)
+	Finished bool
+	// Failed 结束时是否失败
+	Failed bool
+}
+
+// toWorkloadStatus 把informer传入的对象转为workloadStatus，不支持的类型返回false
+func toWorkloadStatus(obj interface{}) (*workloadStatus, bool) {
+	switch o := obj.(type) {
+	case *appsv1.Deployment:
+		return &workloadStatus{
+			Kind:               "Deployment",
+			Meta:               &o.ObjectMeta,
+			Desired:            replicasOf(o.Spec.Replicas),
+			Ready:              o.Status.ReadyReplicas,
+			Updated:            o.Status.UpdatedReplicas,
+			Available:          o.Status.AvailableReplicas,
+			ObservedGeneration: o.Status.ObservedGeneration,
+		}, true
+	case *appsv1.ReplicaSet:
+		return &workloadStatus{
+			Kind:               "ReplicaSet",
+			Meta:               &o.ObjectMeta,
+			Desired:            replicasOf(o.Spec.Replicas),
+			Ready:              o.Status.ReadyReplicas,
+			Updated:            o.Status.FullyLabeledReplicas,
+			Available:          o.Status.AvailableReplicas,
+			ObservedGeneration: o.Status.ObservedGeneration,
+		}, true
+	case *appsv1.StatefulSet:
+		return &workloadStatus{
+			Kind:               "StatefulSet",
+			Meta:               &o.ObjectMeta,
+			Desired:            replicasOf(o.Spec.Replicas),
+			Ready:              o.Status.ReadyReplicas,
+			Updated:            o.Status.UpdatedReplicas,
+			Available:          o.Status.AvailableReplicas,
+			ObservedGeneration: o.Status.ObservedGeneration,
+			Progress:           fmt.Sprintf("currentRevision: %s updateRevision: %s", o.Status.CurrentRevision, o.Status.UpdateRevision),
+		}, true
+	case *appsv1.DaemonSet:
+		return &workloadStatus{
+			Kind:               "DaemonSet",
+			Meta:               &o.ObjectMeta,
+			Desired:            o.Status.DesiredNumberScheduled,
+			Ready:              o.Status.NumberReady,
+			Updated:            o.Status.UpdatedNumberScheduled,
+			Available:          o.Status.NumberAvailable,
+			ObservedGeneration: o.Status.ObservedGeneration,
+		}, true
+	case *batchv1.Job:
+		s := &workloadStatus{
+			Kind:      "Job",
+			Meta:      &o.ObjectMeta,
+			Desired:   replicasOf(o.Spec.Parallelism),
+			Ready:     o.Status.Active,
+			Available: o.Status.Succeeded,
+			Progress:  fmt.Sprintf("active: %d succeeded: %d failed: %d", o.Status.Active, o.Status.Succeeded, o.Status.Failed),
+		}
+		for _, c := range o.Status.Conditions {
+			if c.Status != v1.ConditionTrue {
+				continue
+			}
+			switch c.Type {
+			case batchv1.JobComplete:
+				s.Finished = true
+			case batchv1.JobFailed:
+				s.Finished = true
+				s.Failed = true
+				s.Progress = fmt.Sprintf("%s reason: %s", s.Progress, c.Reason)
+			}
+		}
+		return s, true
+	case *batchv1.CronJob:
+		lastSchedule := ""
+		if o.Status.LastScheduleTime != nil {
+			lastSchedule = o.Status.LastScheduleTime.String()
+		}
+		return &workloadStatus{
+			Kind:     "CronJob",
+			Meta:     &o.ObjectMeta,
+			Ready:    int32(len(o.Status.Active)),
+			Progress: fmt.Sprintf("active: %d lastScheduleTime: %s", len(o.Status.Active), lastSchedule),
+		}, true
+	}
+	return nil, false
+}
+
+func replicasOf(r *int32) int32 {
+	if r == nil {
+		return 1
+	}
+	return *r
+}
+
+// ownerSpanInfo 根据OwnerReferences找到owner的SpanInfo，优先使用controller owner
+func ownerSpanInfo(refs []metav1.OwnerReference) (*SpanInfo, bool) {
+	if ref := metav1.GetControllerOfNoCopy(&metav1.ObjectMeta{OwnerReferences: refs}); ref != nil {
+		if spanInfo, ok := WorkloadCtxSet.Get(ref.UID); ok {
+			return spanInfo, true
+		}
+	}
+	for _, ref := range refs {
+		if spanInfo, ok := WorkloadCtxSet.Get(ref.UID); ok {
+			return spanInfo, true
+		}
+	}
+	return nil, false
+}
+
+// WorkloadHandler 处理Deployment ReplicaSet StatefulSet DaemonSet Job CronJob，
+// 每个对象拥有自己的生命周期trace：创建、spec变更、扩缩容、rollout进度与删除，
+// 如果对象有owner(ex: Deployment创建的ReplicaSet)，则加入owner的trace
+type WorkloadHandler struct {
+	provider *trace.TracerProvider
+	kind     string
+	// rollouts Deployment的rollout追踪
+	rollouts *RolloutTracker
+}
+
+func NewWorkloadHandler(kind string) *WorkloadHandler {
+	return &WorkloadHandler{
+		provider: GlobalJaegerProvider,
+		kind:     kind,
+		rollouts: GlobalRolloutTracker,
+	}
+}
+
+func (w *WorkloadHandler) tracer() oteltrace.Tracer {
+	return w.provider.Tracer(strings.ToLower(w.kind) + "s")
+}
+
+func (w *WorkloadHandler) OnAdd(obj interface{}, isInInitialList bool) {
+	ws, ok := toWorkloadStatus(obj)
+	if !ok {
+		return
+	}
+	// 接管leader时重放的对象已经在追踪(本副本上一个任期中的对象)，不能再开启新的trace
+	if _, ok := WorkloadCtxSet.Peek(ws.Meta.UID); ok {
+		return
+	}
+	// 有owner时加入owner的trace，否则新建trace
+	parentCtx := context.Background()
+	if owner, ok := ownerSpanInfo(ws.Meta.OwnerReferences); ok {
+		parentCtx = owner.Ctx
+	}
+	attrs := workloadAttributes(ws)
+	if len(ws.Meta.OwnerReferences) != 0 {
+		attrs = append(attrs, attribute.KeyValue{
+			Key:   "ownerReference",
+			Value: attribute.StringValue(fmt.Sprintf("name: %s kind: %s", ws.Meta.OwnerReferences[0].Name, ws.Meta.OwnerReferences[0].Kind)),
+		})
+	}
+	WorkloadCtxSet.Add(ws.Meta.UID, startLifecycle(w.tracer(), parentCtx, ws.Meta,
+		fmt.Sprintf("%s-%s/%s", strings.ToLower(ws.Kind), ws.Meta.Name, ws.Meta.Namespace),
+		fmt.Sprintf("%s-lifecycle", strings.ToLower(ws.Kind)), isInInitialList, attrs...))
+
+	// 新ReplicaSet创建时的副本数是rollout的第一次扩容，初始列表中的ReplicaSet不属于进行中的rollout
+	if rs, ok := obj.(*appsv1.ReplicaSet); ok && !isInInitialList {
+		w.rollouts.OnReplicaSetAdd(rs)
+	}
+}
+
+func (w *WorkloadHandler) OnUpdate(oldObj, newObj interface{}) {
+	oldWs, ok := toWorkloadStatus(oldObj)
+	if !ok {
+		return
+	}
+	ws, ok := toWorkloadStatus(newObj)
+	if !ok {
+		return
+	}
+	// resync时对象未变化，不需要记录
+	if oldWs.Meta.ResourceVersion == ws.Meta.ResourceVersion {
+		return
+	}
+
+	spanInfo, ok := WorkloadCtxSet.Get(ws.Meta.UID)
+	if !ok {
+		log.Println("not found carrier:", ws.Kind, ws.Meta.Name)
+		return
+	}
+	newCtx := otel.GetTextMapPropagator().Extract(context.Background(), spanInfo.Carrier)
+	tracer := w.tracer()
+
+	// 1. 扩缩容
+	if oldWs.Desired != ws.Desired {
+		action := "scale-up"
+		if ws.Desired < oldWs.Desired {
+			action = "scale-down"
+		}
+		_, span := tracer.Start(newCtx, fmt.Sprintf("%s %d -> %d", action, oldWs.Desired, ws.Desired))
+		span.SetAttributes(workloadAttributes(ws)...)
+		span.End()
+	}
+
+	// 2. spec变更：generation变化但不是单纯的扩缩容
+	if oldWs.Meta.Generation != ws.Meta.Generation && oldWs.Desired == ws.Desired {
+		_, span := tracer.Start(newCtx, fmt.Sprintf("spec-change(generation %d)", ws.Meta.Generation))
+		span.SetAttributes(workloadAttributes(ws)...)
+		span.End()
+	}
+
+	// 3. rollout进度
+	if workloadProgressChanged(oldWs, ws) {
+		_, span := tracer.Start(newCtx, fmt.Sprintf("progress %d/%d", ws.Ready, ws.Desired))
+		span.SetAttributes(workloadAttributes(ws)...)
+		span.End()
+	}
+
+	// 4. Deployment的rollout
+	switch n := newObj.(type) {
+	case *appsv1.Deployment:
+		w.rollouts.OnDeploymentUpdate(spanInfo.Ctx, oldObj.(*appsv1.Deployment), n)
+	case *appsv1.ReplicaSet:
+		w.rollouts.OnReplicaSetUpdate(oldObj.(*appsv1.ReplicaSet), n)
+	}
+
+	// 5. job结束，结束生命周期span
+	if ws.Finished && !oldWs.Finished {
+		childSpan := oteltrace.SpanFromContext(spanInfo.Ctx)
+		if ws.Failed {
+			childSpan.SetStatus(codes.Error, ws.Progress)
+		} else {
+			childSpan.SetStatus(codes.Ok, ws.Progress)
+		}
+		childSpan.End()
+	}
+}
+
+func (w *WorkloadHandler) OnDelete(obj interface{}) {
+	obj, finalStateUnknown := unwrapTombstone(obj)
+	ws, ok := toWorkloadStatus(obj)
+	if !ok {
+		return
+	}
+	spanInfo, ok := WorkloadCtxSet.Get(ws.Meta.UID)
+	if !ok {
+		log.Println("not found carrier:", ws.Kind, ws.Meta.Name)
+		return
+	}
+	WorkloadCtxSet.Remove(ws.Meta.UID)
+	if dep, ok := obj.(*appsv1.Deployment); ok {
+		w.rollouts.OnDeploymentDelete(dep)
+	}
+
+	endLifecycle(w.tracer(), spanInfo, ws.Meta, strings.ToLower(ws.Kind),
+		fmt.Sprintf("%s-%s/%s", strings.ToLower(ws.Kind), ws.Meta.Name, ws.Meta.Namespace), finalStateUnknown, workloadAttributes(ws)...)
+}
+
+func workloadProgressChanged(old, new *workloadStatus) bool {
+	return old.Ready != new.Ready ||
+		old.Updated != new.Updated ||
+		old.Available != new.Available ||
+		old.ObservedGeneration != new.ObservedGeneration ||
+		old.Progress != new.Progress
+}
+
+// workloadAttributes 工作负载span需要记录的字段
+func workloadAttributes(ws *workloadStatus) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		{
+			Key:   "kind",
+			Value: attribute.StringValue(ws.Kind),
+		},
+		{
+			Key:   "namespace",
+			Value: attribute.StringValue(ws.Meta.Namespace),
+		},
+		{
+			Key:   "generation",
+			Value: attribute.Int64Value(ws.Meta.Generation),
+		},
+		{
+			Key:   "replicas",
+			Value: attribute.StringValue(fmt.Sprintf("desired: %d ready: %d updated: %d available: %d", ws.Desired, ws.Ready, ws.Updated, ws.Available)),
+		},
+	}
+	if ws.Progress != "" {
+		attrs = append(attrs, attribute.KeyValue{
+			Key:   "progress",
+			Value: attribute.StringValue(ws.Progress),
+		})
+	}
+	return attrs
+}
+
+var _ cache.ResourceEventHandler = &WorkloadHandler{}
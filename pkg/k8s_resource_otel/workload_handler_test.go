@@ -0,0 +1,42 @@
+package k8s_resource_otel
+
+import (
+	"github.com/practice/opentelemetry-practice/pkg/k8s_resource_otel/helpers/lru"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"testing"
+)
+
+func TestWorkloadEvictedSpanEnded(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	GlobalJaegerProvider = trace.NewTracerProvider(trace.WithSpanProcessor(recorder))
+	GlobalRolloutTracker = NewRolloutTracker(GlobalJaegerProvider)
+	cacheConfig := lru.NewCacheConfig[types.UID, *SpanInfo](0, 1, lru.ChangeCallbacks[types.UID, *SpanInfo]{EvictFunc: onWorkloadEvicted})
+	WorkloadCtxSet = lru.NewCache(cacheConfig.LRUCacheMode(), cacheConfig)
+
+	handler := NewWorkloadHandler("Deployment")
+	for _, name := range []string{"foo", "bar"} {
+		handler.OnAdd(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name)}}, false)
+	}
+
+	// 缓存只能保存一个对象，foo被淘汰，其根span与生命周期span都已结束
+	ended := recorder.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("expected the evicted root and lifecycle spans to end, got %d spans", len(ended))
+	}
+	for _, span := range ended {
+		if span.Status().Code != codes.Error || span.Status().Description != WorkloadEvictedStatus {
+			t.Errorf("span %s: expected evicted status, got %v", span.Name(), span.Status())
+		}
+	}
+	if _, ok := WorkloadCtxSet.Peek("foo"); ok {
+		t.Errorf("expected foo to be evicted")
+	}
+	if _, ok := WorkloadCtxSet.Peek("bar"); !ok {
+		t.Errorf("expected bar to be tracked")
+	}
+}
@@ -0,0 +1,87 @@
+package k8s_resource_otel
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func init() {
+	workqueue.SetProvider(newWorkqueueMetricsProvider())
+}
+
+// workqueueMetricsProvider 把client-go workqueue的指标暴露为prometheus指标，使用name label区分不同队列
+type workqueueMetricsProvider struct {
+	depth                   *prometheus.GaugeVec
+	adds                    *prometheus.CounterVec
+	latency                 *prometheus.HistogramVec
+	workDuration            *prometheus.HistogramVec
+	unfinishedWork          *prometheus.GaugeVec
+	longestRunningProcessor *prometheus.GaugeVec
+	retries                 *prometheus.CounterVec
+}
+
+var _ workqueue.MetricsProvider = &workqueueMetricsProvider{}
+
+func newWorkqueueMetricsProvider() *workqueueMetricsProvider {
+	return &workqueueMetricsProvider{
+		depth: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "k8s_informer_workqueue_depth",
+			Help: "Current depth of the workqueue",
+		}, []string{"name"}),
+		adds: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "k8s_informer_workqueue_adds_total",
+			Help: "The total number of adds handled by the workqueue",
+		}, []string{"name"}),
+		latency: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "k8s_informer_workqueue_queue_duration_seconds",
+			Help:    "How long an item stays in the workqueue before being requested",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"name"}),
+		workDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "k8s_informer_workqueue_work_duration_seconds",
+			Help:    "How long processing an item from the workqueue takes",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}, []string{"name"}),
+		unfinishedWork: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "k8s_informer_workqueue_unfinished_work_seconds",
+			Help: "How many seconds of work has been done that is in progress",
+		}, []string{"name"}),
+		longestRunningProcessor: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "k8s_informer_workqueue_longest_running_processor_seconds",
+			Help: "How many seconds the longest running processor has been running",
+		}, []string{"name"}),
+		retries: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "k8s_informer_workqueue_retries_total",
+			Help: "The total number of retries handled by the workqueue",
+		}, []string{"name"}),
+	}
+}
+
+func (w *workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return w.depth.WithLabelValues(name)
+}
+
+func (w *workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return w.adds.WithLabelValues(name)
+}
+
+func (w *workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return w.latency.WithLabelValues(name)
+}
+
+func (w *workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return w.workDuration.WithLabelValues(name)
+}
+
+func (w *workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return w.unfinishedWork.WithLabelValues(name)
+}
+
+func (w *workqueueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return w.longestRunningProcessor.WithLabelValues(name)
+}
+
+func (w *workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return w.retries.WithLabelValues(name)
+}